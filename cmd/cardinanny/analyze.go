@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/mclarke47/cardinanny/pkg"
+	"go.uber.org/zap"
+)
+
+// runAnalyze scans once and prints a report without touching the prometheus
+// config, so it can run in CI against a staging prometheus.
+func runAnalyze(args []string, logger *zap.SugaredLogger) int {
+	fs := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	promBaseURL := fs.String("prometheusBaseURL", "http://localhost:9090", "the base URL to use to connect to prometheus")
+	promClientConfigFile := fs.String("prometheusClientConfigFile", "", "path to a file with the HTTP client config used to connect to prometheus")
+	labelLimit := fs.Uint64("cardinalityLabelLimit", 1000000, "the max number of values a label can have")
+	scanBackend := fs.String("scanBackend", pkg.ScanBackendAuto, "how label value counts are found, one of auto, tsdb, promql or labels")
+	format := fs.String("format", "table", "output format, one of table, json or csv")
+	output := fs.String("output", "", "also save the report as JSON to this file")
+	from := fs.String("from", "", "load the report from a saved report or TSDB stats JSON file instead of scanning prometheus")
+	baseline := fs.String("baseline", "", "print the difference between this saved report or TSDB stats JSON file and the new report")
+	failOnOverLimit := fs.Bool("failOnOverLimit", false, "exit with code 3 if any label is over the limit")
+	failOnGrowth := fs.Float64("failOnGrowth", 0, "exit with code 3 if any label's value count grew by more than this ratio compared to the baseline, e.g. 0.1 for 10%")
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	// checked before anything is written to -output
+	switch *format {
+	case "table", "json", "csv":
+	default:
+		logger.Errorw("unknown report format, expected table, json or csv", "format", *format)
+		return exitUsage
+	}
+
+	var report *pkg.Report
+	var err error
+
+	if *from != "" {
+		report, err = pkg.LoadReport(*from, *labelLimit)
+	} else {
+		report, err = scanReport(*promBaseURL, *promClientConfigFile, *labelLimit, *scanBackend, logger)
+	}
+	if err != nil {
+		logger.Errorw("unable to build report", "error", err)
+		return exitError
+	}
+
+	if *output != "" {
+		var b bytes.Buffer
+		if err := report.WriteJSON(&b); err != nil {
+			logger.Errorw("unable to save report", "error", err)
+			return exitError
+		}
+		if err := ioutil.WriteFile(*output, b.Bytes(), 0644); err != nil {
+			logger.Errorw("unable to save report", "error", err)
+			return exitError
+		}
+	}
+
+	exitCode := exitOK
+
+	if *failOnOverLimit {
+		for _, l := range report.Labels {
+			if l.OverLimit {
+				logger.Warnw("label over the limit", "label", l.Name, "values", l.ValueCount, "limit", *labelLimit)
+				exitCode = exitFindings
+			}
+		}
+	}
+
+	if *baseline == "" {
+		if err := report.Write(os.Stdout, *format); err != nil {
+			logger.Errorw("unable to print report", "error", err)
+			return exitError
+		}
+		return exitCode
+	}
+
+	base, err := pkg.LoadReport(*baseline, *labelLimit)
+	if err != nil {
+		logger.Errorw("unable to load baseline", "error", err)
+		return exitError
+	}
+
+	diffs := pkg.DiffReports(base, report)
+	if err := pkg.WriteDiff(os.Stdout, diffs, *format); err != nil {
+		logger.Errorw("unable to print report", "error", err)
+		return exitError
+	}
+
+	if *failOnGrowth > 0 {
+		for _, d := range diffs {
+			if d.Ratio > *failOnGrowth {
+				logger.Warnw("label value count grew more than allowed", "label", d.Label, "job", d.Job, "old", d.Old, "new", d.New)
+				exitCode = exitFindings
+			}
+		}
+	}
+	return exitCode
+}
+
+func scanReport(baseURL, clientConfigFile string, labelLimit uint64, scanBackend string, logger *zap.SugaredLogger) (*pkg.Report, error) {
+	inst := pkg.DefaultInstanceConfig
+	inst.BaseURL = baseURL
+
+	if clientConfigFile != "" {
+		clientConfig, err := pkg.LoadPromClientConfigFile(clientConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		inst.ClientConfig = *clientConfig
+	}
+
+	promAPI, _, err := newPromAPI(&inst, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	caps, err := pkg.DetectCapabilities(ctx, promAPI, logger)
+	if err != nil {
+		logger.Warnw("unable to detect prometheus capabilities, assuming a long term store", "error", err)
+	}
+
+	source, err := pkg.NewLabelCardinalitySource(scanBackend, promAPI, caps, time.Duration(inst.ScanLookback))
+	if err != nil {
+		return nil, fmt.Errorf("invalid scan backend, %w", err)
+	}
+
+	scanner := pkg.CardinalityScanner{
+		Logger:          logger,
+		PromAPI:         promAPI,
+		Source:          source,
+		LabelCountLimit: labelLimit,
+	}
+	return scanner.Report(ctx)
+}
@@ -2,15 +2,15 @@ package main
 
 import (
 	"context"
-	"flag"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/mclarke47/cardinanny/pkg"
 	"go.uber.org/zap"
 
-	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 )
@@ -20,51 +20,268 @@ type PromContext struct {
 }
 
 type CardiNanny struct {
+	// mu is held by the scans and every change made over HTTP, so only one
+	// of them writes the config and the summary at a time.
+	mu sync.Mutex
+
+	Name               string
 	Logger             *zap.SugaredLogger
 	CardinalityScanner pkg.CardinalityScanner
 	PromConfigRewriter pkg.PromConfigRewriter
 	PromContext        PromContext
 	PromCleaner        pkg.PromCleaner
-	Summary            map[string][]string
+	Policy             pkg.RemediationPolicy
+	Queue              *pkg.RemediationQueue
+	Capabilities       pkg.Capabilities
+	History            *pkg.History
+	Notifier           pkg.Notifier
+	// Leadership is only set when several replicas elect which of them
+	// makes changes.
+	Leadership *pkg.Leadership
+	Summary    map[string][]string
+	// Outcomes is what happened to each label found, for /summary and to
+	// retry the failures.
+	Outcomes *pkg.RemediationOutcomes
+	Breaker  *pkg.CircuitBreaker
+	// Exemptions are the labels reverted by hand, which are not dropped
+	// again by the scans.
+	Exemptions *pkg.Exemptions
+	// ImpactAnalyzers find what breaks when a label is dropped.
+	ImpactAnalyzers []pkg.ImpactAnalyzer
+
+	// proposals are the changes pushed to a git branch and waiting to be
+	// merged, whose labels are left out of the scans meanwhile.
+	proposals []pkg.ConfigChange
+
+	inst                 *pkg.InstanceConfig
+	httpClient           *http.Client
+	capabilitiesDetected bool
+}
+
+// newPromAPI connects to the instance's prometheus, retrying the calls which
+// fail with transient errors.
+func newPromAPI(inst *pkg.InstanceConfig, logger *zap.SugaredLogger) (v1.API, *http.Client, error) {
+	httpClient, err := inst.ClientConfig.NewHTTPClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := api.NewClient(api.Config{
+		Address:      inst.BaseURL,
+		RoundTripper: httpClient.Transport,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return inst.APIRetry.Wrap(v1.NewAPI(client), inst.Name, logger), httpClient, nil
 }
 
-func newCardiNanny(api v1.API, pathToConfigFile, baseURL string, logger *zap.SugaredLogger, labelLimit uint64) *CardiNanny {
-	return &CardiNanny{
-		Summary: map[string][]string{},
-		Logger:  logger,
+func newCardiNanny(inst *pkg.InstanceConfig, history *pkg.History, logger *zap.SugaredLogger) (*CardiNanny, error) {
+	logger = logger.With("instance", inst.Name)
+
+	promAPI, httpClient, err := newPromAPI(inst, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var trend *pkg.TrendDetector
+	if inst.Trend != nil {
+		trend = inst.Trend.NewTrendDetector(inst.LabelLimit)
+	}
+
+	var histograms *pkg.HistogramBucketCheck
+	if inst.Scan.MaxHistogramBuckets > 0 {
+		histograms = &pkg.HistogramBucketCheck{Logger: logger, PromAPI: promAPI, MaxBuckets: inst.Scan.MaxHistogramBuckets}
+	}
+
+	var exemplars *pkg.ExemplarScanner
+	if inst.Scan.ExemplarLookback > 0 {
+		exemplars = &pkg.ExemplarScanner{Logger: logger, PromAPI: promAPI, Lookback: time.Duration(inst.Scan.ExemplarLookback)}
+	}
+
+	// label drops scoped to instances go by the attribution of the scan
+	var targets, scopedTargets *pkg.TargetAttributor
+	if inst.Scan.AttributeTargets || inst.Policy.Scope == pkg.ScopeInstance {
+		targets = &pkg.TargetAttributor{Logger: logger, PromAPI: promAPI, OutlierFactor: inst.Scan.TargetOutlierFactor}
+	}
+	if inst.Policy.Scope == pkg.ScopeInstance {
+		scopedTargets = targets
+	}
+
+	var gitRepo *pkg.GitConfigRepo
+	if inst.Git != nil {
+		gitRepo, err = inst.Git.NewGitConfigRepo(logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var notifier pkg.Notifier
+	if inst.Notify != nil {
+		notifier = inst.Notify.NewNotifier()
+	}
+
+	breaker := &pkg.CircuitBreaker{Instance: inst.Name, Limits: inst.Limits}
+	exemptions := &pkg.Exemptions{Instance: inst.Name}
+	if history != nil {
+		entries, err := history.Entries()
+		if err != nil {
+			return nil, fmt.Errorf("error reading the labels dropped and reverted from history, %w", err)
+		}
+		if inst.Limits.MaxLabelsPerDay > 0 {
+			breaker.Seed(entries)
+		}
+		exemptions.Record(entries...)
+	}
+
+	nanny := &CardiNanny{
+		Name:            inst.Name,
+		Notifier:        notifier,
+		Summary:         map[string][]string{},
+		Outcomes:        &pkg.RemediationOutcomes{Instance: inst.Name},
+		Breaker:         breaker,
+		Exemptions:      exemptions,
+		ImpactAnalyzers: inst.Impact.NewImpactAnalyzers(promAPI, logger),
+		Logger:          logger,
+		Policy:          inst.Policy.RemediationPolicy(),
+		Queue:           &pkg.RemediationQueue{TTL: time.Duration(inst.Policy.ProposalTTL)},
+		History:         history,
 		CardinalityScanner: pkg.CardinalityScanner{
 			Logger:          logger,
-			PromAPI:         api,
-			LabelCountLimit: labelLimit,
+			PromAPI:         promAPI,
+			LabelCountLimit: inst.LabelLimit,
+			Trend:           trend,
+			Histograms:      histograms,
+			Exemplars:       exemplars,
+			Targets:         targets,
+			ProtectedLabels: inst.Scan.ProtectedLabels,
+			Concurrency:     inst.Scan.Concurrency,
+			QueryRateLimit:  inst.Scan.QueryRateLimit,
 		},
 		PromConfigRewriter: pkg.PromConfigRewriter{
-			Logger:     logger,
-			PromAPI:    api,
-			HTTPClient: &http.Client{},
-			BaseURL:    baseURL,
+			Logger:        logger,
+			PromAPI:       promAPI,
+			HTTPClient:    httpClient,
+			BaseURL:       inst.BaseURL,
+			Git:           gitRepo,
+			Instance:      inst.Name,
+			DriftPolicy:   inst.DriftPolicy,
+			ReloadTimeout: time.Duration(inst.ReloadTimeout),
+			Targets:       scopedTargets,
 		},
 		PromContext: PromContext{
-			PathToConfigFile: pathToConfigFile,
+			PathToConfigFile: inst.ConfigFile,
 		},
 		PromCleaner: pkg.PromCleaner{
 			Logger:  logger,
-			PromAPI: api,
+			PromAPI: promAPI,
+			Targets: scopedTargets,
 		},
+		inst:       inst,
+		httpClient: httpClient,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := nanny.detectCapabilities(ctx); err != nil {
+		return nil, err
+	}
+	if trend != nil {
+		backfillTrend(ctx, trend, nanny.CardinalityScanner.Source, promAPI, logger)
+	}
+	return nanny, nil
+}
+
+// detectCapabilities finds what the instance's prometheus supports and picks
+// the scan source, reloader and head series budget to go with it. Until it
+// can tell, a long term store is assumed and detection is tried again on the
+// next cycle.
+func (c *CardiNanny) detectCapabilities(ctx context.Context) error {
+	caps, err := pkg.DetectCapabilities(ctx, c.CardinalityScanner.PromAPI, c.Logger)
+	if err != nil {
+		c.Logger.Warnw("unable to detect prometheus capabilities, assuming a long term store until the next cycle", "error", err)
+	}
+	c.capabilitiesDetected = err == nil
+
+	source, err := pkg.NewLabelCardinalitySource(c.inst.ScanBackend, c.CardinalityScanner.PromAPI, caps, time.Duration(c.inst.ScanLookback))
+	if err != nil {
+		return err
+	}
+
+	var headSeries *pkg.HeadSeriesBudget
+	if c.inst.SeriesBudget > 0 {
+		if caps.TSDBStats {
+			headSeries = &pkg.HeadSeriesBudget{Logger: c.Logger, PromAPI: c.CardinalityScanner.PromAPI, Budget: c.inst.SeriesBudget, Protected: c.inst.Scan.ProtectedLabels}
+		} else if c.capabilitiesDetected {
+			c.Logger.Warnw("head series budget needs the TSDB stats API, ignoring it", "budget", c.inst.SeriesBudget)
+		}
+	}
+
+	c.Capabilities = caps
+	c.CardinalityScanner.Source = source
+	c.CardinalityScanner.HeadSeries = headSeries
+	c.PromConfigRewriter.Reloader = c.inst.Reload.NewReloader(caps, c.httpClient, c.inst.BaseURL, c.Logger)
+	return nil
+}
+
+// backfillTrend loads the recent history of the labels with the most values,
+// failing to do so only delays trend detection until a few scans have run.
+func backfillTrend(ctx context.Context, trend *pkg.TrendDetector, source pkg.LabelCardinalitySource, promAPI v1.API, logger *zap.SugaredLogger) {
+	stats, err := source.LabelValueCounts(ctx)
+	if err != nil {
+		logger.Warnw("unable to backfill label history", "error", err)
+		return
+	}
+
+	if err := trend.Backfill(ctx, promAPI, trend.TopLabels(stats), time.Now()); err != nil {
+		logger.Warnw("unable to backfill label history", "error", err)
 	}
 }
 
 func (c *CardiNanny) Start() {
 	ticker := time.NewTicker(2 * time.Minute)
-	ctx := context.TODO()
-	c.ScanForHighLabelCardinality(ctx)
-
 	for {
-		select {
-		case <-ticker.C:
-			ctx := context.TODO()
-			c.ScanForHighLabelCardinality(ctx)
+		if c.Leadership.IsLeader() {
+			c.ScanForHighLabelCardinality(context.TODO())
+		} else {
+			c.Logger.Debug("not the leader, skipping the cardinality scan")
 		}
+		<-ticker.C
+	}
+}
+
+// SummarySnapshot copies the labels dropped in each job, for /summary.
+func (c *CardiNanny) SummarySnapshot() map[string][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	summary := map[string][]string{}
+	for job, labels := range c.Summary {
+		summary[job] = append([]string{}, labels...)
 	}
+	return summary
+}
+
+// Approve approves a proposed label drop, to be applied by the next scan.
+func (c *CardiNanny) Approve(id string) (pkg.Proposal, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Queue.Approve(id)
+}
+
+// Reject rejects a proposed label drop.
+func (c *CardiNanny) Reject(id string) (pkg.Proposal, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Queue.Reject(id)
+}
+
+// ResetBreaker resumes the label drops paused by the remediation limits.
+func (c *CardiNanny) ResetBreaker() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Breaker.Reset()
 }
 
 func (c *CardiNanny) addToSummary(jobNamesToLabelsToDrop map[string][]string) {
@@ -77,90 +294,444 @@ func (c *CardiNanny) addToSummary(jobNamesToLabelsToDrop map[string][]string) {
 	}
 }
 
-func (c *CardiNanny) ScanForHighLabelCardinality(ctx context.Context) {
-	c.Logger.Infow("starting cardinality scan", "limit", c.CardinalityScanner.LabelCountLimit)
+func (c *CardiNanny) removeFromSummary(job string, labels []string) {
+	var remaining []string
+	for _, l := range c.Summary[job] {
+		if !containsString(labels, l) {
+			remaining = append(remaining, l)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(c.Summary, job)
+		return
+	}
+	c.Summary[job] = remaining
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CardiNanny) notify(ctx context.Context, event pkg.NotificationEvent, message string, plan *pkg.Plan) {
+	if c.Notifier == nil {
+		return
+	}
+	err := c.Notifier.Notify(ctx, pkg.Notification{
+		Instance: c.Name,
+		Event:    event,
+		Time:     time.Now(),
+		Message:  message,
+		Plan:     plan,
+	})
+	if err != nil {
+		c.Logger.Warnw("unable to send notification", "event", event, "error", err)
+	}
+}
+
+// scan carries on with the labels it could find the jobs of when the queries
+// for others failed.
+func (c *CardiNanny) scan(ctx context.Context) (map[string][]string, error) {
 	jobToLabelToDrop, err := c.CardinalityScanner.Scan(ctx)
+	var partial *pkg.PartialScanError
+	if errors.As(err, &partial) {
+		c.Logger.Warnw("scan incomplete, carrying on with the labels found", "error", err)
+		c.Outcomes.Scanned(jobToLabelToDrop, partial.Labels)
+		return jobToLabelToDrop, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when scanning, %w", err)
+	}
+	c.Outcomes.Scanned(jobToLabelToDrop, nil)
+	return jobToLabelToDrop, nil
+}
+
+// impacts finds what uses the labels about to be dropped. Analyzers which
+// fail are left out, so a Prometheus without the rules API can still be
+// looked after.
+func (c *CardiNanny) impacts(ctx context.Context, jobToLabelToDrop map[string][]string) []pkg.Impact {
+	var impacts []pkg.Impact
+	for _, a := range c.ImpactAnalyzers {
+		found, err := a.Impacts(ctx, jobToLabelToDrop)
+		if err != nil {
+			c.Logger.Warnw("unable to check what uses the labels to drop", "error", err)
+			continue
+		}
+		impacts = append(impacts, found...)
+	}
+	return impacts
+}
+
+// labelsToDrop scans and returns the labels which can be dropped now, the
+// approved proposals among them, the labels newly proposed for approval and
+// what uses the labels found. Labels used by rules are blocked or proposed
+// for approval depending on the impact config.
+func (c *CardiNanny) labelsToDrop(ctx context.Context) (map[string][]string, map[string][]string, map[string][]string, []pkg.Impact, error) {
+	c.Logger.Infow("starting cardinality scan", "limit", c.CardinalityScanner.LabelCountLimit)
+	jobToLabelToDrop, err := c.scan(ctx)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	jobToLabelToDrop = c.withoutProposals(ctx, jobToLabelToDrop)
+	jobToLabelToDrop = c.withoutExemptions(jobToLabelToDrop)
+
+	impacts := c.impacts(ctx, jobToLabelToDrop)
+	proceed, escalated, blocked := pkg.SplitByImpact(jobToLabelToDrop, impacts)
+	for _, job := range sortedKeys(blocked) {
+		for _, label := range blocked[job] {
+			c.Logger.Warnw("not dropping a label which would break something using it", "job", job, "label", label, "reason", pkg.ImpactReason(impacts, job, label))
+		}
+	}
+	c.Outcomes.Blocked(blocked, impacts)
+
+	auto, needsApproval := c.Policy.Split(proceed)
+	needsApproval = c.notDropped(ctx, pkg.MergeJobLabels(needsApproval, escalated))
+
+	proposed := map[string][]string{}
+	for _, p := range c.Queue.Propose(needsApproval) {
+		c.Logger.Infow("label drop proposed, waiting for approval", "id", p.ID, "job", p.Job, "label", p.Label, "expires", p.ExpiresAt)
+		proposed[p.Job] = append(proposed[p.Job], p.Label)
+	}
+
+	approved := c.Queue.Approved()
+	return pkg.MergeJobLabels(auto, approved), approved, proposed, impacts, nil
+}
+
+// withoutProposals leaves out the labels of the changes waiting to be merged
+// in git, forgetting the changes whose branch was deleted.
+func (c *CardiNanny) withoutProposals(ctx context.Context, jobToLabelToDrop map[string][]string) map[string][]string {
+	var open []pkg.ConfigChange
+	for _, change := range c.proposals {
+		if !c.PromConfigRewriter.Git.Proposed(ctx, change) {
+			continue
+		}
+		open = append(open, change)
+		jobToLabelToDrop = pkg.WithoutJobLabels(jobToLabelToDrop, change.Jobs)
+	}
+	c.proposals = open
+	return jobToLabelToDrop
+}
+
+// notDropped leaves out the labels the config already drops, such as the
+// approved ones applied by an earlier scan whose series are still around.
+func (c *CardiNanny) notDropped(ctx context.Context, jobToLabelToDrop map[string][]string) map[string][]string {
+	if len(jobToLabelToDrop) == 0 {
+		return jobToLabelToDrop
+	}
+	plan, err := c.PromConfigRewriter.Plan(ctx, jobToLabelToDrop, nil, c.PromContext.PathToConfigFile)
+	if err != nil {
+		c.Logger.Warnw("unable to check which labels are already dropped", "error", err)
+		return jobToLabelToDrop
+	}
+	return plan.Dropped()
+}
+
+// withoutExemptions leaves out the labels reverted by hand.
+func (c *CardiNanny) withoutExemptions(jobToLabelToDrop map[string][]string) map[string][]string {
+	remaining := c.Exemptions.Filter(jobToLabelToDrop)
+	if exempt := pkg.WithoutJobLabels(jobToLabelToDrop, remaining); len(exempt) > 0 {
+		c.Logger.Infow("not dropping labels which were reverted, apply a plan to drop them again", "labels", exempt)
+	}
+	return remaining
+}
+
+// awaitMerge keeps a change pushed to git as pending until its branch is
+// merged or deleted.
+func (c *CardiNanny) awaitMerge(plan *pkg.Plan) {
+	c.proposals = append(c.proposals, plan.Change())
+	c.Outcomes.Pending(plan.Dropped(), "proposed in git, waiting for it to be merged")
+}
+
+// Plan scans and plans dropping every label found, whether or not it needs
+// approval.
+func (c *CardiNanny) Plan(ctx context.Context) (*pkg.Plan, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	jobToLabelToDrop, err := c.scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	jobToLabelToDrop = c.withoutExemptions(jobToLabelToDrop)
+
+	plan, err := c.PromConfigRewriter.Plan(ctx, jobToLabelToDrop, nil, c.PromContext.PathToConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	plan.Instance = c.Name
+	pkg.AnnotateImpacts(plan, c.impacts(ctx, plan.Dropped()))
+	return plan, nil
+}
+
+// ApplyPlan applies a plan made for this instance and records what it
+// changed. With git the change only reaches prometheus once it is deployed,
+// so it is proposed instead and nothing is recorded.
+func (c *CardiNanny) ApplyPlan(ctx context.Context, plan *pkg.Plan) ([]pkg.HistoryEntry, error) {
+	if plan.Instance != c.Name {
+		return nil, fmt.Errorf("%w, expected %s but was %q", pkg.ErrPlanInstance, c.Name, plan.Instance)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.applyPlan(ctx, plan)
+}
+
+func (c *CardiNanny) applyPlan(ctx context.Context, plan *pkg.Plan) ([]pkg.HistoryEntry, error) {
+	plan.Instance = c.Name
+	git := c.PromConfigRewriter.Git
+	if git != nil && git.Proposed(ctx, plan.Change()) {
+		c.Logger.Infow("config change already proposed, waiting for it to be merged", "labels", plan.Dropped())
+		c.awaitMerge(plan)
+		return nil, nil
+	}
+
+	if err := c.PromConfigRewriter.ApplyPlan(ctx, plan, c.PromContext.PathToConfigFile); err != nil {
+		return nil, err
+	}
+
+	if git != nil {
+		if git.PushBranch {
+			c.awaitMerge(plan)
+		}
+		c.notify(ctx, pkg.NotifyProposed, fmt.Sprintf("config change in %d job(s) proposed in git", len(plan.Jobs)), plan)
+		return nil, nil
+	}
+
+	c.addToSummary(plan.Dropped())
+	for job, labels := range plan.Restored() {
+		c.removeFromSummary(job, labels)
+	}
+	c.notify(ctx, pkg.NotifyApplied, fmt.Sprintf("config changed in %d job(s)", len(plan.Jobs)), plan)
+
+	entries := plan.HistoryEntries()
+	c.Exemptions.Record(entries...)
+	if c.History == nil {
+		return entries, nil
+	}
+	recorded, err := c.History.Record(entries...)
+	if err != nil {
+		return nil, fmt.Errorf("config changed but not recorded in history, %w", err)
+	}
+	return recorded, nil
+}
+
+// ScanForHighLabelCardinality drops the high cardinality labels found and
+// deletes their series. Labels which failed to be dropped or cleaned before
+// are retried once their backoff is over, one job failing to be cleaned does
+// not stop the others. Label drops over the remediation limits are held back
+// as pending and pause remediation until it is resumed by hand.
+func (c *CardiNanny) ScanForHighLabelCardinality(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.capabilitiesDetected {
+		if err := c.detectCapabilities(ctx); err != nil {
+			return err
+		}
+	}
+
+	jobToLabelToDrop, approved, proposed, impacts, err := c.labelsToDrop(ctx)
 	if err != nil {
 		c.Logger.Error("Error when scanning", err)
-		return
+		return err
+	}
+
+	if len(proposed) > 0 {
+		plan, err := c.PromConfigRewriter.Plan(ctx, proposed, nil, c.PromContext.PathToConfigFile)
+		if err != nil {
+			c.Logger.Warnw("unable to plan proposed label drops", "error", err)
+		} else if !plan.Empty() {
+			plan.Instance = c.Name
+			pkg.AnnotateImpacts(plan, impacts)
+			c.notify(ctx, pkg.NotifyProposed, "label drops need approval", plan)
+		}
+	}
+
+	jobToLabelToDrop, waiting := c.Outcomes.Ready(jobToLabelToDrop)
+	if len(waiting) > 0 {
+		c.Logger.Infow("label drops failed before, retrying them later", "labels", waiting)
 	}
 
 	if len(jobToLabelToDrop) == 0 {
 		c.Logger.Infow("starting cardinality scan done, no config changed required")
-		return
+		return c.clean(ctx, nil)
 	}
 
 	c.Logger.Infow("high cardinality labels found", "labels", jobToLabelToDrop)
 
-	err = c.PromConfigRewriter.DropLabelsInJobs(ctx, jobToLabelToDrop, c.PromContext.PathToConfigFile)
+	plan, err := c.PromConfigRewriter.Plan(ctx, jobToLabelToDrop, nil, c.PromContext.PathToConfigFile)
 	if err != nil {
-		c.Logger.Error("Error when updating prometheus config", err)
-		return
+		c.Logger.Error("Error when planning prometheus config changes", err)
+		c.Outcomes.Failed(pkg.StepConfig, jobToLabelToDrop, err)
+		return fmt.Errorf("error when planning prometheus config changes, %w", err)
 	}
-	c.addToSummary(jobToLabelToDrop)
+	if plan.Empty() {
+		c.Logger.Infow("high cardinality labels are already dropped, no config changed required", "labels", jobToLabelToDrop)
+		c.Queue.MarkApplied(approved)
+		c.Outcomes.AlreadyRemediated(jobToLabelToDrop)
+		return c.clean(ctx, nil)
+	}
+
+	pkg.AnnotateImpacts(plan, impacts)
+	// the biggest head series contributors are let through first
+	var priority []string
+	if c.CardinalityScanner.HeadSeries != nil {
+		priority = c.CardinalityScanner.HeadSeries.Last()
+	}
+	allowed, held, paused := c.Breaker.Allow(plan.Dropped(), priority)
+	if len(held) > 0 {
+		reason := c.Breaker.Status().Reason
+		c.Logger.Warnw("remediation paused, holding label drops back until it is resumed", "reason", reason, "labels", held)
+		c.Outcomes.Pending(held, "remediation paused, "+reason)
+		if paused {
+			c.notify(ctx, pkg.NotifyPaused, fmt.Sprintf("label drops paused, %s", reason), plan)
+		}
+
+		jobToLabelToDrop = pkg.WithoutJobLabels(jobToLabelToDrop, held)
+		approved = pkg.WithoutJobLabels(approved, held)
+		if len(allowed) == 0 {
+			c.Queue.MarkApplied(approved)
+			c.Outcomes.AlreadyRemediated(jobToLabelToDrop)
+			return c.clean(ctx, nil)
+		}
 
-	// TODO pass job to delete series to ensure we are dropping the right data
-	var labelsToDrop []string
+		plan, err = c.PromConfigRewriter.Plan(ctx, allowed, nil, c.PromContext.PathToConfigFile)
+		if err != nil {
+			c.Logger.Error("Error when planning prometheus config changes", err)
+			c.Outcomes.Failed(pkg.StepConfig, allowed, err)
+			return fmt.Errorf("error when planning prometheus config changes, %w", err)
+		}
+		pkg.AnnotateImpacts(plan, impacts)
+	}
 
-	for _, v := range jobToLabelToDrop {
-		labelsToDrop = append(labelsToDrop, v...)
+	// the scan can take long enough for another replica to take over
+	if !c.Leadership.IsLeader() {
+		c.Logger.Warnw("lost leadership during the scan, leaving the changes to the new leader", "labels", jobToLabelToDrop)
+		return nil
 	}
 
-	err = c.PromCleaner.Clean(ctx, labelsToDrop)
-	if err != nil {
-		c.Logger.Error("Error when cleaning high cardinality data", err)
+	dropped := plan.Dropped()
+	if _, err := c.applyPlan(ctx, plan); err != nil {
+		c.Logger.Error("Error when updating prometheus config", err)
+		c.Outcomes.Failed(pkg.StepConfig, dropped, err)
+		return fmt.Errorf("error when updating prometheus config, %w", err)
 	}
-	c.Logger.Info("Cardinality averted")
+	if c.PromConfigRewriter.Git != nil {
+		c.Queue.MarkApplied(approved)
+		return nil
+	}
+	c.Breaker.Record(dropped)
+	c.Queue.MarkApplied(approved)
+	c.Outcomes.AlreadyRemediated(jobToLabelToDrop)
 
+	return c.clean(ctx, dropped)
 }
 
-func main() {
+// clean deletes the existing series of the labels just dropped and of the
+// ones which failed to be cleaned before, job by job. Changes made through git
+// are not running yet so their series are left alone.
+func (c *CardiNanny) clean(ctx context.Context, dropped map[string][]string) error {
+	if c.PromConfigRewriter.Git != nil {
+		return nil
+	}
+	toClean := pkg.MergeJobLabels(dropped, c.Outcomes.Due(pkg.StepClean))
+	if len(toClean) == 0 {
+		return nil
+	}
 
-	promFilePath := flag.String("prometheusConfigFile", "./prometheus.yml", "path to the prometheus config file")
-	promBaseURL := flag.String("prometheusBaseURL", "http://localhost:9090", "the base URL to use to connect to prometheus")
-	labelLimit := flag.Int("cardinalityLabelLimit", 1000000, "the mac number of values a label can have")
+	if !c.Capabilities.AdminAPI {
+		c.Logger.Infow("admin API not available, existing high cardinality series will age out instead of being deleted", "labels", toClean)
+		c.Outcomes.Remediated(toClean)
+		c.Logger.Info("Cardinality averted")
+		return nil
+	}
 
-	flag.Parse()
+	failed := c.PromCleaner.CleanJobs(ctx, toClean)
+	for job, labels := range toClean {
+		if err, ok := failed[job]; ok {
+			c.Logger.Errorw("Error when cleaning high cardinality data", "job", job, "labels", labels, "error", err)
+			c.Outcomes.Failed(pkg.StepClean, map[string][]string{job: labels}, err)
+			continue
+		}
+		c.Outcomes.Remediated(map[string][]string{job: labels})
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("error when cleaning high cardinality data of %d job(s), retrying them later", len(failed))
+	}
+	c.Logger.Info("Cardinality averted")
+	return nil
+}
 
-	logger, err := zap.NewDevelopment()
-	if err != nil {
-		log.Fatal(err)
+// Revert restores the labels dropped by a history entry and records that it
+// was reverted.
+func (c *CardiNanny) Revert(ctx context.Context, entry pkg.HistoryEntry) (pkg.HistoryEntry, error) {
+	if entry.Action != pkg.HistoryDrop {
+		return pkg.HistoryEntry{}, fmt.Errorf("history entry %s is a %s, only drops can be reverted", entry.ID, entry.Action)
 	}
 
-	defer logger.Sync() // flushes buffer, if any
-	sugar := logger.Sugar()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.revertLabels(ctx, entry.Job, entry.Labels, entry.ID)
+}
 
-	client, err := api.NewClient(api.Config{
-		Address: *promBaseURL,
-	})
+// RevertLabels restores dropped labels of a job, reverts is the ID of the
+// history entry being undone if there is one.
+func (c *CardiNanny) RevertLabels(ctx context.Context, job string, labels []string, reverts string) (pkg.HistoryEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.revertLabels(ctx, job, labels, reverts)
+}
 
+func (c *CardiNanny) revertLabels(ctx context.Context, job string, labels []string, reverts string) (pkg.HistoryEntry, error) {
+	plan, err := c.PromConfigRewriter.Plan(ctx, nil, map[string][]string{job: labels}, c.PromContext.PathToConfigFile)
 	if err != nil {
-		sugar.Fatal("", err)
+		return pkg.HistoryEntry{}, err
 	}
+	if plan.Empty() {
+		return pkg.HistoryEntry{}, fmt.Errorf("%w: %v in job %s", pkg.ErrLabelNotDropped, labels, job)
+	}
+	plan.Instance = c.Name
 
-	v1api := v1.NewAPI(client)
-
-	cardinanny := newCardiNanny(v1api, *promFilePath, *promBaseURL, sugar, uint64(*labelLimit))
+	entry := pkg.HistoryEntry{
+		Instance: c.Name,
+		Action:   pkg.HistoryRevert,
+		Job:      job,
+		Labels:   plan.Restored()[job],
+		Reverts:  reverts,
+		Time:     time.Now(),
+	}
 
-	sugar.Infow("starting Cardinanny with",
-		"configPath", promFilePath,
-		"prometheusBaseURL", promBaseURL,
-		"cardinalityLabelLimit", labelLimit,
-	)
+	// with git the labels are only restored once the change is deployed, it
+	// is proposed like any other change. They are exempted straight away so
+	// the scans don't drop them again once it is.
+	if c.PromConfigRewriter.Git != nil {
+		if _, err := c.applyPlan(ctx, plan); err != nil {
+			return pkg.HistoryEntry{}, err
+		}
+		c.Exemptions.Record(entry)
+		return pkg.HistoryEntry{}, fmt.Errorf("%w: restoring %v in job %s", pkg.ErrChangeProposed, entry.Labels, job)
+	}
 
-	go cardinanny.Start()
+	if err := c.PromConfigRewriter.ApplyPlan(ctx, plan, c.PromContext.PathToConfigFile); err != nil {
+		return pkg.HistoryEntry{}, err
+	}
+	restored := entry.Labels
+	c.removeFromSummary(job, restored)
+	c.Outcomes.Forget(job, restored)
+	c.notify(ctx, pkg.NotifyReverted, fmt.Sprintf("labels %v restored in job %s", restored, job), plan)
 
-	r := gin.Default()
-	r.GET("/ping", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"message": "pong",
-		})
-	})
-	r.GET("/summary", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"summary": cardinanny.Summary,
-		})
-	})
-	r.Run() // listen and serve on 0.0.0.0:8080
+	c.Exemptions.Record(entry)
+	if c.History == nil {
+		return entry, nil
+	}
 
+	recorded, err := c.History.Record(entry)
+	if err != nil {
+		return pkg.HistoryEntry{}, fmt.Errorf("labels restored but not recorded in history, %w", err)
+	}
+	return recorded[0], nil
 }
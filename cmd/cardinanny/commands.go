@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mclarke47/cardinanny/pkg"
+	"go.uber.org/zap"
+)
+
+const commandTimeout = 5 * time.Minute
+
+func sortedKeys(m map[string][]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// runScan scans every instance once and prints the labels which would be
+// dropped, without changing anything.
+func runScan(args []string, logger *zap.SugaredLogger) int {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	instFlags := registerInstanceFlags(fs)
+	format := fs.String("format", "table", "output format, one of table or json")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	nannies, err := instFlags.loadNannies(logger)
+	if err != nil {
+		logger.Errorw("unable to load config", "error", err)
+		return exitError
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	exitCode := exitOK
+	results := map[string]map[string][]string{}
+	for _, n := range nannies {
+		jobs, err := n.CardinalityScanner.Scan(ctx)
+		var partial *pkg.PartialScanError
+		if err != nil {
+			n.Logger.Errorw("error when scanning", "error", err)
+			exitCode = exitError
+			if !errors.As(err, &partial) {
+				continue
+			}
+		}
+		results[n.Name] = jobs
+		if len(jobs) > 0 && exitCode == exitOK {
+			exitCode = exitFindings
+		}
+	}
+
+	switch *format {
+	case "json":
+		err = writeJSON(results)
+	case "table":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "INSTANCE\tJOB\tLABELS")
+		for _, n := range nannies {
+			for _, job := range sortedKeys(results[n.Name]) {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", n.Name, job, strings.Join(results[n.Name][job], ","))
+			}
+		}
+		err = tw.Flush()
+	default:
+		logger.Errorw("unknown output format", "format", *format)
+		return exitUsage
+	}
+	if err != nil {
+		logger.Errorw("unable to print scan results", "error", err)
+		return exitError
+	}
+	return exitCode
+}
+
+// runPlan shows the config changes apply would make right now, including the
+// ones which need approval first.
+func runPlan(args []string, logger *zap.SugaredLogger) int {
+	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+	instFlags := registerInstanceFlags(fs)
+	output := fs.String("output", "", "also save the plans as JSON to this file, for apply -plan")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	nannies, err := instFlags.loadNannies(logger)
+	if err != nil {
+		logger.Errorw("unable to load config", "error", err)
+		return exitError
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	exitCode := exitOK
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tJOB\tCHANGE\tLABELS\tMODE")
+
+	plans := []*pkg.Plan{}
+	for _, n := range nannies {
+		plan, err := n.Plan(ctx)
+		if err != nil {
+			n.Logger.Errorw("unable to plan config changes", "error", err)
+			exitCode = exitError
+			continue
+		}
+		plans = append(plans, plan)
+
+		for _, j := range plan.Jobs {
+			mode := n.Policy.ModeFor(j.Job)
+			changes := []struct {
+				name   string
+				labels []string
+			}{{"add", j.Added}, {"merge", j.Merged}, {"remove", j.Removed}}
+			for _, c := range changes {
+				if len(c.labels) > 0 {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", n.Name, j.Job, c.name, strings.Join(c.labels, ","), mode)
+				}
+			}
+			for _, d := range j.Scoped {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s@%s\t%s\n", n.Name, j.Job, "scope", d.Label, strings.Join(d.Instances, ","), mode)
+			}
+		}
+		if !plan.Empty() && exitCode == exitOK {
+			exitCode = exitFindings
+		}
+	}
+	tw.Flush()
+
+	for _, p := range plans {
+		if !p.Empty() {
+			fmt.Printf("\n# %s\n%s", p.Instance, p.Diff)
+		}
+	}
+
+	if *output != "" {
+		b, err := json.MarshalIndent(plans, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(*output, b, 0644)
+		}
+		if err != nil {
+			logger.Errorw("unable to save plans", "error", err)
+			return exitError
+		}
+	}
+	return exitCode
+}
+
+// runApply runs a single scan and remediation cycle, for running from cron,
+// or applies plans saved by plan -output.
+func runApply(args []string, logger *zap.SugaredLogger) int {
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	instFlags := registerInstanceFlags(fs)
+	approveAll := fs.Bool("approveAll", false, "also apply label drops in jobs which need approval, there is nobody to approve them during a one-off run")
+	planFile := fs.String("plan", "", "apply the plans saved in this file instead of scanning, fails if the prometheus config changed since")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	var plans []*pkg.Plan
+	if *planFile != "" {
+		var err error
+		if plans, err = pkg.LoadPlans(*planFile); err != nil {
+			logger.Errorw("unable to load plans", "error", err)
+			return exitError
+		}
+	}
+
+	nannies, err := instFlags.loadNannies(logger)
+	if err != nil {
+		logger.Errorw("unable to load config", "error", err)
+		return exitError
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	exitCode := exitOK
+	if *planFile != "" {
+		byName := map[string]*CardiNanny{}
+		for _, n := range nannies {
+			byName[n.Name] = n
+		}
+		for _, p := range plans {
+			n, ok := byName[p.Instance]
+			if !ok {
+				logger.Errorw("plan is for an instance which is not configured", "instance", p.Instance)
+				exitCode = exitError
+				continue
+			}
+			if _, err := n.ApplyPlan(ctx, p); err != nil {
+				n.Logger.Errorw("unable to apply plan", "error", err)
+				exitCode = exitError
+			}
+		}
+		return exitCode
+	}
+
+	for _, n := range nannies {
+		if *approveAll {
+			n.Policy = pkg.RemediationPolicy{Default: pkg.AutoApply}
+		}
+		if err := n.ScanForHighLabelCardinality(ctx); err != nil {
+			exitCode = exitError
+		}
+	}
+	return exitCode
+}
+
+// runRevert restores the labels dropped by a history entry, or given labels
+// of a job.
+func runRevert(args []string, logger *zap.SugaredLogger) int {
+	fs := flag.NewFlagSet("revert", flag.ContinueOnError)
+	instFlags := registerInstanceFlags(fs)
+	id := fs.String("id", "", "the ID of the history entry to revert")
+	instance := fs.String("instance", "", "the instance to restore labels in, only needed with -job when more than one instance is configured")
+	job := fs.String("job", "", "the job to restore labels in, instead of -id")
+	labels := fs.String("labels", "", "comma separated labels to restore in -job")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if (*id == "") == (*job == "") || (*job != "" && *labels == "") {
+		fmt.Fprintln(os.Stderr, "either -id or -job and -labels are required")
+		fs.Usage()
+		return exitUsage
+	}
+
+	instances, history, err := instFlags.load()
+	if err != nil {
+		logger.Errorw("unable to load config", "error", err)
+		return exitError
+	}
+
+	entry := pkg.HistoryEntry{Instance: *instance, Job: *job, Labels: splitList(*labels)}
+	if *id != "" {
+		entry, err = history.Find(*id)
+		if err != nil {
+			logger.Errorw("unable to find history entry", "error", err)
+			return exitError
+		}
+	}
+	if entry.Instance == "" && len(instances) == 1 {
+		entry.Instance = instances[0].Name
+	}
+
+	var inst *pkg.InstanceConfig
+	for _, i := range instances {
+		if i.Name == entry.Instance {
+			inst = i
+		}
+	}
+	if inst == nil {
+		logger.Errorw("instance is not configured", "instance", entry.Instance)
+		return exitError
+	}
+
+	cardinanny, err := newCardiNanny(inst, history, logger)
+	if err != nil {
+		logger.Errorw("error setting up instance", "instance", inst.Name, "error", err)
+		return exitError
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	var reverted pkg.HistoryEntry
+	if *id != "" {
+		reverted, err = cardinanny.Revert(ctx, entry)
+	} else {
+		reverted, err = cardinanny.RevertLabels(ctx, entry.Job, entry.Labels, "")
+	}
+	if errors.Is(err, pkg.ErrChangeProposed) {
+		logger.Infow("labels restore proposed in git", "job", entry.Job, "labels", entry.Labels)
+		return exitOK
+	}
+	if err != nil {
+		logger.Errorw("unable to restore labels", "job", entry.Job, "labels", entry.Labels, "error", err)
+		return exitError
+	}
+
+	logger.Infow("labels restored", "id", reverted.ID, "instance", reverted.Instance, "job", reverted.Job, "labels", reverted.Labels)
+	return exitOK
+}
+
+// runHistory lists the recorded config changes.
+func runHistory(args []string, logger *zap.SugaredLogger) int {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	instFlags := registerInstanceFlags(fs)
+	instance := fs.String("instance", "", "only list changes made to this instance")
+	format := fs.String("format", "table", "output format, one of table or json")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	_, history, err := instFlags.load()
+	if err != nil {
+		logger.Errorw("unable to load config", "error", err)
+		return exitError
+	}
+
+	entries, err := history.Entries()
+	if err != nil {
+		logger.Errorw("unable to read history", "error", err)
+		return exitError
+	}
+
+	var filtered []pkg.HistoryEntry
+	for _, e := range entries {
+		if *instance == "" || e.Instance == *instance {
+			filtered = append(filtered, e)
+		}
+	}
+
+	switch *format {
+	case "json":
+		err = writeJSON(filtered)
+	case "table":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTIME\tINSTANCE\tACTION\tJOB\tLABELS\tREVERTS")
+		for _, e := range filtered {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.ID, e.Time.Format(time.RFC3339), e.Instance, e.Action, e.Job, strings.Join(e.Labels, ","), e.Reverts)
+		}
+		err = tw.Flush()
+	default:
+		logger.Errorw("unknown output format", "format", *format)
+		return exitUsage
+	}
+	if err != nil {
+		logger.Errorw("unable to print history", "error", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// runValidateConfig checks the config can be loaded without connecting to
+// prometheus, for use in CI before deploying it.
+func runValidateConfig(args []string, logger *zap.SugaredLogger) int {
+	fs := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	instFlags := registerInstanceFlags(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	instances, _, err := instFlags.load()
+	if err != nil {
+		logger.Errorw("invalid config", "error", err)
+		return exitError
+	}
+
+	exitCode := exitOK
+	for _, inst := range instances {
+		if err := inst.Validate(); err != nil {
+			logger.Errorw("invalid config", "instance", inst.Name, "error", err)
+			exitCode = exitError
+			continue
+		}
+		logger.Infow("config is valid", "instance", inst.Name, "prometheusConfigFile", inst.ConfigFile)
+	}
+	return exitCode
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mclarke47/cardinanny/pkg"
+	"go.uber.org/zap"
+)
+
+type leaderFlags struct {
+	backend        *string
+	lockFile       *string
+	leaseName      *string
+	leaseNamespace *string
+	identity       *string
+	leaseDuration  *time.Duration
+}
+
+func registerLeaderFlags(fs *flag.FlagSet) *leaderFlags {
+	return &leaderFlags{
+		backend:        fs.String("leaderElection", pkg.LeaderElectionNone, "elect a leader among cardinanny replicas so only one makes changes, one of none, file or kubernetes"),
+		lockFile:       fs.String("leaderLockFile", "", "path to the lock file on a volume shared by the replicas, for -leaderElection=file"),
+		leaseName:      fs.String("leaderLeaseName", "cardinanny", "the name of the Lease, for -leaderElection=kubernetes"),
+		leaseNamespace: fs.String("leaderLeaseNamespace", "", "the namespace of the Lease, defaults to the pod's namespace"),
+		identity:       fs.String("leaderIdentity", "", "the identity of this replica, defaults to the hostname (the pod name)"),
+		leaseDuration:  fs.Duration("leaderLeaseDuration", 15*time.Second, "how long followers wait before taking over from a leader which stopped renewing"),
+	}
+}
+
+// newLeadership returns nil when leader election is disabled, which always
+// leads.
+func (f *leaderFlags) newLeadership(logger *zap.SugaredLogger) (*pkg.Leadership, error) {
+	identity := *f.identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		identity = hostname
+	}
+
+	var elector pkg.LeaderElector
+	switch *f.backend {
+	case pkg.LeaderElectionNone:
+		return nil, nil
+	case pkg.LeaderElectionFile:
+		if *f.lockFile == "" {
+			return nil, fmt.Errorf("-leaderLockFile is required for file leader election")
+		}
+		elector = &pkg.FileLockElector{Path: *f.lockFile, Identity: identity}
+	case pkg.LeaderElectionKubernetes:
+		lease, err := pkg.NewInClusterLeaseElector(*f.leaseName, *f.leaseNamespace, identity, *f.leaseDuration)
+		if err != nil {
+			return nil, err
+		}
+		elector = lease
+	default:
+		return nil, fmt.Errorf("unknown leader election %s, expected none, file or kubernetes", *f.backend)
+	}
+
+	logger.Infow("electing a leader", "backend", *f.backend, "identity", identity)
+	return &pkg.Leadership{
+		Logger:      logger.With("identity", identity),
+		Elector:     elector,
+		RetryPeriod: *f.leaseDuration / 3,
+	}, nil
+}
+
+// leaderOnly refuses requests which change something on followers.
+func leaderOnly(leadership *pkg.Leadership) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !leadership.IsLeader() {
+			c.AbortWithStatusJSON(503, gin.H{"error": "this cardinanny replica is not the leader"})
+			return
+		}
+		c.Next()
+	}
+}
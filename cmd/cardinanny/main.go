@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mclarke47/cardinanny/pkg"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+)
+
+// Exit codes shared by every subcommand so they can be scripted.
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitFindings = 3
+)
+
+type command struct {
+	run   func(args []string, logger *zap.SugaredLogger) int
+	usage string
+}
+
+var commands = map[string]command{
+	"run":             {runDaemon, "scan every 2 minutes and serve the HTTP API (the default)"},
+	"scan":            {runScan, "scan once and print the labels over the limit, exits 3 if there are any"},
+	"plan":            {runPlan, "scan once and print the config changes apply would make, exits 3 if there are any"},
+	"apply":           {runApply, "scan once and apply the config changes"},
+	"revert":          {runRevert, "restore the labels dropped by a history entry"},
+	"history":         {runHistory, "list the config changes made so far"},
+	"validate-config": {runValidateConfig, "check the cardinanny and prometheus config files can be loaded"},
+	"analyze":         {runAnalyze, "print a cardinality report without changing anything"},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	for _, name := range []string{"run", "scan", "plan", "apply", "revert", "history", "validate-config", "analyze"} {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nexit codes: %d ok, %d error, %d usage, %d findings\n", exitOK, exitError, exitUsage, exitFindings)
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// parseFlags returns false with the exit code to use if the subcommand
+// should not carry on.
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+// instanceFlags are the flags every subcommand uses to find the prometheus
+// instances to work on, either from a config file or for a single instance.
+type instanceFlags struct {
+	configFile           *string
+	historyFile          *string
+	promFilePath         *string
+	promBaseURL          *string
+	promClientConfigFile *string
+	labelLimit           *int
+	scanBackend          *string
+	scanConcurrency      *int
+	scanQueryRateLimit   *float64
+	maxHistogramBuckets  *uint64
+	exemplarLookback     *time.Duration
+	apiMaxAttempts       *int
+	apiRetryBackoff      *time.Duration
+	apiMaxRetryBackoff   *time.Duration
+	maxDropsPerCycle     *int
+	maxDropsPerJob       *int
+	maxDropsPerDay       *int
+	ruleImpact           *string
+	dashboardImpact      *string
+	dashboardsDir        *string
+	trendMaxGrowth       *float64
+	trendHorizon         *time.Duration
+	trendWindow          *time.Duration
+	headSeriesBudget     *uint64
+	gitRepoDir           *string
+	gitRemote            *string
+	gitBaseBranch        *string
+	gitPushBranch        *bool
+	forgeType            *string
+	forgeURL             *string
+	forgeProject         *string
+	forgeTokenFile       *string
+	defaultMode          *string
+	approvalJobs         *string
+	autoApplyJobs        *string
+	proposalTTL          *time.Duration
+	remediationScope     *string
+	attributeTargets     *bool
+	targetOutlierFactor  *float64
+	protectedLabels      *string
+	notifyWebhookURL     *string
+	driftPolicy          *string
+	reloadTimeout        *time.Duration
+	reloadMethod         *string
+	promPIDFile          *string
+	promProcessName      *string
+}
+
+func registerInstanceFlags(fs *flag.FlagSet) *instanceFlags {
+	return &instanceFlags{
+		configFile:           fs.String("config", "", "path to a cardinanny config file listing the prometheus instances to look after, overrides the per-instance flags below"),
+		historyFile:          fs.String("historyFile", "", "path to the file config changes are recorded in, defaults to history_file in the config file or ./cardinanny-history.jsonl"),
+		promFilePath:         fs.String("prometheusConfigFile", "./prometheus.yml", "path to the prometheus config file"),
+		promBaseURL:          fs.String("prometheusBaseURL", "http://localhost:9090", "the base URL to use to connect to prometheus"),
+		promClientConfigFile: fs.String("prometheusClientConfigFile", "", "path to a file with the HTTP client config (basic_auth, authorization, tls_config, headers...) used to connect to prometheus"),
+		labelLimit:           fs.Int("cardinalityLabelLimit", 1000000, "the max number of values a label can have"),
+		scanBackend:          fs.String("scanBackend", pkg.ScanBackendAuto, "how label value counts are found, one of auto, tsdb, promql or labels (the last two work against Thanos, Cortex and Mimir)"),
+		scanConcurrency:      fs.Int("scanConcurrency", pkg.DefaultInstanceConfig.Scan.Concurrency, "how many labels are queried at the same time during a scan"),
+		scanQueryRateLimit:   fs.Float64("scanQueryRateLimit", pkg.DefaultInstanceConfig.Scan.QueryRateLimit, "the maximum label queries per second during a scan, 0 is unlimited"),
+		maxHistogramBuckets:  fs.Uint64("maxHistogramBuckets", 0, "report histograms with more buckets, or summaries with more quantiles, than this in a job, 0 disables"),
+		protectedLabels:      fs.String("protectedLabels", "", "comma separated labels never to drop, on top of job, instance, le and quantile"),
+		exemplarLookback:     fs.Duration("exemplarLookback", 0, "report the value counts of exemplar labels stored over this duration, 0 disables"),
+		apiMaxAttempts:       fs.Int("apiMaxAttempts", pkg.DefaultAPIMaxAttempts, "how many times a prometheus API call failing with a transient error is tried, 1 disables retries"),
+		apiRetryBackoff:      fs.Duration("apiRetryBackoff", pkg.DefaultAPIRetryBackoff, "how long to wait before retrying a prometheus API call, doubling with each retry"),
+		apiMaxRetryBackoff:   fs.Duration("apiMaxRetryBackoff", pkg.DefaultAPIMaxRetryBackoff, "the longest wait between retries of a prometheus API call"),
+		maxDropsPerCycle:     fs.Int("maxLabelDropsPerCycle", 0, "pause label drops when more than this many labels would be dropped in one scan, 0 disables"),
+		maxDropsPerJob:       fs.Int("maxLabelDropsPerJob", 0, "pause label drops when more than this many labels would be dropped from one job in one scan, 0 disables"),
+		maxDropsPerDay:       fs.Int("maxLabelDropsPerDay", 0, "pause label drops when more than this many labels would be dropped within a day, 0 disables"),
+		ruleImpact:           fs.String("ruleImpact", string(pkg.ImpactApproval), "what happens to label drops which would break a recording or alerting rule, one of block, approval, warn or ignore"),
+		dashboardImpact:      fs.String("dashboardImpact", string(pkg.ImpactWarn), "what happens to label drops which would break a grafana dashboard, one of block, approval, warn or ignore"),
+		dashboardsDir:        fs.String("grafanaDashboardsDir", "", "directory of grafana dashboards exported as JSON to look for labels about to be dropped in, disabled when empty"),
+		trendMaxGrowth:       fs.Float64("trendMaxGrowthPerHour", 0, "flag labels whose value count grows by more than this many values per hour, 0 disables"),
+		trendHorizon:         fs.Duration("trendHorizon", 0, "flag labels projected to cross the label limit within this duration, 0 disables"),
+		trendWindow:          fs.Duration("trendWindow", 6*time.Hour, "how much label value count history is used to detect trends"),
+		headSeriesBudget:     fs.Uint64("headSeriesBudget", 0, "drop the labels contributing the most head series while prometheus has more head series than this, 0 disables"),
+		gitRepoDir:           fs.String("gitRepoDir", "", "commit config changes to the git working copy at this path instead of reloading prometheus"),
+		gitRemote:            fs.String("gitRemote", "origin", "the git remote to push branches to"),
+		gitBaseBranch:        fs.String("gitBaseBranch", pkg.DefaultGitBaseBranch, "the branch prometheus is deployed from"),
+		gitPushBranch:        fs.Bool("gitPushBranch", false, "push config changes to a new branch instead of committing to the base branch"),
+		forgeType:            fs.String("forge", "", "open a merge request for pushed branches, one of gitlab or github"),
+		forgeURL:             fs.String("forgeURL", "", "the API base URL of the forge"),
+		forgeProject:         fs.String("forgeProject", "", "the forge project/repository, e.g. infra/prometheus"),
+		forgeTokenFile:       fs.String("forgeTokenFile", "", "path to a file containing the forge API token"),
+		defaultMode:          fs.String("defaultRemediationMode", string(pkg.AutoApply), "whether label drops are applied straight away (auto) or need approval (approval)"),
+		approvalJobs:         fs.String("approvalRequiredJobs", "", "comma separated jobs whose label drops need approval"),
+		autoApplyJobs:        fs.String("autoApplyJobs", "", "comma separated jobs whose label drops are applied straight away"),
+		proposalTTL:          fs.Duration("proposalTTL", 24*time.Hour, "how long a proposed label drop waits for approval before it expires"),
+		remediationScope:     fs.String("remediationScope", string(pkg.ScopeJob), "whether labels are dropped from the whole job (job) or only from the instances responsible for them when there are some (instance)"),
+		attributeTargets:     fs.Bool("attributeTargets", false, "break high cardinality labels down by instance to show which targets they come from, always on with -remediationScope=instance"),
+		targetOutlierFactor:  fs.Float64("targetOutlierFactor", pkg.DefaultTargetOutlierFactor, "how many times more values than the median of the other instances of its job an instance needs to be held responsible for a label"),
+		driftPolicy:          fs.String("driftPolicy", string(pkg.DriftRefuse), "what to do when the prometheus config file differs from the running config, one of refuse, merge (make the changes to the file) or overwrite"),
+		reloadTimeout:        fs.Duration("reloadTimeout", pkg.DefaultReloadTimeout, "how long prometheus gets to run the new config after a reload before it counts as failed"),
+		reloadMethod:         fs.String("reloadMethod", pkg.ReloadAuto, "how prometheus is reloaded, one of auto, http (needs --web.enable-lifecycle), signal (SIGHUP) or wait (for a config reloader sidecar)"),
+		promPIDFile:          fs.String("prometheusPIDFile", "", "path to the prometheus pid file, for -reloadMethod=signal"),
+		promProcessName:      fs.String("prometheusProcessName", "", "the prometheus process name, for -reloadMethod=signal without a pid file"),
+		notifyWebhookURL:     fs.String("notifyWebhookURL", "", "post a JSON notification with the plan to this URL when label drops are proposed, applied or reverted"),
+	}
+}
+
+func (f *instanceFlags) load() ([]*pkg.InstanceConfig, *pkg.History, error) {
+	history := &pkg.History{Path: *f.historyFile}
+
+	if *f.configFile != "" {
+		cfg, err := pkg.LoadCardinannyConfigFile(*f.configFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if history.Path == "" {
+			history.Path = cfg.HistoryFile
+		}
+		if history.Path == "" {
+			history.Path = "./cardinanny-history.jsonl"
+		}
+		return cfg.Instances, history, nil
+	}
+
+	if history.Path == "" {
+		history.Path = "./cardinanny-history.jsonl"
+	}
+
+	mode, err := pkg.ParseRemediationMode(*f.defaultMode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scope, err := pkg.ParseRemediationScope(*f.remediationScope)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	driftPolicy, err := pkg.ParseDriftPolicy(*f.driftPolicy)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inst := pkg.DefaultInstanceConfig
+	inst.Name = "default"
+	inst.DriftPolicy = driftPolicy
+	inst.ReloadTimeout = model.Duration(*f.reloadTimeout)
+	inst.Reload = pkg.ReloadConfig{Method: *f.reloadMethod, PIDFile: *f.promPIDFile, ProcessName: *f.promProcessName}
+	if err := inst.Reload.Validate(); err != nil {
+		return nil, nil, err
+	}
+	inst.BaseURL = *f.promBaseURL
+	inst.ConfigFile = *f.promFilePath
+	inst.LabelLimit = uint64(*f.labelLimit)
+	inst.ScanBackend = *f.scanBackend
+	inst.Scan = pkg.ScanConfig{
+		Concurrency:         *f.scanConcurrency,
+		QueryRateLimit:      *f.scanQueryRateLimit,
+		MaxHistogramBuckets: *f.maxHistogramBuckets,
+		ExemplarLookback:    model.Duration(*f.exemplarLookback),
+		AttributeTargets:    *f.attributeTargets,
+		TargetOutlierFactor: *f.targetOutlierFactor,
+		ProtectedLabels:     splitList(*f.protectedLabels),
+	}
+	if err := inst.Scan.Validate(); err != nil {
+		return nil, nil, err
+	}
+	inst.APIRetry = pkg.APIRetryConfig{
+		MaxAttempts: *f.apiMaxAttempts,
+		Backoff:     model.Duration(*f.apiRetryBackoff),
+		MaxBackoff:  model.Duration(*f.apiMaxRetryBackoff),
+	}
+	if err := inst.APIRetry.Validate(); err != nil {
+		return nil, nil, err
+	}
+	inst.Limits = pkg.RemediationLimits{
+		MaxLabelsPerCycle: *f.maxDropsPerCycle,
+		MaxLabelsPerJob:   *f.maxDropsPerJob,
+		MaxLabelsPerDay:   *f.maxDropsPerDay,
+	}
+	if err := inst.Limits.Validate(); err != nil {
+		return nil, nil, err
+	}
+	inst.Impact = pkg.ImpactConfig{
+		Rules:         pkg.ImpactAction(*f.ruleImpact),
+		Dashboards:    pkg.ImpactAction(*f.dashboardImpact),
+		DashboardsDir: *f.dashboardsDir,
+	}
+	if err := inst.Impact.Validate(); err != nil {
+		return nil, nil, err
+	}
+	inst.SeriesBudget = *f.headSeriesBudget
+
+	if *f.trendMaxGrowth > 0 || *f.trendHorizon > 0 {
+		inst.Trend = &pkg.TrendConfig{
+			MaxGrowthPerHour: *f.trendMaxGrowth,
+			Horizon:          model.Duration(*f.trendHorizon),
+			Window:           model.Duration(*f.trendWindow),
+		}
+	}
+	inst.Policy = pkg.PolicyConfig{
+		Default:              mode,
+		ApprovalRequiredJobs: splitList(*f.approvalJobs),
+		AutoApplyJobs:        splitList(*f.autoApplyJobs),
+		ProposalTTL:          model.Duration(*f.proposalTTL),
+		Scope:                scope,
+	}
+
+	if *f.promClientConfigFile != "" {
+		clientConfig, err := pkg.LoadPromClientConfigFile(*f.promClientConfigFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		inst.ClientConfig = *clientConfig
+	}
+
+	if *f.notifyWebhookURL != "" {
+		inst.Notify = &pkg.NotifyConfig{WebhookURL: *f.notifyWebhookURL}
+	}
+
+	if *f.gitRepoDir != "" {
+		inst.Git = &pkg.GitConfig{
+			Dir:        *f.gitRepoDir,
+			Remote:     *f.gitRemote,
+			BaseBranch: *f.gitBaseBranch,
+			PushBranch: *f.gitPushBranch,
+		}
+		if *f.forgeType != "" {
+			inst.Git.Forge = &pkg.ForgeConfig{
+				Type:      *f.forgeType,
+				URL:       *f.forgeURL,
+				Project:   *f.forgeProject,
+				TokenFile: *f.forgeTokenFile,
+			}
+		}
+	}
+
+	return []*pkg.InstanceConfig{&inst}, history, nil
+}
+
+// loadNannies sets up every configured instance, returning them in config
+// file order.
+func (f *instanceFlags) loadNannies(logger *zap.SugaredLogger) ([]*CardiNanny, error) {
+	instances, history, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var nannies []*CardiNanny
+	for _, inst := range instances {
+		cardinanny, err := newCardiNanny(inst, history, logger)
+		if err != nil {
+			return nil, fmt.Errorf("error setting up instance %s, %w", inst.Name, err)
+		}
+		nannies = append(nannies, cardinanny)
+	}
+	return nannies, nil
+}
+
+func main() {
+	args := os.Args[1:]
+
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		usage()
+		os.Exit(exitOK)
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %s\n\n", name)
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	code := cmd.run(args, logger.Sugar())
+	logger.Sync() // flushes buffer, if any
+	os.Exit(code)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mclarke47/cardinanny/pkg"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+func decideProposal(c *gin.Context, nannies map[string]*CardiNanny, approve bool) {
+	nanny, ok := nannies[c.Param("instance")]
+	if !ok {
+		c.JSON(404, gin.H{"error": "instance not found"})
+		return
+	}
+
+	decide := nanny.Reject
+	if approve {
+		decide = nanny.Approve
+	}
+
+	p, err := decide(c.Param("id"))
+	switch {
+	case errors.Is(err, pkg.ErrProposalNotFound):
+		c.JSON(404, gin.H{"error": err.Error()})
+	case errors.Is(err, pkg.ErrProposalNotPending):
+		c.JSON(409, gin.H{"error": err.Error(), "proposal": p})
+	default:
+		c.JSON(200, gin.H{"proposal": p})
+	}
+}
+
+func revertResponse(c *gin.Context, entry pkg.HistoryEntry, err error) {
+	switch {
+	case errors.Is(err, pkg.ErrHistoryEntryNotFound):
+		c.JSON(404, gin.H{"error": err.Error()})
+	case errors.Is(err, pkg.ErrLabelNotDropped):
+		c.JSON(409, gin.H{"error": err.Error()})
+	case errors.Is(err, pkg.ErrChangeProposed):
+		c.JSON(202, gin.H{"status": err.Error()})
+	case err != nil:
+		c.JSON(500, gin.H{"error": err.Error()})
+	default:
+		c.JSON(200, gin.H{"history": entry})
+	}
+}
+
+// runDaemon looks after every instance until it is killed, serving the HTTP
+// API on :8080.
+func runDaemon(args []string, logger *zap.SugaredLogger) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	instFlags := registerInstanceFlags(fs)
+	leaderFlags := registerLeaderFlags(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	leadership, err := leaderFlags.newLeadership(logger)
+	if err != nil {
+		logger.Errorw("unable to set up leader election", "error", err)
+		return exitError
+	}
+
+	list, err := instFlags.loadNannies(logger)
+	if err != nil {
+		logger.Errorw("unable to load config", "error", err)
+		return exitError
+	}
+	history := list[0].History
+
+	if leadership != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go leadership.Run(ctx)
+	}
+
+	nannies := map[string]*CardiNanny{}
+
+	for _, cardinanny := range list {
+		cardinanny.Leadership = leadership
+		nannies[cardinanny.Name] = cardinanny
+
+		logger.Infow("starting Cardinanny with",
+			"instance", cardinanny.Name,
+			"configPath", cardinanny.PromContext.PathToConfigFile,
+			"prometheusBaseURL", cardinanny.PromConfigRewriter.BaseURL,
+			"cardinalityLabelLimit", cardinanny.CardinalityScanner.LabelCountLimit,
+		)
+
+		go cardinanny.Start()
+	}
+
+	r := gin.Default()
+	r.GET("/ping", func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"message": "pong",
+		})
+	})
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/summary", func(c *gin.Context) {
+		summary := map[string]map[string][]string{}
+		status := map[string]pkg.OutcomesSnapshot{}
+		breakers := map[string]pkg.BreakerStatus{}
+		histograms := map[string][]pkg.BucketExplosion{}
+		exemplars := map[string][]pkg.ExemplarLabel{}
+		targets := map[string][]pkg.LabelAttribution{}
+		for name, n := range nannies {
+			summary[name] = n.SummarySnapshot()
+			status[name] = n.Outcomes.Snapshot()
+			breakers[name] = n.Breaker.Status()
+			if h := n.CardinalityScanner.Histograms; h != nil {
+				histograms[name] = h.Last()
+			}
+			if e := n.CardinalityScanner.Exemplars; e != nil {
+				exemplars[name] = e.Last()
+			}
+			if t := n.CardinalityScanner.Targets; t != nil {
+				targets[name] = t.Last()
+			}
+		}
+		c.JSON(200, gin.H{
+			"summary":    summary,
+			"status":     status,
+			"breaker":    breakers,
+			"histograms": histograms,
+			"exemplars":  exemplars,
+			"targets":    targets,
+		})
+	})
+	r.GET("/proposals", func(c *gin.Context) {
+		proposals := map[string][]pkg.Proposal{}
+		for name, n := range nannies {
+			proposals[name] = n.Queue.List()
+		}
+		c.JSON(200, gin.H{
+			"proposals": proposals,
+		})
+	})
+	r.POST("/instances/:instance/proposals/:id/approve", leaderOnly(leadership), func(c *gin.Context) {
+		decideProposal(c, nannies, true)
+	})
+	r.POST("/instances/:instance/proposals/:id/reject", leaderOnly(leadership), func(c *gin.Context) {
+		decideProposal(c, nannies, false)
+	})
+	r.GET("/instances/:instance/plan", func(c *gin.Context) {
+		nanny, ok := nannies[c.Param("instance")]
+		if !ok {
+			c.JSON(404, gin.H{"error": "instance not found"})
+			return
+		}
+		plan, err := nanny.Plan(c.Request.Context())
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"plan": plan})
+	})
+	r.POST("/instances/:instance/plan/apply", leaderOnly(leadership), func(c *gin.Context) {
+		nanny, ok := nannies[c.Param("instance")]
+		if !ok {
+			c.JSON(404, gin.H{"error": "instance not found"})
+			return
+		}
+		var plan pkg.Plan
+		if err := c.ShouldBindJSON(&plan); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		entries, err := nanny.ApplyPlan(c.Request.Context(), &plan)
+		switch {
+		case errors.Is(err, pkg.ErrPlanOutdated):
+			c.JSON(409, gin.H{"error": err.Error()})
+		case errors.Is(err, pkg.ErrPlanInstance), errors.Is(err, pkg.ErrPlanMismatch):
+			c.JSON(400, gin.H{"error": err.Error()})
+		case err != nil:
+			c.JSON(500, gin.H{"error": err.Error()})
+		default:
+			c.JSON(200, gin.H{"history": entries})
+		}
+	})
+	r.POST("/instances/:instance/breaker/reset", leaderOnly(leadership), func(c *gin.Context) {
+		nanny, ok := nannies[c.Param("instance")]
+		if !ok {
+			c.JSON(404, gin.H{"error": "instance not found"})
+			return
+		}
+		if err := nanny.ResetBreaker(); err != nil {
+			c.JSON(409, gin.H{"error": err.Error()})
+			return
+		}
+		nanny.Logger.Infow("remediation resumed")
+		c.JSON(200, gin.H{"breaker": nanny.Breaker.Status()})
+	})
+	r.GET("/history", func(c *gin.Context) {
+		entries, err := history.Entries()
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{
+			"history": entries,
+		})
+	})
+	r.POST("/history/:id/revert", leaderOnly(leadership), func(c *gin.Context) {
+		entry, err := history.Find(c.Param("id"))
+		if err != nil {
+			revertResponse(c, entry, err)
+			return
+		}
+		nanny, ok := nannies[entry.Instance]
+		if !ok {
+			c.JSON(404, gin.H{"error": "instance not found"})
+			return
+		}
+		entry, err = nanny.Revert(c.Request.Context(), entry)
+		revertResponse(c, entry, err)
+	})
+	r.POST("/instances/:instance/jobs/:job/labels/:label/revert", leaderOnly(leadership), func(c *gin.Context) {
+		nanny, ok := nannies[c.Param("instance")]
+		if !ok {
+			c.JSON(404, gin.H{"error": "instance not found"})
+			return
+		}
+		entry, err := nanny.RevertLabels(c.Request.Context(), c.Param("job"), []string{c.Param("label")}, "")
+		revertResponse(c, entry, err)
+	})
+
+	// listen and serve on 0.0.0.0:8080
+	if err := r.Run(); err != nil {
+		logger.Errorw("unable to serve the HTTP API", "error", err)
+		return exitError
+	}
+	return exitOK
+}
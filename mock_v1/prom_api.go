@@ -40,7 +40,7 @@ func (m *MockAPI) EXPECT() *MockAPIMockRecorder {
 }
 
 // AlertManagers mocks base method.
-func (m MockAPI) AlertManagers(ctx context.Context) (v1.AlertManagersResult, error) {
+func (m *MockAPI) AlertManagers(ctx context.Context) (v1.AlertManagersResult, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "AlertManagers", ctx)
 	ret0, _ := ret[0].(v1.AlertManagersResult)
@@ -55,7 +55,7 @@ func (mr *MockAPIMockRecorder) AlertManagers(ctx interface{}) *gomock.Call {
 }
 
 // Alerts mocks base method.
-func (m MockAPI) Alerts(ctx context.Context) (v1.AlertsResult, error) {
+func (m *MockAPI) Alerts(ctx context.Context) (v1.AlertsResult, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Alerts", ctx)
 	ret0, _ := ret[0].(v1.AlertsResult)
@@ -70,7 +70,7 @@ func (mr *MockAPIMockRecorder) Alerts(ctx interface{}) *gomock.Call {
 }
 
 // Buildinfo mocks base method.
-func (m MockAPI) Buildinfo(ctx context.Context) (v1.BuildinfoResult, error) {
+func (m *MockAPI) Buildinfo(ctx context.Context) (v1.BuildinfoResult, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Buildinfo", ctx)
 	ret0, _ := ret[0].(v1.BuildinfoResult)
@@ -128,7 +128,7 @@ func (mr *MockAPIMockRecorder) DeleteSeries(ctx, matches, startTime, endTime int
 }
 
 // Flags mocks base method.
-func (m MockAPI) Flags(ctx context.Context) (v1.FlagsResult, error) {
+func (m *MockAPI) Flags(ctx context.Context) (v1.FlagsResult, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Flags", ctx)
 	ret0, _ := ret[0].(v1.FlagsResult)
@@ -143,7 +143,7 @@ func (mr *MockAPIMockRecorder) Flags(ctx interface{}) *gomock.Call {
 }
 
 // LabelNames mocks base method.
-func (m MockAPI) LabelNames(ctx context.Context, matches []string, startTime, endTime time.Time) ([]string, v1.Warnings, error) {
+func (m *MockAPI) LabelNames(ctx context.Context, matches []string, startTime, endTime time.Time) ([]string, v1.Warnings, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "LabelNames", ctx, matches, startTime, endTime)
 	ret0, _ := ret[0].([]string)
@@ -159,7 +159,7 @@ func (mr *MockAPIMockRecorder) LabelNames(ctx, matches, startTime, endTime inter
 }
 
 // LabelValues mocks base method.
-func (m MockAPI) LabelValues(ctx context.Context, label string, matches []string, startTime, endTime time.Time) (model.LabelValues, v1.Warnings, error) {
+func (m *MockAPI) LabelValues(ctx context.Context, label string, matches []string, startTime, endTime time.Time) (model.LabelValues, v1.Warnings, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "LabelValues", ctx, label, matches, startTime, endTime)
 	ret0, _ := ret[0].(model.LabelValues)
@@ -175,7 +175,7 @@ func (mr *MockAPIMockRecorder) LabelValues(ctx, label, matches, startTime, endTi
 }
 
 // Metadata mocks base method.
-func (m MockAPI) Metadata(ctx context.Context, metric, limit string) (map[string][]v1.Metadata, error) {
+func (m *MockAPI) Metadata(ctx context.Context, metric, limit string) (map[string][]v1.Metadata, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Metadata", ctx, metric, limit)
 	ret0, _ := ret[0].(map[string][]v1.Metadata)
@@ -206,7 +206,7 @@ func (mr *MockAPIMockRecorder) Query(ctx, query, ts interface{}) *gomock.Call {
 }
 
 // QueryExemplars mocks base method.
-func (m MockAPI) QueryExemplars(ctx context.Context, query string, startTime, endTime time.Time) ([]v1.ExemplarQueryResult, error) {
+func (m *MockAPI) QueryExemplars(ctx context.Context, query string, startTime, endTime time.Time) ([]v1.ExemplarQueryResult, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "QueryExemplars", ctx, query, startTime, endTime)
 	ret0, _ := ret[0].([]v1.ExemplarQueryResult)
@@ -221,7 +221,7 @@ func (mr *MockAPIMockRecorder) QueryExemplars(ctx, query, startTime, endTime int
 }
 
 // QueryRange mocks base method.
-func (m MockAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, v1.Warnings, error) {
+func (m *MockAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, v1.Warnings, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "QueryRange", ctx, query, r)
 	ret0, _ := ret[0].(model.Value)
@@ -237,7 +237,7 @@ func (mr *MockAPIMockRecorder) QueryRange(ctx, query, r interface{}) *gomock.Cal
 }
 
 // Rules mocks base method.
-func (m MockAPI) Rules(ctx context.Context) (v1.RulesResult, error) {
+func (m *MockAPI) Rules(ctx context.Context) (v1.RulesResult, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Rules", ctx)
 	ret0, _ := ret[0].(v1.RulesResult)
@@ -252,7 +252,7 @@ func (mr *MockAPIMockRecorder) Rules(ctx interface{}) *gomock.Call {
 }
 
 // Runtimeinfo mocks base method.
-func (m MockAPI) Runtimeinfo(ctx context.Context) (v1.RuntimeinfoResult, error) {
+func (m *MockAPI) Runtimeinfo(ctx context.Context) (v1.RuntimeinfoResult, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Runtimeinfo", ctx)
 	ret0, _ := ret[0].(v1.RuntimeinfoResult)
@@ -267,7 +267,7 @@ func (mr *MockAPIMockRecorder) Runtimeinfo(ctx interface{}) *gomock.Call {
 }
 
 // Series mocks base method.
-func (m MockAPI) Series(ctx context.Context, matches []string, startTime, endTime time.Time) ([]model.LabelSet, v1.Warnings, error) {
+func (m *MockAPI) Series(ctx context.Context, matches []string, startTime, endTime time.Time) ([]model.LabelSet, v1.Warnings, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Series", ctx, matches, startTime, endTime)
 	ret0, _ := ret[0].([]model.LabelSet)
@@ -283,7 +283,7 @@ func (mr *MockAPIMockRecorder) Series(ctx, matches, startTime, endTime interface
 }
 
 // Snapshot mocks base method.
-func (m MockAPI) Snapshot(ctx context.Context, skipHead bool) (v1.SnapshotResult, error) {
+func (m *MockAPI) Snapshot(ctx context.Context, skipHead bool) (v1.SnapshotResult, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Snapshot", ctx, skipHead)
 	ret0, _ := ret[0].(v1.SnapshotResult)
@@ -313,7 +313,7 @@ func (mr *MockAPIMockRecorder) TSDB(ctx interface{}) *gomock.Call {
 }
 
 // Targets mocks base method.
-func (m MockAPI) Targets(ctx context.Context) (v1.TargetsResult, error) {
+func (m *MockAPI) Targets(ctx context.Context) (v1.TargetsResult, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Targets", ctx)
 	ret0, _ := ret[0].(v1.TargetsResult)
@@ -328,7 +328,7 @@ func (mr *MockAPIMockRecorder) Targets(ctx interface{}) *gomock.Call {
 }
 
 // TargetsMetadata mocks base method.
-func (m MockAPI) TargetsMetadata(ctx context.Context, matchTarget, metric, limit string) ([]v1.MetricMetadata, error) {
+func (m *MockAPI) TargetsMetadata(ctx context.Context, matchTarget, metric, limit string) ([]v1.MetricMetadata, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "TargetsMetadata", ctx, matchTarget, metric, limit)
 	ret0, _ := ret[0].([]v1.MetricMetadata)
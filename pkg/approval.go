@@ -0,0 +1,268 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RemediationMode string
+
+const (
+	AutoApply        RemediationMode = "auto"
+	ApprovalRequired RemediationMode = "approval"
+)
+
+func ParseRemediationMode(s string) (RemediationMode, error) {
+	switch RemediationMode(s) {
+	case AutoApply, ApprovalRequired:
+		return RemediationMode(s), nil
+	}
+	return "", fmt.Errorf("unknown remediation mode %s, expected %s or %s", s, AutoApply, ApprovalRequired)
+}
+
+// RemediationPolicy decides per job whether label drops are applied straight
+// away or have to be approved by a human first.
+type RemediationPolicy struct {
+	Default RemediationMode
+	Jobs    map[string]RemediationMode
+}
+
+func (p RemediationPolicy) ModeFor(job string) RemediationMode {
+	if m, ok := p.Jobs[job]; ok {
+		return m
+	}
+	if p.Default == "" {
+		return AutoApply
+	}
+	return p.Default
+}
+
+// Split separates the jobs whose labels can be dropped now from the ones
+// which need approval.
+func (p RemediationPolicy) Split(jobNamesToLabelsToDrop map[string][]string) (map[string][]string, map[string][]string) {
+	auto := map[string][]string{}
+	approval := map[string][]string{}
+
+	for job, labels := range jobNamesToLabelsToDrop {
+		if p.ModeFor(job) == ApprovalRequired {
+			approval[job] = labels
+		} else {
+			auto[job] = labels
+		}
+	}
+	return auto, approval
+}
+
+type ProposalStatus string
+
+const (
+	ProposalPending  ProposalStatus = "pending"
+	ProposalApproved ProposalStatus = "approved"
+	ProposalRejected ProposalStatus = "rejected"
+	ProposalApplied  ProposalStatus = "applied"
+)
+
+type Proposal struct {
+	ID         string         `json:"id"`
+	Job        string         `json:"job"`
+	Label      string         `json:"label"`
+	Status     ProposalStatus `json:"status"`
+	ProposedAt time.Time      `json:"proposedAt"`
+	ExpiresAt  time.Time      `json:"expiresAt"`
+}
+
+var (
+	ErrProposalNotFound   = errors.New("proposal not found")
+	ErrProposalNotPending = errors.New("proposal is not pending")
+)
+
+// RemediationQueue holds proposed label drops until they are approved,
+// rejected or expire. Approved proposals are kept until they are applied, and
+// applied ones for another TTL so the series left behind by the drop aren't
+// proposed again.
+type RemediationQueue struct {
+	TTL time.Duration
+
+	mu        sync.Mutex
+	proposals map[string]*Proposal
+	nextID    int
+	now       func() time.Time
+}
+
+func (q *RemediationQueue) clock() time.Time {
+	if q.now != nil {
+		return q.now()
+	}
+	return time.Now()
+}
+
+// expire drops pending, rejected and applied proposals past their expiry, a
+// rejected label will be proposed again once its rejection expires.
+func (q *RemediationQueue) expire() {
+	now := q.clock()
+	for id, p := range q.proposals {
+		if p.Status != ProposalApproved && now.After(p.ExpiresAt) {
+			delete(q.proposals, id)
+		}
+	}
+}
+
+func (q *RemediationQueue) find(job, label string) *Proposal {
+	for _, p := range q.proposals {
+		if p.Job == job && p.Label == label {
+			return p
+		}
+	}
+	return nil
+}
+
+// Propose queues every job/label pair which isn't already known to the queue.
+func (q *RemediationQueue) Propose(jobNamesToLabelsToDrop map[string][]string) []Proposal {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.proposals == nil {
+		q.proposals = map[string]*Proposal{}
+	}
+	q.expire()
+
+	var added []Proposal
+	for _, job := range sortedJobs(jobNamesToLabelsToDrop) {
+		for _, label := range jobNamesToLabelsToDrop[job] {
+			if q.find(job, label) != nil {
+				continue
+			}
+
+			q.nextID++
+			now := q.clock()
+			p := &Proposal{
+				ID:         strconv.Itoa(q.nextID),
+				Job:        job,
+				Label:      label,
+				Status:     ProposalPending,
+				ProposedAt: now,
+				ExpiresAt:  now.Add(q.TTL),
+			}
+			q.proposals[p.ID] = p
+			added = append(added, *p)
+		}
+	}
+	return added
+}
+
+func (q *RemediationQueue) List() []Proposal {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire()
+
+	result := []Proposal{}
+	for _, p := range q.proposals {
+		result = append(result, *p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, _ := strconv.Atoi(result[i].ID)
+		b, _ := strconv.Atoi(result[j].ID)
+		return a < b
+	})
+	return result
+}
+
+func (q *RemediationQueue) decide(id string, status ProposalStatus) (Proposal, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire()
+
+	p, ok := q.proposals[id]
+	if !ok {
+		return Proposal{}, ErrProposalNotFound
+	}
+	if p.Status != ProposalPending {
+		return *p, ErrProposalNotPending
+	}
+	p.Status = status
+	return *p, nil
+}
+
+func (q *RemediationQueue) Approve(id string) (Proposal, error) {
+	return q.decide(id, ProposalApproved)
+}
+
+func (q *RemediationQueue) Reject(id string) (Proposal, error) {
+	return q.decide(id, ProposalRejected)
+}
+
+// Approved returns the approved label drops grouped by job.
+func (q *RemediationQueue) Approved() map[string][]string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	result := map[string][]string{}
+	for _, p := range q.proposals {
+		if p.Status == ProposalApproved {
+			result[p.Job] = append(result[p.Job], p.Label)
+		}
+	}
+	for _, labels := range result {
+		sort.Strings(labels)
+	}
+	return result
+}
+
+// MarkApplied records approved proposals as applied once their labels have
+// been dropped.
+func (q *RemediationQueue) MarkApplied(jobNamesToLabelsToDrop map[string][]string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for job, labels := range jobNamesToLabelsToDrop {
+		for _, label := range labels {
+			if p := q.find(job, label); p != nil && p.Status == ProposalApproved {
+				p.Status = ProposalApplied
+				p.ExpiresAt = q.clock().Add(q.TTL)
+			}
+		}
+	}
+}
+
+// WithoutJobLabels returns the job to label map without the given labels.
+func WithoutJobLabels(jobNamesToLabels, without map[string][]string) map[string][]string {
+	result := map[string][]string{}
+	for job, labels := range jobNamesToLabels {
+		for _, label := range labels {
+			if !containsString(without[job], label) {
+				result[job] = append(result[job], label)
+			}
+		}
+	}
+	return result
+}
+
+// MergeJobLabels combines job to label maps, dropping duplicate labels.
+func MergeJobLabels(maps ...map[string][]string) map[string][]string {
+	result := map[string][]string{}
+	for _, m := range maps {
+		for job, labels := range m {
+			for _, label := range labels {
+				if !containsString(result[job], label) {
+					result[job] = append(result[job], label)
+				}
+			}
+		}
+	}
+	return result
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RemediationPolicy_Split(t *testing.T) {
+	policy := RemediationPolicy{
+		Default: AutoApply,
+		Jobs: map[string]RemediationMode{
+			"some-other-job": ApprovalRequired,
+		},
+	}
+
+	auto, approval := policy.Split(map[string][]string{
+		"some-job":       {"v1"},
+		"some-other-job": {"v2", "v3"},
+	})
+
+	assert.Equal(t, map[string][]string{"some-job": {"v1"}}, auto)
+	assert.Equal(t, map[string][]string{"some-other-job": {"v2", "v3"}}, approval)
+}
+
+func Test_RemediationPolicy_defaultApprovalRequired(t *testing.T) {
+	policy := RemediationPolicy{
+		Default: ApprovalRequired,
+		Jobs: map[string]RemediationMode{
+			"some-job": AutoApply,
+		},
+	}
+
+	assert.Equal(t, AutoApply, policy.ModeFor("some-job"))
+	assert.Equal(t, ApprovalRequired, policy.ModeFor("some-other-job"))
+}
+
+func Test_RemediationQueue_approveFlowsIntoApproved(t *testing.T) {
+	q := RemediationQueue{TTL: time.Hour}
+
+	added := q.Propose(map[string][]string{
+		"some-job": {"v1", "v2"},
+	})
+	assert.Len(t, added, 2)
+
+	// proposing the same labels again is a no-op
+	assert.Len(t, q.Propose(map[string][]string{"some-job": {"v1"}}), 0)
+
+	_, err := q.Approve(added[0].ID)
+	assert.Nil(t, err)
+
+	_, err = q.Reject(added[1].ID)
+	assert.Nil(t, err)
+
+	assert.Equal(t, map[string][]string{"some-job": {"v1"}}, q.Approved())
+
+	q.MarkApplied(map[string][]string{"some-job": {"v1"}})
+
+	assert.Equal(t, map[string][]string{}, q.Approved())
+	assert.Len(t, q.List(), 2)
+	assert.Equal(t, ProposalApplied, q.List()[0].Status)
+	assert.Equal(t, ProposalRejected, q.List()[1].Status)
+
+	// the series of an applied label linger, it isn't proposed again
+	assert.Len(t, q.Propose(map[string][]string{"some-job": {"v1"}}), 0)
+}
+
+func Test_RemediationQueue_approveUnknownOrDecidedProposal(t *testing.T) {
+	q := RemediationQueue{TTL: time.Hour}
+
+	_, err := q.Approve("42")
+	assert.Equal(t, ErrProposalNotFound, err)
+
+	added := q.Propose(map[string][]string{"some-job": {"v1"}})
+
+	_, err = q.Reject(added[0].ID)
+	assert.Nil(t, err)
+
+	_, err = q.Approve(added[0].ID)
+	assert.Equal(t, ErrProposalNotPending, err)
+}
+
+func Test_RemediationQueue_proposalsExpire(t *testing.T) {
+	now := time.Date(2021, 8, 20, 10, 0, 0, 0, time.UTC)
+	q := RemediationQueue{TTL: time.Hour, now: func() time.Time { return now }}
+
+	added := q.Propose(map[string][]string{"some-job": {"v1", "v2"}})
+
+	_, err := q.Approve(added[1].ID)
+	assert.Nil(t, err)
+
+	now = now.Add(2 * time.Hour)
+
+	_, err = q.Approve(added[0].ID)
+	assert.Equal(t, ErrProposalNotFound, err)
+
+	// approved proposals wait to be applied even after they would have expired
+	assert.Equal(t, map[string][]string{"some-job": {"v2"}}, q.Approved())
+
+	// an expired proposal is proposed again on the next scan
+	assert.Len(t, q.Propose(map[string][]string{"some-job": {"v1"}}), 1)
+}
+
+func Test_MergeJobLabels(t *testing.T) {
+	assert.Equal(t, map[string][]string{
+		"some-job":       {"v1", "v2"},
+		"some-other-job": {"v3"},
+	}, MergeJobLabels(
+		map[string][]string{"some-job": {"v1"}},
+		map[string][]string{"some-job": {"v1", "v2"}, "some-other-job": {"v3"}},
+	))
+}
@@ -0,0 +1,189 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RemediationLimits caps how many labels are dropped without a human looking,
+// 0 leaves a cap out.
+type RemediationLimits struct {
+	MaxLabelsPerCycle int `yaml:"max_labels_per_cycle,omitempty"`
+	MaxLabelsPerJob   int `yaml:"max_labels_per_job,omitempty"`
+	MaxLabelsPerDay   int `yaml:"max_labels_per_day,omitempty"`
+}
+
+func (l RemediationLimits) Validate() error {
+	if l.MaxLabelsPerCycle < 0 || l.MaxLabelsPerJob < 0 || l.MaxLabelsPerDay < 0 {
+		return fmt.Errorf("label limits can not be negative")
+	}
+	return nil
+}
+
+var ErrBreakerNotTripped = errors.New("remediation is not paused")
+
+// BreakerStatus is whether remediation is paused and why.
+type BreakerStatus struct {
+	Paused       bool       `json:"paused"`
+	Reason       string     `json:"reason,omitempty"`
+	PausedAt     *time.Time `json:"pausedAt,omitempty"`
+	DroppedToday int        `json:"droppedToday"`
+}
+
+// CircuitBreaker stops a bad limit setting from dropping dozens of labels at
+// once. Once a cap is hit it holds back every further label drop until it is
+// reset by hand.
+type CircuitBreaker struct {
+	Instance string
+	Limits   RemediationLimits
+
+	mu       sync.Mutex
+	paused   bool
+	reason   string
+	pausedAt time.Time
+	// dropped has the time of each label drop in the last day.
+	dropped []time.Time
+	now     func() time.Time
+}
+
+func (b *CircuitBreaker) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
+
+func (b *CircuitBreaker) droppedToday() int {
+	dayAgo := b.clock().Add(-24 * time.Hour)
+	i := 0
+	for i < len(b.dropped) && !b.dropped[i].After(dayAgo) {
+		i++
+	}
+	b.dropped = b.dropped[i:]
+	return len(b.dropped)
+}
+
+// Seed counts the labels dropped in the last day before cardinanny started.
+func (b *CircuitBreaker) Seed(entries []HistoryEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, e := range entries {
+		if e.Instance != b.Instance || e.Action != HistoryDrop {
+			continue
+		}
+		for range e.Labels {
+			b.dropped = append(b.dropped, e.Time)
+		}
+	}
+	b.droppedToday()
+}
+
+func (b *CircuitBreaker) trip(reason string) {
+	b.paused = true
+	b.reason = reason
+	b.pausedAt = b.clock()
+	RemediationPaused.WithLabelValues(b.Instance).Set(1)
+}
+
+// Allow splits the label drops into the ones within the caps and the ones
+// held back, pausing remediation if anything is held back. Labels in priority
+// are let through first, in its order, then the other labels job by job. It
+// also returns whether remediation was paused just now.
+func (b *CircuitBreaker) Allow(jobNamesToLabelsToDrop map[string][]string, priority []string) (map[string][]string, map[string][]string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	allowed := map[string][]string{}
+	held := map[string][]string{}
+	if b.paused {
+		for job, labels := range jobNamesToLabelsToDrop {
+			held[job] = labels
+		}
+		return allowed, held, false
+	}
+
+	type jobLabel struct{ job, label string }
+	var drops []jobLabel
+	for _, label := range priority {
+		for _, job := range sortedJobs(jobNamesToLabelsToDrop) {
+			if containsString(jobNamesToLabelsToDrop[job], label) {
+				drops = append(drops, jobLabel{job, label})
+			}
+		}
+	}
+	for _, job := range sortedJobs(jobNamesToLabelsToDrop) {
+		for _, label := range jobNamesToLabelsToDrop[job] {
+			if !containsString(priority, label) {
+				drops = append(drops, jobLabel{job, label})
+			}
+		}
+	}
+
+	var reason string
+	count, today := 0, b.droppedToday()
+	for _, d := range drops {
+		switch {
+		case b.Limits.MaxLabelsPerJob > 0 && len(allowed[d.job]) >= b.Limits.MaxLabelsPerJob:
+			reason = fmt.Sprintf("more than %d labels to drop in job %s", b.Limits.MaxLabelsPerJob, d.job)
+		case b.Limits.MaxLabelsPerCycle > 0 && count >= b.Limits.MaxLabelsPerCycle:
+			reason = fmt.Sprintf("more than %d labels to drop in one cycle", b.Limits.MaxLabelsPerCycle)
+		case b.Limits.MaxLabelsPerDay > 0 && today+count >= b.Limits.MaxLabelsPerDay:
+			reason = fmt.Sprintf("more than %d labels dropped in a day", b.Limits.MaxLabelsPerDay)
+		default:
+			allowed[d.job] = append(allowed[d.job], d.label)
+			count++
+			continue
+		}
+		held[d.job] = append(held[d.job], d.label)
+	}
+
+	if len(held) > 0 {
+		b.trip(reason)
+		return allowed, held, true
+	}
+	return allowed, held, false
+}
+
+// Record counts labels dropped towards the daily cap.
+func (b *CircuitBreaker) Record(jobNamesToLabelsToDrop map[string][]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock()
+	for _, labels := range jobNamesToLabelsToDrop {
+		for range labels {
+			b.dropped = append(b.dropped, now)
+		}
+	}
+}
+
+// Reset resumes remediation. The daily count starts again from zero, as the
+// labels dropped so far have been looked at.
+func (b *CircuitBreaker) Reset() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.paused {
+		return ErrBreakerNotTripped
+	}
+	b.paused = false
+	b.reason = ""
+	b.dropped = nil
+	RemediationPaused.WithLabelValues(b.Instance).Set(0)
+	return nil
+}
+
+func (b *CircuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := BreakerStatus{Paused: b.paused, Reason: b.reason, DroppedToday: b.droppedToday()}
+	if b.paused {
+		pausedAt := b.pausedAt
+		s.PausedAt = &pausedAt
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker_perJobAndCycleLimits(t *testing.T) {
+	b := &CircuitBreaker{Instance: "breaker-test", Limits: RemediationLimits{MaxLabelsPerCycle: 3, MaxLabelsPerJob: 2}}
+
+	allowed, held, paused := b.Allow(map[string][]string{"api": {"a", "b"}}, nil)
+	assert.Equal(t, map[string][]string{"api": {"a", "b"}}, allowed)
+	assert.Empty(t, held)
+	assert.False(t, paused)
+
+	allowed, held, paused = b.Allow(map[string][]string{"api": {"a", "b", "c"}, "worker": {"d", "e"}}, nil)
+	assert.Equal(t, map[string][]string{"api": {"a", "b"}, "worker": {"d"}}, allowed)
+	assert.Equal(t, map[string][]string{"api": {"c"}, "worker": {"e"}}, held)
+	assert.True(t, paused)
+	assert.Equal(t, "more than 3 labels to drop in one cycle", b.Status().Reason)
+	assert.Equal(t, 1.0, testutil.ToFloat64(RemediationPaused.WithLabelValues("breaker-test")))
+
+	// paused until reset
+	allowed, held, paused = b.Allow(map[string][]string{"api": {"a"}}, nil)
+	assert.Empty(t, allowed)
+	assert.Equal(t, map[string][]string{"api": {"a"}}, held)
+	assert.False(t, paused)
+
+	assert.Nil(t, b.Reset())
+	assert.Equal(t, ErrBreakerNotTripped, b.Reset())
+	assert.Equal(t, 0.0, testutil.ToFloat64(RemediationPaused.WithLabelValues("breaker-test")))
+
+	allowed, _, _ = b.Allow(map[string][]string{"api": {"a"}}, nil)
+	assert.Equal(t, map[string][]string{"api": {"a"}}, allowed)
+}
+
+func TestCircuitBreaker_dailyLimit(t *testing.T) {
+	now := time.Date(2021, 8, 2, 12, 0, 0, 0, time.UTC)
+	b := &CircuitBreaker{Instance: "breaker-test", Limits: RemediationLimits{MaxLabelsPerDay: 3}, now: func() time.Time { return now }}
+
+	b.Seed([]HistoryEntry{
+		{Instance: "breaker-test", Action: HistoryDrop, Job: "api", Labels: []string{"a", "b"}, Time: now.Add(-25 * time.Hour)},
+		{Instance: "breaker-test", Action: HistoryDrop, Job: "api", Labels: []string{"c"}, Time: now.Add(-time.Hour)},
+		{Instance: "breaker-test", Action: HistoryRevert, Job: "api", Labels: []string{"c"}, Time: now.Add(-time.Hour)},
+		{Instance: "other", Action: HistoryDrop, Job: "api", Labels: []string{"d"}, Time: now.Add(-time.Hour)},
+	})
+	assert.Equal(t, 1, b.Status().DroppedToday)
+
+	allowed, held, _ := b.Allow(map[string][]string{"api": {"d"}}, nil)
+	assert.Equal(t, map[string][]string{"api": {"d"}}, allowed)
+	assert.Empty(t, held)
+	b.Record(allowed)
+
+	allowed, held, paused := b.Allow(map[string][]string{"api": {"e", "f"}}, nil)
+	assert.Equal(t, map[string][]string{"api": {"e"}}, allowed)
+	assert.Equal(t, map[string][]string{"api": {"f"}}, held)
+	assert.True(t, paused)
+	assert.Equal(t, "more than 3 labels dropped in a day", b.Status().Reason)
+	assert.Equal(t, now, *b.Status().PausedAt)
+
+	assert.Nil(t, b.Reset())
+	assert.Equal(t, 0, b.Status().DroppedToday)
+}
+
+func TestCircuitBreaker_biggestContributorsFirst(t *testing.T) {
+	b := &CircuitBreaker{Instance: "breaker-priority-test", Limits: RemediationLimits{MaxLabelsPerCycle: 2}}
+
+	allowed, held, paused := b.Allow(map[string][]string{"api": {"small", "big"}, "worker": {"medium"}}, []string{"big", "medium", "small"})
+	assert.Equal(t, map[string][]string{"api": {"big"}, "worker": {"medium"}}, allowed)
+	assert.Equal(t, map[string][]string{"api": {"small"}}, held)
+	assert.True(t, paused)
+}
@@ -0,0 +1,67 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"go.uber.org/zap"
+)
+
+// Capabilities describes which of the Prometheus APIs cardinanny relies on are
+// available. Long term stores like Thanos, Cortex and Mimir implement the
+// query API but not the TSDB stats or admin endpoints.
+type Capabilities struct {
+	Version   string
+	TSDBStats bool
+	AdminAPI  bool
+	// Lifecycle is whether the /-/reload endpoint is enabled.
+	Lifecycle bool
+}
+
+// isUnsupported tells an endpoint the server doesn't implement from one which
+// failed.
+func isUnsupported(err error) bool {
+	var apiErr *v1.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.Msg {
+	case fmt.Sprintf("client error: %d", http.StatusNotFound),
+		fmt.Sprintf("client error: %d", http.StatusMethodNotAllowed),
+		fmt.Sprintf("server error: %d", http.StatusNotImplemented):
+		return true
+	}
+	return false
+}
+
+// DetectCapabilities asks the server what it supports. Only a server without
+// the flags endpoint is taken for a long term store, any other error leaves
+// the capabilities unknown and is returned so detection can be tried again.
+func DetectCapabilities(ctx context.Context, promAPI v1.API, logger *zap.SugaredLogger) (Capabilities, error) {
+	caps := Capabilities{}
+
+	if info, err := promAPI.Buildinfo(ctx); err != nil {
+		logger.Debugw("buildinfo not available", "error", err)
+	} else {
+		caps.Version = info.Version
+	}
+
+	flags, err := promAPI.Flags(ctx)
+	if err != nil && !isUnsupported(err) {
+		return caps, fmt.Errorf("error detecting prometheus capabilities, %w", err)
+	}
+	if err != nil {
+		logger.Infow("flags not available, assuming a long term store without TSDB stats or admin APIs", "error", err)
+		return caps, nil
+	}
+
+	caps.TSDBStats = true
+	caps.AdminAPI = flags["web.enable-admin-api"] == "true"
+	caps.Lifecycle = flags["web.enable-lifecycle"] == "true"
+
+	logger.Infow("detected prometheus capabilities", "version", caps.Version, "tsdbStats", caps.TSDBStats, "adminAPI", caps.AdminAPI, "lifecycle", caps.Lifecycle)
+	return caps, nil
+}
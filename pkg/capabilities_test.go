@@ -0,0 +1,70 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mclarke47/cardinanny/mock_v1"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_DetectCapabilities_prometheusWithAdminAPI(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	m.EXPECT().Buildinfo(gomock.Any()).Return(v1.BuildinfoResult{Version: "2.29.1"}, nil)
+	m.EXPECT().Flags(gomock.Any()).Return(v1.FlagsResult{
+		"web.enable-admin-api": "true",
+		"web.enable-lifecycle": "false",
+	}, nil)
+
+	caps, err := DetectCapabilities(context.Background(), m, zap.NewNop().Sugar())
+	assert.Nil(t, err)
+
+	assert.Equal(t, Capabilities{Version: "2.29.1", TSDBStats: true, AdminAPI: true}, caps)
+}
+
+func Test_DetectCapabilities_prometheusWithLifecycle(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	m.EXPECT().Buildinfo(gomock.Any()).Return(v1.BuildinfoResult{Version: "2.29.1"}, nil)
+	m.EXPECT().Flags(gomock.Any()).Return(v1.FlagsResult{
+		"web.enable-admin-api": "false",
+		"web.enable-lifecycle": "true",
+	}, nil)
+
+	caps, err := DetectCapabilities(context.Background(), m, zap.NewNop().Sugar())
+	assert.Nil(t, err)
+
+	assert.Equal(t, Capabilities{Version: "2.29.1", TSDBStats: true, Lifecycle: true}, caps)
+}
+
+func Test_DetectCapabilities_longTermStore(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	m.EXPECT().Buildinfo(gomock.Any()).Return(v1.BuildinfoResult{}, &v1.Error{Type: v1.ErrClient, Msg: "client error: 404"})
+	m.EXPECT().Flags(gomock.Any()).Return(v1.FlagsResult{}, &v1.Error{Type: v1.ErrClient, Msg: "client error: 404"})
+
+	caps, err := DetectCapabilities(context.Background(), m, zap.NewNop().Sugar())
+	assert.Nil(t, err)
+
+	assert.Equal(t, Capabilities{}, caps)
+}
+
+func Test_DetectCapabilities_failureIsNotALongTermStore(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	m.EXPECT().Buildinfo(gomock.Any()).Return(v1.BuildinfoResult{Version: "2.29.1"}, nil)
+	m.EXPECT().Flags(gomock.Any()).Return(v1.FlagsResult{}, errors.New("connection refused"))
+
+	_, err := DetectCapabilities(context.Background(), m, zap.NewNop().Sugar())
+
+	assert.NotNil(t, err)
+}
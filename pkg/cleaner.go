@@ -3,6 +3,7 @@ package pkg
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"time"
 
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
@@ -12,6 +13,9 @@ import (
 type PromCleaner struct {
 	Logger  *zap.SugaredLogger
 	PromAPI v1.API
+	// Targets limits the series deleted to the instances a label was dropped
+	// from when label drops are scoped to instances.
+	Targets *TargetAttributor
 }
 
 func query(labelName string) string {
@@ -39,3 +43,55 @@ func (p *PromCleaner) Clean(ctx context.Context, labelsToDrop []string) error {
 	}
 	return nil
 }
+
+func jobQuery(job, labelName string) string {
+	return fmt.Sprintf("{job=%s,%s=~\".+\"}", strconv.Quote(job), labelName)
+}
+
+// scopedJobQuery selects the series of the instances a label was dropped from,
+// leaving out the ones scraped since.
+func scopedJobQuery(job, labelName string, instances []string) string {
+	return fmt.Sprintf("{job=%s,instance=~%s,%s=~\".+\",%s!=%s}", strconv.Quote(job), strconv.Quote(instancesRegex(instances)), labelName, labelName, strconv.Quote(ScopedDropValue))
+}
+
+func (p *PromCleaner) seriesQuery(job, labelName string) string {
+	if p.Targets != nil {
+		if instances := p.Targets.Responsible(job, labelName); len(instances) > 0 {
+			return scopedJobQuery(job, labelName, instances)
+		}
+	}
+	return jobQuery(job, labelName)
+}
+
+// CleanJobs deletes the series of each job with the dropped labels, leaving
+// the same labels of other jobs alone. It carries on with the other jobs when
+// one fails and returns the errors by job.
+func (p *PromCleaner) CleanJobs(ctx context.Context, jobNamesToLabels map[string][]string) map[string]error {
+	failed := map[string]error{}
+	var deleted []string
+
+	for _, job := range sortedJobs(jobNamesToLabels) {
+		var seriesToDrop []string
+		for _, l := range jobNamesToLabels[job] {
+			seriesToDrop = append(seriesToDrop, p.seriesQuery(job, l))
+		}
+
+		p.Logger.Debugw("deleting series", "job", job, "series", seriesToDrop)
+
+		if err := p.PromAPI.DeleteSeries(ctx, seriesToDrop, time.Now().Add(-time.Hour), time.Now()); err != nil {
+			failed[job] = fmt.Errorf("error while deleting label data %v of job %s, error %v", jobNamesToLabels[job], job, err)
+			continue
+		}
+		deleted = append(deleted, job)
+	}
+
+	if len(deleted) == 0 {
+		return failed
+	}
+	if err := p.PromAPI.CleanTombstones(ctx); err != nil {
+		for _, job := range deleted {
+			failed[job] = fmt.Errorf("error while cleaning tombstones for label data %v of job %s, error %v", jobNamesToLabels[job], job, err)
+		}
+	}
+	return failed
+}
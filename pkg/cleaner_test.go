@@ -90,3 +90,63 @@ func Test_PromCleaner_CleanTombstonesReturnsError(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Equal(t, "error while cleaning tombstones for label data [label1 otherlabel2], error some-error", err.Error())
 }
+
+func Test_PromCleaner_CleanJobs(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+
+	pc := PromCleaner{
+		Logger:  zap.NewNop().Sugar(),
+		PromAPI: m,
+	}
+
+	gomock.InOrder(
+		m.
+			EXPECT().
+			DeleteSeries(gomock.Any(), gomock.Eq([]string{"{job=\"api\",label1=~\".+\"}", "{job=\"api\",label2=~\".+\"}"}), gomock.Any(), gomock.Any()).
+			Return(errors.New("some-error")),
+		m.
+			EXPECT().
+			DeleteSeries(gomock.Any(), gomock.Eq([]string{"{job=\"worker\",label1=~\".+\"}"}), gomock.Any(), gomock.Any()).
+			Return(nil),
+		m.
+			EXPECT().
+			CleanTombstones(gomock.Any()).
+			Return(nil),
+	)
+
+	failed := pc.CleanJobs(context.Background(), map[string][]string{
+		"api":    {"label1", "label2"},
+		"worker": {"label1"},
+	})
+
+	assert.Len(t, failed, 1)
+	assert.Equal(t, "error while deleting label data [label1 label2] of job api, error some-error", failed["api"].Error())
+}
+
+func Test_PromCleaner_CleanJobsScopedToInstances(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := mock_v1.NewMockAPI(ctrl)
+
+	pc := PromCleaner{
+		Logger:  zap.NewNop().Sugar(),
+		PromAPI: m,
+		Targets: scopedAttributor("api", "label1", "10.0.0.1:8080"),
+	}
+
+	gomock.InOrder(
+		m.
+			EXPECT().
+			DeleteSeries(gomock.Any(), gomock.Eq([]string{`{job="api",instance=~"10\\.0\\.0\\.1:8080",label1=~".+",label1!="cardinanny_dropped"}`, `{job="api",label2=~".+"}`}), gomock.Any(), gomock.Any()).
+			Return(nil),
+		m.
+			EXPECT().
+			CleanTombstones(gomock.Any()).
+			Return(nil),
+	)
+
+	failed := pc.CleanJobs(context.Background(), map[string][]string{"api": {"label1", "label2"}})
+	assert.Empty(t, failed)
+}
@@ -2,90 +2,255 @@ package pkg
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 
 	plog "github.com/go-kit/log"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/pkg/relabel"
 	"go.uber.org/zap"
 )
 
+var (
+	ErrLabelNotDropped = errors.New("label is not dropped by cardinanny")
+	ErrReloadTimeout   = errors.New("prometheus did not load the new config in time")
+)
+
+const (
+	DefaultReloadTimeout = 30 * time.Second
+	reloadPollInterval   = time.Second
+)
+
 type PromConfigRewriter struct {
-	Logger     *zap.SugaredLogger
-	PromAPI    v1.API
+	Logger  *zap.SugaredLogger
+	PromAPI v1.API
+	// Reloader reloads prometheus once the config file is written, the
+	// /-/reload endpoint at BaseURL when not set.
+	Reloader   Reloader
 	HTTPClient *http.Client
 	BaseURL    string
+	Git        *GitConfigRepo
+	// Instance labels the drift metrics.
+	Instance    string
+	DriftPolicy DriftPolicy
+	// ReloadTimeout is how long prometheus gets to run the new config after
+	// a reload, DefaultReloadTimeout when not set.
+	ReloadTimeout time.Duration
+	// Targets scopes label drops to the instances responsible for them when
+	// set, labels are dropped from the whole job otherwise.
+	Targets *TargetAttributor
 }
 
-func toRegexMap(jobNamesToLabelsToDrop map[string][]string) map[string]string {
-	result := map[string]string{}
+// getConfig returns the running config both as prometheus reports it and
+// parsed.
+func (p *PromConfigRewriter) getConfig(ctx context.Context) (string, *config.Config, error) {
+	c, err := p.PromAPI.Config(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("error retrieving the latest config from the promtheus API, %w", err)
+	}
 
-	for k, labels := range jobNamesToLabelsToDrop {
+	var cfgFile *config.Config
+	if cfgFile, err = config.Load(c.YAML, false, plog.NewNopLogger()); err != nil {
+		return "", nil, err
+	}
+	return c.YAML, cfgFile, nil
+}
 
-		var r string
-		for _, v := range labels {
-			if r == "" {
-				r += v
-			} else {
-				r += fmt.Sprintf("|%s", v)
+// addLabelDrops adds the labels to the job's labeldrop rule, creating it if
+// the job does not have one yet. It returns the labels added in a new rule and
+// the ones merged into an existing rule, labels already dropped are skipped.
+func addLabelDrops(jobNamesToLabelsToDrop map[string][]string, cfgFile *config.Config) (map[string][]string, map[string][]string) {
+	added := map[string][]string{}
+	merged := map[string][]string{}
+
+	for _, sc := range cfgFile.ScrapeConfigs {
+
+		labels, ok := jobNamesToLabelsToDrop[sc.JobName]
+		if !ok {
+			continue
+		}
+
+		var existing *relabel.Config
+		var dropped []string
+		for _, rc := range sc.MetricRelabelConfigs {
+			if names, ok := regexLabelNames(rc.Regex); ok && rc.Action == relabel.LabelDrop {
+				if existing == nil {
+					existing = rc
+				}
+				dropped = append(dropped, names...)
 			}
 		}
 
-		result[k] = r
-	}
+		var newLabels []string
+		for _, l := range labels {
+			if !containsString(dropped, l) && !containsString(newLabels, l) {
+				newLabels = append(newLabels, l)
+			}
+		}
+		if len(newLabels) == 0 {
+			continue
+		}
 
-	return result
+		if existing != nil {
+			names, _ := regexLabelNames(existing.Regex)
+			existing.Regex = relabel.MustNewRegexp(strings.Join(append(names, newLabels...), "|"))
+			merged[sc.JobName] = newLabels
+			continue
+		}
+
+		sc.MetricRelabelConfigs = append(sc.MetricRelabelConfigs, &relabel.Config{
+			Action: relabel.LabelDrop,
+			Regex:  relabel.MustNewRegexp(strings.Join(newLabels, "|")),
+		})
+		added[sc.JobName] = newLabels
+	}
+	return added, merged
 }
 
-func (p *PromConfigRewriter) getConfigFile(ctx context.Context) (*config.Config, error) {
-	c, err := p.PromAPI.Config(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("error retrieving the latest config from the promtheus API, %w", err)
+// scope takes the labels coming from some of the job's targets only out of
+// the labels to drop from the whole job.
+func (p *PromConfigRewriter) scope(jobNamesToLabelsToDrop map[string][]string) (map[string][]string, map[string][]ScopedDrop) {
+	if p.Targets == nil {
+		return jobNamesToLabelsToDrop, nil
 	}
 
-	var cfgFile *config.Config
-	if cfgFile, err = config.Load(c.YAML, false, plog.NewNopLogger()); err != nil {
-		return nil, err
+	jobWide := map[string][]string{}
+	scoped := map[string][]ScopedDrop{}
+	for job, labels := range jobNamesToLabelsToDrop {
+		for _, l := range labels {
+			if instances := p.Targets.Responsible(job, l); len(instances) > 0 {
+				scoped[job] = append(scoped[job], ScopedDrop{Label: l, Instances: instances})
+			} else {
+				jobWide[job] = append(jobWide[job], l)
+			}
+		}
 	}
-	return cfgFile, nil
+	return jobWide, scoped
 }
 
-func generateNewConfigFile(jobNamesToLabelsToDrop map[string][]string, cfgFile config.Config, configPath string) error {
-	jobNamesToLabelDropRegex := toRegexMap(jobNamesToLabelsToDrop)
+// addScopedDrops adds a rule replacing the values of each label for the given
+// instances. Labels dropped from the whole job and instances the label is
+// already dropped from are skipped. It returns what was added.
+func addScopedDrops(jobNamesToScopedDrops map[string][]ScopedDrop, cfgFile *config.Config) map[string][]ScopedDrop {
+	added := map[string][]ScopedDrop{}
 
 	for _, sc := range cfgFile.ScrapeConfigs {
+		drops, ok := jobNamesToScopedDrops[sc.JobName]
+		if !ok {
+			continue
+		}
 
-		if v, ok := jobNamesToLabelDropRegex[sc.JobName]; ok {
+		var dropped []string
+		scopedInstances := map[string][]string{}
+		for _, rc := range sc.MetricRelabelConfigs {
+			if names, ok := regexLabelNames(rc.Regex); ok && rc.Action == relabel.LabelDrop {
+				dropped = append(dropped, names...)
+			}
+			if d, ok := scopedDropLabel(rc); ok {
+				scopedInstances[d.Label] = append(scopedInstances[d.Label], d.Instances...)
+			}
+		}
 
-			sc.MetricRelabelConfigs = append(sc.MetricRelabelConfigs, &relabel.Config{
-				Action: relabel.LabelDrop,
-				Regex:  relabel.MustNewRegexp(v),
-			})
+		for _, d := range drops {
+			if containsString(dropped, d.Label) {
+				continue
+			}
+			var instances []string
+			for _, i := range d.Instances {
+				if !containsString(scopedInstances[d.Label], i) {
+					instances = append(instances, i)
+				}
+			}
+			if len(instances) == 0 {
+				continue
+			}
+
+			drop := ScopedDrop{Label: d.Label, Instances: instances}
+			sc.MetricRelabelConfigs = append(sc.MetricRelabelConfigs, scopedDropConfig(drop))
+			added[sc.JobName] = append(added[sc.JobName], drop)
 		}
 	}
-	return ioutil.WriteFile(configPath, []byte(cfgFile.String()), 0644)
+	return added
 }
 
-func (p *PromConfigRewriter) reloadConfig(ctx context.Context) error {
+// regexLabelNames returns the label names a labeldrop regex was generated
+// from, or false if it is not a plain alternation of label names.
+func regexLabelNames(re relabel.Regexp) ([]string, bool) {
+	original, err := re.MarshalYAML()
+	if err != nil || original == nil {
+		return nil, false
+	}
 
-	resp, err := p.HTTPClient.Post(fmt.Sprintf("%s/-/reload", p.BaseURL), "", nil)
-	if err != nil {
-		return err
+	names := strings.Split(original.(string), "|")
+	for _, n := range names {
+		if !model.LabelName(n).IsValid() {
+			return nil, false
+		}
 	}
+	return names, true
+}
 
-	if resp.StatusCode != 200 {
-		defer resp.Body.Close()
-		b, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("error when reloading prometheus config, expected status code 200 but was %d, body was unreadable", resp.StatusCode)
+// removeLabelDrops takes the labels out of the labeldrop rules of the job,
+// removing rules which no longer drop anything along with the rules dropping
+// the labels from some instances only. It returns the labels which were
+// found.
+func removeLabelDrops(job string, labels []string, cfgFile *config.Config) ([]string, error) {
+	for _, sc := range cfgFile.ScrapeConfigs {
+		if sc.JobName != job {
+			continue
 		}
-		return fmt.Errorf("error when reloading prometheus config, expected status code 200 but was %d, body: %s", resp.StatusCode, b)
+
+		var removed []string
+		var kept []*relabel.Config
+		for _, rc := range sc.MetricRelabelConfigs {
+			if d, ok := scopedDropLabel(rc); ok && containsString(labels, d.Label) {
+				if !containsString(removed, d.Label) {
+					removed = append(removed, d.Label)
+				}
+				continue
+			}
+
+			names, ok := regexLabelNames(rc.Regex)
+			if rc.Action != relabel.LabelDrop || !ok {
+				kept = append(kept, rc)
+				continue
+			}
+
+			var remaining []string
+			for _, n := range names {
+				if containsString(labels, n) {
+					if !containsString(removed, n) {
+						removed = append(removed, n)
+					}
+				} else {
+					remaining = append(remaining, n)
+				}
+			}
+
+			if len(remaining) == 0 {
+				continue
+			}
+			rc.Regex = relabel.MustNewRegexp(strings.Join(remaining, "|"))
+			kept = append(kept, rc)
+		}
+		sc.MetricRelabelConfigs = kept
+		return removed, nil
 	}
+	return nil, fmt.Errorf("job %s not found in the prometheus config", job)
+}
 
-	return nil
+func (p *PromConfigRewriter) reloadConfig(ctx context.Context) error {
+	if p.Reloader != nil {
+		return p.Reloader.Reload(ctx)
+	}
+	reloader := HTTPReloader{HTTPClient: p.HTTPClient, BaseURL: p.BaseURL}
+	return reloader.Reload(ctx)
 }
 
 func (p *PromConfigRewriter) DropLabelsInJobs(ctx context.Context, jobNamesToLabelsToDrop map[string][]string, configPath string) error {
@@ -94,28 +259,98 @@ func (p *PromConfigRewriter) DropLabelsInJobs(ctx context.Context, jobNamesToLab
 		return nil
 	}
 
-	cfgFile, err := p.getConfigFile(ctx)
+	plan, err := p.Plan(ctx, jobNamesToLabelsToDrop, nil, configPath)
 	if err != nil {
 		return err
 	}
+	if plan.Empty() {
+		p.Logger.Infow("labels are already dropped, config unchanged", "labels", jobNamesToLabelsToDrop)
+		return nil
+	}
 
-	if len(cfgFile.ScrapeConfigs) == 0 {
-		return fmt.Errorf("had labels to drop %v, but no scrapeConfigs in config file at %s", jobNamesToLabelsToDrop, configPath)
+	if err := ioutil.WriteFile(configPath, []byte(plan.Config), 0644); err != nil {
+		return err
 	}
 
-	err = generateNewConfigFile(jobNamesToLabelsToDrop, *cfgFile, configPath)
+	p.Logger.Debug("Config file generated")
+
+	return p.applyConfigChange(ctx, configPath, DropChange(plan.Dropped()))
+}
+
+// RestoreLabelsInJob undoes a previous DropLabelsInJobs for the labels of one
+// job, leaving any other relabel rules alone. Labels which are not dropped are
+// ignored as long as at least one of them is.
+func (p *PromConfigRewriter) RestoreLabelsInJob(ctx context.Context, job string, labels []string, configPath string) error {
+	plan, err := p.Plan(ctx, nil, map[string][]string{job: labels}, configPath)
 	if err != nil {
 		return err
 	}
+	if plan.Empty() {
+		return fmt.Errorf("%w: %v in job %s", ErrLabelNotDropped, labels, job)
+	}
 
-	p.Logger.Debug("Config file generated")
+	if err := ioutil.WriteFile(configPath, []byte(plan.Config), 0644); err != nil {
+		return err
+	}
+
+	removed := plan.Restored()[job]
+	p.Logger.Debugw("Config file generated", "restored", removed)
+
+	return p.applyConfigChange(ctx, configPath, RestoreChange(job, removed))
+}
+
+func (p *PromConfigRewriter) applyConfigChange(ctx context.Context, configPath string, change ConfigChange) error {
+	if p.Git != nil {
+		return p.Git.CommitConfigChange(ctx, configPath, change)
+	}
 
-	err = p.reloadConfig(ctx)
+	err := p.reloadConfig(ctx)
 	if err != nil {
+		ConfigReloads.WithLabelValues(p.Instance, "failed").Inc()
 		return err
 	}
 
+	if err := p.waitForConfig(ctx, configPath); err != nil {
+		ConfigReloads.WithLabelValues(p.Instance, "timeout").Inc()
+		return err
+	}
+	ConfigReloads.WithLabelValues(p.Instance, "success").Inc()
+
 	p.Logger.Debug("Prom config reloaded")
 
 	return nil
 }
+
+// waitForConfig polls the running config until it is the one in the config
+// file, as a successful reload request does not mean prometheus loaded it.
+func (p *PromConfigRewriter) waitForConfig(ctx context.Context, configPath string) error {
+	_, asWritten, resolved, err := loadDiskConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	timeout := p.ReloadTimeout
+	if timeout == 0 {
+		timeout = DefaultReloadTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(reloadPollInterval)
+	defer ticker.Stop()
+	for {
+		_, running, err := p.getConfig(ctx)
+		if err == nil && configMatches(running, asWritten, resolved) {
+			return nil
+		}
+		if err != nil {
+			p.Logger.Debugw("unable to check the running config", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w, the running config did not match %s after %s", ErrReloadTimeout, configPath, timeout)
+		case <-ticker.C:
+		}
+	}
+}
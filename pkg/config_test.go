@@ -8,11 +8,16 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 
+	plog "github.com/go-kit/log"
 	"github.com/golang/mock/gomock"
 	"github.com/mclarke47/cardinanny/mock_v1"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/config"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 )
@@ -24,6 +29,18 @@ func yamlFixture(t *testing.T, file string) string {
 	return string(yaml)
 }
 
+// expectReload makes the mock prometheus run whatever is in the config file
+// when the rewriter checks the reload took effect.
+func expectReload(m *mock_v1.MockAPI, configPath string) *gomock.Call {
+	return m.
+		EXPECT().
+		Config(gomock.Any()).
+		DoAndReturn(func(context.Context) (v1.ConfigResult, error) {
+			b, err := ioutil.ReadFile(configPath)
+			return v1.ConfigResult{YAML: string(b)}, err
+		})
+}
+
 func TestConfigWriter_emptymap(t *testing.T) {
 
 	ctrl := gomock.NewController(t)
@@ -204,6 +221,42 @@ func TestConfigWriter_reloadReturnsError(t *testing.T) {
 	)
 }
 
+func TestConfigWriter_reloadNotTakingEffect(t *testing.T) {
+	running := yamlFixture(t, "./fixtures/2-scrape-jobs.yaml")
+	writer := planRewriter(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}, running)
+	writer.Instance = "reload-not-taking-effect"
+	writer.ReloadTimeout = 50 * time.Millisecond
+
+	// prometheus keeps running the old config, e.g. because it failed to load
+	// the new one
+	writer.PromAPI.(*mock_v1.MockAPI).
+		EXPECT().
+		Config(gomock.Any()).
+		Return(v1.ConfigResult{YAML: running}, nil).
+		AnyTimes()
+
+	path := writeConfigFile(t, "")
+	err := writer.DropLabelsInJobs(context.Background(), map[string][]string{"some-job": {"somevalue"}}, path)
+	assert.True(t, errors.Is(err, ErrReloadTimeout))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ConfigReloads.WithLabelValues("reload-not-taking-effect", "timeout")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(ConfigReloads.WithLabelValues("reload-not-taking-effect", "success")))
+}
+
+func TestConfigWriter_reloadTakesEffect(t *testing.T) {
+	writer := planRewriter(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}, yamlFixture(t, "./fixtures/2-scrape-jobs.yaml"))
+	writer.Instance = "reload-takes-effect"
+
+	path := writeConfigFile(t, "")
+	expectReload(writer.PromAPI.(*mock_v1.MockAPI), path)
+
+	assert.Nil(t, writer.DropLabelsInJobs(context.Background(), map[string][]string{"some-job": {"somevalue"}}, path))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ConfigReloads.WithLabelValues("reload-takes-effect", "success")))
+}
+
 func testLabelDropping(
 	t *testing.T,
 	inputYamlFixturePath string,
@@ -246,6 +299,7 @@ func testLabelDroppingWithReloadFunc(
 			YAML: string(yaml),
 		}, nil).
 		MaxTimes(1)
+	expectReload(m, tempFile.Name()).MaxTimes(1)
 
 	writer := PromConfigRewriter{
 		PromAPI:    m,
@@ -269,3 +323,78 @@ func assertConfigFilesAreEqual(t *testing.T, expectedFilePath string, actualFile
 
 	assert.Nil(t, err)
 }
+
+func testLabelRestoring(t *testing.T, inputYamlFixturePath string, job string, labels []string) (string, error) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(ts.Close)
+
+	tempFile, err := ioutil.TempFile("", fmt.Sprintf("%s.yaml", t.Name()))
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.Remove(tempFile.Name()) })
+
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	m.
+		EXPECT().
+		Config(gomock.Any()).
+		Return(v1.ConfigResult{
+			YAML: yamlFixture(t, inputYamlFixturePath),
+		}, nil)
+	expectReload(m, tempFile.Name()).MaxTimes(1)
+
+	writer := PromConfigRewriter{
+		PromAPI:    m,
+		HTTPClient: ts.Client(),
+		BaseURL:    ts.URL,
+		Logger:     zap.NewNop().Sugar(),
+	}
+
+	err = writer.RestoreLabelsInJob(context.Background(), job, labels, tempFile.Name())
+
+	b, readErr := ioutil.ReadAll(tempFile)
+	assert.Nil(t, readErr)
+	return string(b), err
+}
+
+// assertConfigsAreEquivalent compares configs once loaded, as loading fills
+// in the defaults of the relabel rules.
+func assertConfigsAreEquivalent(t *testing.T, expectedFilePath string, actual string) {
+	expected, err := config.Load(yamlFixture(t, expectedFilePath), false, plog.NewNopLogger())
+	assert.Nil(t, err)
+
+	loaded, err := config.Load(actual, false, plog.NewNopLogger())
+	assert.Nil(t, err)
+
+	assert.Equal(t, expected.String(), loaded.String())
+}
+
+func TestConfigWriter_restoreOneOfTwoLabels(t *testing.T) {
+	actual, err := testLabelRestoring(t, "./fixtures/2-scrape-jobs-expected-2-label.yaml", "some-job", []string{"anotherBadLabel"})
+	assert.Nil(t, err)
+	assertConfigsAreEquivalent(t, "./fixtures/2-scrape-jobs-expected-1-label.yaml", actual)
+}
+
+func TestConfigWriter_restoreLastLabelRemovesRule(t *testing.T) {
+	actual, err := testLabelRestoring(t, "./fixtures/2-scrape-jobs-expected-1-label.yaml", "some-job", []string{"somevalue"})
+	assert.Nil(t, err)
+	assertConfigsAreEquivalent(t, "./fixtures/2-scrape-jobs.yaml", actual)
+}
+
+func TestConfigWriter_restoreOnlyTouchesTheJob(t *testing.T) {
+	actual, err := testLabelRestoring(t, "./fixtures/2-scrape-jobs-expected-1-label-each.yaml", "some-other-job", []string{"somevalue"})
+	assert.Nil(t, err)
+	assert.Contains(t, actual, "regex: anotherBadLabel")
+	assert.NotContains(t, actual, "regex: somevalue")
+}
+
+func TestConfigWriter_restoreLabelNotDropped(t *testing.T) {
+	actual, err := testLabelRestoring(t, "./fixtures/2-scrape-jobs-expected-1-label.yaml", "some-other-job", []string{"somevalue"})
+	assert.True(t, errors.Is(err, ErrLabelNotDropped))
+	assert.Equal(t, "", actual)
+
+	_, err = testLabelRestoring(t, "./fixtures/2-scrape-jobs.yaml", "unknown-job", []string{"somevalue"})
+	assert.Equal(t, "job unknown-job not found in the prometheus config", err.Error())
+}
@@ -0,0 +1,247 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"go.uber.org/zap"
+)
+
+const ImpactDashboard = "dashboard"
+
+// grafanaVariable stands in for dashboard variables so queries using them
+// can be parsed as PromQL.
+const grafanaVariable = "__grafana_var__"
+
+var (
+	// grafana's interval variables are used as range durations
+	grafanaIntervalVariable = regexp.MustCompile(`\$\{?__(rate_interval|interval|range)(_ms|_s)?\}?`)
+	grafanaVariableRef      = regexp.MustCompile(`\$\{[^}]+\}|\[\[[^\]]+\]\]|\$[a-zA-Z_][a-zA-Z0-9_]*`)
+	grafanaLabelValues      = regexp.MustCompile(`^\s*label_values\((?:(.*),)?\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*\)\s*$`)
+	grafanaQueryResult      = regexp.MustCompile(`^\s*query_result\((.*)\)\s*$`)
+)
+
+func parseDashboardQuery(query string) (parser.Expr, error) {
+	query = grafanaIntervalVariable.ReplaceAllString(query, "5m")
+	query = grafanaVariableRef.ReplaceAllString(query, grafanaVariable)
+	return parser.ParseExpr(query)
+}
+
+// dashboardQuery is a PromQL query of a panel or template variable.
+type dashboardQuery struct {
+	where string
+	query string
+}
+
+type grafanaTarget struct {
+	Expr string `json:"expr"`
+}
+
+type grafanaPanel struct {
+	Title   string          `json:"title"`
+	Targets []grafanaTarget `json:"targets"`
+	// rows have their panels inside them when collapsed
+	Panels []grafanaPanel `json:"panels"`
+}
+
+type grafanaVariableDef struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Query is a string or, in newer versions, an object with the query.
+	Query      json.RawMessage `json:"query"`
+	Definition string          `json:"definition"`
+}
+
+type grafanaDashboard struct {
+	Title  string         `json:"title"`
+	UID    string         `json:"uid"`
+	Panels []grafanaPanel `json:"panels"`
+	// Rows are how dashboards were laid out before grafana 5.
+	Rows []struct {
+		Panels []grafanaPanel `json:"panels"`
+	} `json:"rows"`
+	Templating struct {
+		List []grafanaVariableDef `json:"list"`
+	} `json:"templating"`
+}
+
+func (v grafanaVariableDef) query() string {
+	var s string
+	if err := json.Unmarshal(v.Query, &s); err == nil {
+		return s
+	}
+	var q struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal(v.Query, &q); err == nil && q.Query != "" {
+		return q.Query
+	}
+	return v.Definition
+}
+
+func panelQueries(panels []grafanaPanel) []dashboardQuery {
+	var queries []dashboardQuery
+	for _, p := range panels {
+		for _, t := range p.Targets {
+			if t.Expr != "" {
+				queries = append(queries, dashboardQuery{where: "panel " + p.Title, query: t.Expr})
+			}
+		}
+		queries = append(queries, panelQueries(p.Panels)...)
+	}
+	return queries
+}
+
+func (d *grafanaDashboard) name() string {
+	if d.Title != "" {
+		return d.Title
+	}
+	return d.UID
+}
+
+func (d *grafanaDashboard) queries() []dashboardQuery {
+	queries := panelQueries(d.Panels)
+	for _, r := range d.Rows {
+		queries = append(queries, panelQueries(r.Panels)...)
+	}
+	for _, v := range d.Templating.List {
+		if v.Type == "query" {
+			if q := v.query(); q != "" {
+				queries = append(queries, dashboardQuery{where: "variable " + v.Name, query: q})
+			}
+		}
+	}
+	return queries
+}
+
+// loadDashboard reads a dashboard JSON export, either the dashboard model
+// itself or as returned by the grafana API with the dashboard under a
+// "dashboard" key.
+func loadDashboard(path string) (*grafanaDashboard, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var wrapped struct {
+		Dashboard *grafanaDashboard `json:"dashboard"`
+	}
+	if err := json.Unmarshal(b, &wrapped); err != nil {
+		return nil, fmt.Errorf("error parsing grafana dashboard %s, %w", path, err)
+	}
+	if wrapped.Dashboard != nil {
+		return wrapped.Dashboard, nil
+	}
+
+	var d grafanaDashboard
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, fmt.Errorf("error parsing grafana dashboard %s, %w", path, err)
+	}
+	return &d, nil
+}
+
+// DashboardsImpactAnalyzer finds the grafana dashboards, exported as JSON
+// into a directory, whose panels or template variables use labels about to
+// be dropped. The directory is read again every time so it can be kept in
+// sync with grafana.
+type DashboardsImpactAnalyzer struct {
+	Logger *zap.SugaredLogger
+	Dir    string
+	Action ImpactAction
+}
+
+// parseGrafanaQuery parses a dashboard query, which can also be grafana's
+// label_values and query_result variable queries. It returns the label of
+// label_values queries, and no expression for label_values of any metric.
+func parseGrafanaQuery(query string) (parser.Expr, string, error) {
+	var label string
+	if m := grafanaLabelValues.FindStringSubmatch(query); m != nil {
+		if strings.TrimSpace(m[1]) == "" {
+			return nil, m[2], nil
+		}
+		query, label = m[1], m[2]
+	} else if m := grafanaQueryResult.FindStringSubmatch(query); m != nil {
+		query = m[1]
+	}
+
+	expr, err := parseDashboardQuery(query)
+	return expr, label, err
+}
+
+func (d *DashboardsImpactAnalyzer) Impacts(ctx context.Context, jobNamesToLabelsToDrop map[string][]string) ([]Impact, error) {
+	if d.Action == ImpactIgnore || len(jobNamesToLabelsToDrop) == 0 {
+		return nil, nil
+	}
+
+	var paths []string
+	err := filepath.Walk(d.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".json") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing grafana dashboards, %w", err)
+	}
+
+	var impacts []Impact
+	for _, path := range paths {
+		dashboard, err := loadDashboard(path)
+		if err != nil {
+			d.Logger.Warnw("unable to load grafana dashboard, ignoring it", "path", path, "error", err)
+			continue
+		}
+
+		for _, q := range dashboard.queries() {
+			expr, label, err := parseGrafanaQuery(q.query)
+			if err != nil {
+				// not every panel queries prometheus
+				d.Logger.Debugw("unable to parse dashboard query, ignoring it", "dashboard", dashboard.name(), "query", q.query, "error", err)
+				continue
+			}
+
+			for _, job := range sortedJobs(jobNamesToLabelsToDrop) {
+				used, selectsJob := []string{label}, true
+				if expr != nil {
+					used, selectsJob = queryLabels(expr, job)
+					if label != "" {
+						used = append(used, label)
+					}
+				}
+				if !selectsJob {
+					continue
+				}
+
+				var affected []string
+				for _, l := range jobNamesToLabelsToDrop[job] {
+					if containsString(used, l) {
+						affected = append(affected, l)
+					}
+				}
+				if len(affected) == 0 {
+					continue
+				}
+				impacts = append(impacts, Impact{
+					Job:    job,
+					Labels: affected,
+					Source: ImpactDashboard,
+					Name:   dashboard.name(),
+					Group:  q.where,
+					Query:  q.query,
+					Action: d.Action,
+				})
+			}
+		}
+	}
+	return impacts, nil
+}
@@ -0,0 +1,56 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestParseGrafanaQuery(t *testing.T) {
+	for _, tc := range []struct {
+		query  string
+		labels []string
+		label  string
+	}{
+		{`sum by (path) (rate(http_requests_total{job=~"$job"}[$__rate_interval]))`, []string{"job", "path"}, ""},
+		{`sum by ($group) (up{instance=~"${instance:regex}"})`, []string{"instance"}, ""},
+		{`label_values(http_requests_total{job="api"}, user_id)`, []string{"job"}, "user_id"},
+		{`query_result(topk(5, sum by (path) (requests)))`, []string{"path"}, ""},
+	} {
+		expr, label, err := parseGrafanaQuery(tc.query)
+		assert.Nil(t, err, tc.query)
+		assert.Equal(t, tc.label, label, tc.query)
+
+		labels, selectsJob := queryLabels(expr, "api")
+		assert.Equal(t, tc.labels, labels, tc.query)
+		assert.True(t, selectsJob, tc.query)
+	}
+
+	expr, label, err := parseGrafanaQuery(`label_values(pod)`)
+	assert.Nil(t, err)
+	assert.Nil(t, expr)
+	assert.Equal(t, "pod", label)
+}
+
+func TestDashboardsImpactAnalyzer(t *testing.T) {
+	analyzer := &DashboardsImpactAnalyzer{Logger: zap.NewNop().Sugar(), Dir: "./fixtures/dashboards", Action: ImpactBlock}
+	impacts, err := analyzer.Impacts(context.Background(), map[string][]string{
+		"api":    {"path", "user_id", "task_id"},
+		"worker": {"task_id"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []Impact{
+		{Job: "api", Labels: []string{"path"}, Source: ImpactDashboard, Name: "API", Group: "panel Requests by path", Query: `sum by (path) (rate(http_requests_total{job=~"$job"}[$__rate_interval]))`, Action: ImpactBlock},
+		{Job: "worker", Labels: []string{"task_id"}, Source: ImpactDashboard, Name: "API", Group: "panel Worker tasks", Query: `sum by (task_id) (rate(tasks_total{job="worker"}[5m]))`, Action: ImpactBlock},
+		{Job: "api", Labels: []string{"user_id"}, Source: ImpactDashboard, Name: "API", Group: "variable user", Query: `label_values(http_requests_total{job="api"}, user_id)`, Action: ImpactBlock},
+		{Job: "api", Labels: []string{"user_id"}, Source: ImpactDashboard, Name: "latency", Group: "panel Slow users", Query: `sum by (user_id) (rate(latency_count[5m]))`, Action: ImpactBlock},
+	}, impacts)
+}
+
+func TestDashboardsImpactAnalyzer_missingDir(t *testing.T) {
+	analyzer := &DashboardsImpactAnalyzer{Logger: zap.NewNop().Sugar(), Dir: "./fixtures/no-such-dir", Action: ImpactWarn}
+	_, err := analyzer.Impacts(context.Background(), map[string][]string{"api": {"path"}})
+	assert.EqualError(t, err, "error listing grafana dashboards, lstat ./fixtures/no-such-dir: no such file or directory")
+}
@@ -0,0 +1,178 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	plog "github.com/go-kit/log"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/prometheus/prometheus/config"
+)
+
+// DriftPolicy decides what happens when the prometheus config file on disk
+// no longer matches the config prometheus is running.
+type DriftPolicy string
+
+const (
+	// DriftOverwrite replaces the file with the running config plus
+	// cardinanny's changes, losing the edits made to the file.
+	DriftOverwrite DriftPolicy = "overwrite"
+	// DriftRefuse leaves the file alone and fails with ErrConfigDrift. It is
+	// also what an unset policy does.
+	DriftRefuse DriftPolicy = "refuse"
+	// DriftMerge makes cardinanny's changes to the file on disk instead of
+	// to the running config, keeping both.
+	DriftMerge DriftPolicy = "merge"
+)
+
+func ParseDriftPolicy(s string) (DriftPolicy, error) {
+	switch DriftPolicy(s) {
+	case DriftOverwrite, DriftRefuse, DriftMerge:
+		return DriftPolicy(s), nil
+	}
+	return "", fmt.Errorf("unknown drift policy %s, expected %s, %s or %s", s, DriftOverwrite, DriftRefuse, DriftMerge)
+}
+
+var ErrConfigDrift = errors.New("prometheus config file differs from the running config")
+
+// ConfigDriftError is returned instead of overwriting a config file with
+// changes prometheus has not loaded.
+type ConfigDriftError struct {
+	Path string
+	Diff string
+}
+
+func (e *ConfigDriftError) Error() string {
+	return fmt.Sprintf("prometheus config file %s differs from the running config, refusing to overwrite it:\n%s", e.Path, e.Diff)
+}
+
+func (e *ConfigDriftError) Is(target error) bool {
+	return target == ErrConfigDrift
+}
+
+// loadDiskConfig loads the config file the same way the running config is
+// shown, with its paths as written and as prometheus would resolve them.
+func loadDiskConfig(configPath string) ([]byte, *config.Config, *config.Config, error) {
+	b, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	asWritten, err := config.Load(string(b), false, plog.NewNopLogger())
+	if err != nil {
+		return b, nil, nil, fmt.Errorf("error parsing prometheus config file %s, %w", configPath, err)
+	}
+
+	resolved, err := config.LoadFile(configPath, false, plog.NewNopLogger())
+	if err != nil {
+		return b, nil, nil, fmt.Errorf("error parsing prometheus config file %s, %w", configPath, err)
+	}
+	return b, asWritten, resolved, nil
+}
+
+// configMatches tells whether the running config is the config file, which
+// prometheus shows with its paths resolved or as written depending on the
+// version.
+func configMatches(running, asWritten, resolved *config.Config) bool {
+	want := running.String()
+	return asWritten.String() == want || resolved.String() == want
+}
+
+// checkDrift compares the config file with the running config and returns
+// its contents if it could be loaded. A missing or empty file has nothing to
+// lose so it never drifts.
+func (p *PromConfigRewriter) checkDrift(running *config.Config, configPath string) (string, error) {
+	b, asWritten, resolved, err := loadDiskConfig(configPath)
+	if os.IsNotExist(err) || (err == nil && len(b) == 0) {
+		p.setDriftMetric(false)
+		return "", nil
+	}
+	if err != nil {
+		p.setDriftMetric(true)
+		return "", &ConfigDriftError{Path: configPath, Diff: err.Error()}
+	}
+
+	if configMatches(running, asWritten, resolved) {
+		p.setDriftMetric(false)
+		return string(b), nil
+	}
+
+	p.setDriftMetric(true)
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(running.String()),
+		B:        difflib.SplitLines(asWritten.String()),
+		FromFile: "running",
+		ToFile:   configPath,
+		Context:  3,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(b), &ConfigDriftError{Path: configPath, Diff: diff}
+}
+
+func (p *PromConfigRewriter) setDriftMetric(drifted bool) {
+	v := 0.0
+	if drifted {
+		v = 1
+	}
+	ConfigDrift.WithLabelValues(p.Instance).Set(v)
+}
+
+// baseConfig returns the running config and the config document cardinanny's
+// changes should be made to. That is the file on disk, keeping its comments
+// and formatting, unless it is missing or overwritten because it drifted.
+func (p *PromConfigRewriter) baseConfig(ctx context.Context, configPath string) (string, string, error) {
+	running, cfgFile, err := p.getConfig(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	doc, err := p.baseDocument(running, cfgFile, configPath)
+	if err != nil {
+		return "", "", err
+	}
+	return running, doc, nil
+}
+
+// baseDocument returns the config document changes are made to, the file on
+// disk or the running config, depending on the drift policy.
+func (p *PromConfigRewriter) baseDocument(running string, cfgFile *config.Config, configPath string) (string, error) {
+	// With git the working copy is ahead of the running config until its
+	// commits are deployed, so it is never compared with it.
+	if p.Git != nil {
+		b, err := ioutil.ReadFile(configPath)
+		if os.IsNotExist(err) || (err == nil && len(b) == 0) {
+			return running, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+
+	disk, err := p.checkDrift(cfgFile, configPath)
+	if err == nil {
+		if disk == "" {
+			return running, nil
+		}
+		return disk, nil
+	}
+
+	var driftErr *ConfigDriftError
+	switch {
+	case !errors.As(err, &driftErr):
+		return "", err
+	case p.DriftPolicy == DriftOverwrite:
+		p.Logger.Warnw("prometheus config file differs from the running config, overwriting it", "path", configPath)
+		return running, nil
+	case p.DriftPolicy == DriftMerge && disk != "":
+		p.Logger.Warnw("prometheus config file differs from the running config, making changes to the file", "path", configPath)
+		return disk, nil
+	}
+
+	ConfigDriftRefused.WithLabelValues(p.Instance).Inc()
+	return "", err
+}
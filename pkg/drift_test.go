@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "cardinanny-drift")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "prometheus.yml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+const extraJob = `
+  - job_name: added-by-hand
+    static_configs:
+      - targets: ["localhost:9100"]
+`
+
+func TestPromConfigRewriter_noDrift(t *testing.T) {
+	path := writeConfigFile(t, yamlFixture(t, "./fixtures/2-scrape-jobs.yaml"))
+
+	writer := planRewriter(t, nil, runningConfig(t, "./fixtures/2-scrape-jobs.yaml"))
+	writer.Instance = "no-drift"
+	writer.DriftPolicy = DriftRefuse
+
+	plan, err := writer.Plan(context.Background(), map[string][]string{"some-job": {"somevalue"}}, nil, path)
+	assert.Nil(t, err)
+	assert.False(t, plan.Empty())
+	assert.Equal(t, 0.0, testutil.ToFloat64(ConfigDrift.WithLabelValues("no-drift")))
+}
+
+func TestPromConfigRewriter_driftRefused(t *testing.T) {
+	path := writeConfigFile(t, yamlFixture(t, "./fixtures/2-scrape-jobs.yaml")+extraJob)
+
+	writer := planRewriter(t, nil, runningConfig(t, "./fixtures/2-scrape-jobs.yaml"))
+	writer.Instance = "refused"
+	writer.DriftPolicy = DriftRefuse
+
+	_, err := writer.Plan(context.Background(), map[string][]string{"some-job": {"somevalue"}}, nil, path)
+	assert.True(t, errors.Is(err, ErrConfigDrift))
+	assert.Contains(t, err.Error(), "+- job_name: added-by-hand\n")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ConfigDrift.WithLabelValues("refused")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ConfigDriftRefused.WithLabelValues("refused")))
+
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(string(b), extraJob))
+}
+
+func TestPromConfigRewriter_driftRefusedWithoutPolicy(t *testing.T) {
+	path := writeConfigFile(t, yamlFixture(t, "./fixtures/2-scrape-jobs.yaml")+extraJob)
+
+	writer := planRewriter(t, nil, runningConfig(t, "./fixtures/2-scrape-jobs.yaml"))
+	writer.Instance = "unset"
+
+	_, err := writer.Plan(context.Background(), map[string][]string{"some-job": {"somevalue"}}, nil, path)
+	assert.True(t, errors.Is(err, ErrConfigDrift))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ConfigDriftRefused.WithLabelValues("unset")))
+
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(string(b), extraJob))
+}
+
+func TestPromConfigRewriter_driftMerged(t *testing.T) {
+	path := writeConfigFile(t, yamlFixture(t, "./fixtures/2-scrape-jobs.yaml")+extraJob)
+
+	writer := planRewriter(t, nil, runningConfig(t, "./fixtures/2-scrape-jobs.yaml"))
+	writer.Instance = "merged"
+	writer.DriftPolicy = DriftMerge
+
+	plan, err := writer.Plan(context.Background(), map[string][]string{"some-job": {"somevalue"}}, nil, path)
+	assert.Nil(t, err)
+	assert.Equal(t, []JobPlan{{Job: "some-job", Added: []string{"somevalue"}}}, plan.Jobs)
+	assert.Contains(t, plan.Config, "job_name: added-by-hand")
+	assert.Contains(t, plan.Config, "regex: somevalue")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ConfigDrift.WithLabelValues("merged")))
+}
+
+func TestPromConfigRewriter_relativeRuleFilesAreNotDrift(t *testing.T) {
+	path := writeConfigFile(t, "rule_files:\n- rules/*.yml\n"+yamlFixture(t, "./fixtures/2-scrape-jobs.yaml"))
+
+	running := strings.Replace(runningConfig(t, "./fixtures/2-scrape-jobs.yaml"), "scrape_configs:", "rule_files:\n- "+filepath.Join(filepath.Dir(path), "rules/*.yml")+"\nscrape_configs:", 1)
+
+	writer := planRewriter(t, nil, running)
+	writer.Instance = "rule-files"
+	writer.DriftPolicy = DriftRefuse
+
+	_, err := writer.Plan(context.Background(), map[string][]string{"some-job": {"somevalue"}}, nil, path)
+	assert.Nil(t, err)
+}
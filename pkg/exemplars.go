@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"go.uber.org/zap"
+)
+
+// exemplarsQuery selects the exemplars of every series.
+const exemplarsQuery = `{__name__=~".+"}`
+
+// ExemplarLabel is the number of values of a label of exemplars, such as
+// trace_id, overall and by job. Exemplar labels are not series labels so they
+// don't add series and are only reported.
+type ExemplarLabel struct {
+	Name       string            `json:"name"`
+	ValueCount uint64            `json:"valueCount"`
+	Jobs       map[string]uint64 `json:"jobs,omitempty"`
+}
+
+// ExemplarScanner counts the values of the exemplar labels stored over the
+// last Lookback.
+type ExemplarScanner struct {
+	Logger   *zap.SugaredLogger
+	PromAPI  v1.API
+	Lookback time.Duration
+
+	mu   sync.Mutex
+	last []ExemplarLabel
+}
+
+func (e *ExemplarScanner) Scan(ctx context.Context, now time.Time) ([]ExemplarLabel, error) {
+	results, err := e.PromAPI.QueryExemplars(ctx, exemplarsQuery, now.Add(-e.Lookback), now)
+	if err != nil {
+		return nil, fmt.Errorf("error querying exemplars from the promtheus API, %w", err)
+	}
+
+	values := map[string]map[string]bool{}
+	jobValues := map[string]map[string]map[string]bool{}
+	for _, r := range results {
+		job := string(r.SeriesLabels["job"])
+		for _, ex := range r.Exemplars {
+			for name, value := range ex.Labels {
+				l := string(name)
+				if values[l] == nil {
+					values[l] = map[string]bool{}
+					jobValues[l] = map[string]map[string]bool{}
+				}
+				if jobValues[l][job] == nil {
+					jobValues[l][job] = map[string]bool{}
+				}
+				values[l][string(value)] = true
+				jobValues[l][job][string(value)] = true
+			}
+		}
+	}
+
+	var labels []ExemplarLabel
+	for name, v := range values {
+		l := ExemplarLabel{Name: name, ValueCount: uint64(len(v)), Jobs: map[string]uint64{}}
+		for job, jv := range jobValues[name] {
+			l.Jobs[job] = uint64(len(jv))
+		}
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].ValueCount != labels[j].ValueCount {
+			return labels[i].ValueCount > labels[j].ValueCount
+		}
+		return labels[i].Name < labels[j].Name
+	})
+
+	for _, l := range labels {
+		e.Logger.Debugw("exemplar label cardinality", "label", l.Name, "values", l.ValueCount, "jobs", l.Jobs)
+	}
+
+	e.mu.Lock()
+	e.last = labels
+	e.mu.Unlock()
+	return labels, nil
+}
+
+// Last returns the exemplar labels found by the last scan.
+func (e *ExemplarScanner) Last() []ExemplarLabel {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.last
+}
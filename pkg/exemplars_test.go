@@ -0,0 +1,46 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mclarke47/cardinanny/mock_v1"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestExemplarScanner(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := mock_v1.NewMockAPI(ctrl)
+
+	now := time.Date(2021, 8, 2, 12, 0, 0, 0, time.UTC)
+	m.EXPECT().QueryExemplars(gomock.Any(), `{__name__=~".+"}`, now.Add(-time.Hour), now).Return([]v1.ExemplarQueryResult{
+		{
+			SeriesLabels: model.LabelSet{"__name__": "latency_bucket", "job": "api"},
+			Exemplars: []v1.Exemplar{
+				{Labels: model.LabelSet{"trace_id": "a", "span_id": "1"}},
+				{Labels: model.LabelSet{"trace_id": "b", "span_id": "1"}},
+			},
+		},
+		{
+			SeriesLabels: model.LabelSet{"__name__": "tasks_total", "job": "worker"},
+			Exemplars: []v1.Exemplar{
+				{Labels: model.LabelSet{"trace_id": "b"}},
+				{Labels: model.LabelSet{"trace_id": "c"}},
+			},
+		},
+	}, nil)
+
+	scanner := &ExemplarScanner{Logger: zap.NewNop().Sugar(), PromAPI: m, Lookback: time.Hour}
+	labels, err := scanner.Scan(context.Background(), now)
+	assert.Nil(t, err)
+	assert.Equal(t, []ExemplarLabel{
+		{Name: "trace_id", ValueCount: 3, Jobs: map[string]uint64{"api": 2, "worker": 2}},
+		{Name: "span_id", ValueCount: 1, Jobs: map[string]uint64{"api": 1}},
+	}, labels)
+	assert.Equal(t, labels, scanner.Last())
+}
@@ -0,0 +1,339 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// ErrChangeProposed is returned when a change was committed or pushed to git
+// for review rather than applied.
+var ErrChangeProposed = errors.New("the config change was proposed in git and is applied once deployed")
+
+// MergeRequest describes a change pushed to a branch that should be reviewed
+// before it is merged into the branch Prometheus is deployed from.
+type MergeRequest struct {
+	SourceBranch string
+	TargetBranch string
+	Title        string
+	Description  string
+}
+
+// Forge opens merge/pull requests on a git hosting service.
+type Forge interface {
+	OpenMergeRequest(ctx context.Context, mr MergeRequest) (string, error)
+}
+
+// GitConfigRepo commits generated config changes to a local git working copy
+// instead of letting them be applied to the running Prometheus straight away.
+type GitConfigRepo struct {
+	Logger      *zap.SugaredLogger
+	Dir         string
+	Remote      string
+	BaseBranch  string
+	PushBranch  bool
+	Forge       Forge
+	AuthorName  string
+	AuthorEmail string
+}
+
+func (g *GitConfigRepo) git(ctx context.Context, args ...string) (string, error) {
+	name := g.AuthorName
+	if name == "" {
+		name = "cardinanny"
+	}
+	email := g.AuthorEmail
+	if email == "" {
+		email = "cardinanny@localhost"
+	}
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = g.Dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME="+name,
+		"GIT_AUTHOR_EMAIL="+email,
+		"GIT_COMMITTER_NAME="+name,
+		"GIT_COMMITTER_EMAIL="+email,
+	)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error running git %s, %w: %s", strings.Join(args, " "), err, strings.TrimSpace(out.String()))
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+func sortedJobs(jobNamesToLabelsToDrop map[string][]string) []string {
+	var jobs []string
+	for k := range jobNamesToLabelsToDrop {
+		jobs = append(jobs, k)
+	}
+	sort.Strings(jobs)
+	return jobs
+}
+
+// ConfigChange is what a config rewrite did, for commit messages.
+type ConfigChange struct {
+	Action string
+	Jobs   map[string][]string
+}
+
+func DropChange(jobNamesToLabelsToDrop map[string][]string) ConfigChange {
+	return ConfigChange{Action: "drop", Jobs: jobNamesToLabelsToDrop}
+}
+
+func RestoreChange(job string, labels []string) ConfigChange {
+	return ConfigChange{Action: "restore", Jobs: map[string][]string{job: labels}}
+}
+
+func commitMessage(change ConfigChange) (string, string) {
+	jobs := sortedJobs(change.Jobs)
+
+	labelCount := 0
+	var body strings.Builder
+	for _, j := range jobs {
+		labels := change.Jobs[j]
+		labelCount += len(labels)
+		fmt.Fprintf(&body, "%s: %s %s (%d label(s))\n", j, change.Action, strings.Join(labels, ", "), len(labels))
+	}
+
+	title := fmt.Sprintf("cardinanny: %s %d high cardinality label(s) in %d job(s)", change.Action, labelCount, len(jobs))
+	return title, body.String()
+}
+
+// branchName is derived from the change itself so the same finding is only
+// ever proposed once.
+func branchName(change ConfigChange) string {
+	h := sha256.New()
+	for _, j := range sortedJobs(change.Jobs) {
+		labels := append([]string{}, change.Jobs[j]...)
+		sort.Strings(labels)
+		fmt.Fprintf(h, "%s:%s;", j, strings.Join(labels, ","))
+	}
+	return fmt.Sprintf("cardinanny/%s-labels-%s", change.Action, hex.EncodeToString(h.Sum(nil))[:12])
+}
+
+func (g *GitConfigRepo) remote() string {
+	if g.Remote == "" {
+		return "origin"
+	}
+	return g.Remote
+}
+
+// Proposed tells whether a change was pushed to a branch for review which is
+// still on the remote. Once its merge request is merged or closed and the
+// branch deleted, the local branch is deleted too and the base branch is
+// pulled, so a merged change is in the working copy.
+func (g *GitConfigRepo) Proposed(ctx context.Context, change ConfigChange) bool {
+	if !g.PushBranch {
+		return false
+	}
+	branch := branchName(change)
+	_, localErr := g.git(ctx, "rev-parse", "--verify", "--quiet", "refs/heads/"+branch)
+
+	out, err := g.git(ctx, "ls-remote", "--heads", g.remote(), branch)
+	if err != nil {
+		// the change isn't proposed twice while the remote can't be reached
+		g.Logger.Warnw("unable to list the remote branches, relying on the local ones", "remote", g.remote(), "error", err)
+		return localErr == nil
+	}
+	if out != "" {
+		return true
+	}
+	if localErr != nil {
+		return false
+	}
+
+	g.Logger.Infow("proposal branch is gone from the remote, forgetting it", "branch", branch)
+	if _, err := g.git(ctx, "branch", "-D", branch); err != nil {
+		g.Logger.Warnw("unable to delete the proposal branch", "branch", branch, "error", err)
+	}
+	if _, err := g.git(ctx, "pull", "--ff-only", g.remote(), g.BaseBranch); err != nil {
+		g.Logger.Warnw("unable to pull the base branch", "branch", g.BaseBranch, "error", err)
+	}
+	return false
+}
+
+func (g *GitConfigRepo) CommitConfigChange(ctx context.Context, configPath string, change ConfigChange) (err error) {
+	title, body := commitMessage(change)
+
+	rel, err := filepath.Rel(g.Dir, configPath)
+	if err == nil && (rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+		err = fmt.Errorf("the path leaves the repository")
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s is not inside the git repository at %s, %w", configPath, g.Dir, err)
+	}
+
+	if !g.PushBranch {
+		if _, err := g.git(ctx, "add", rel); err != nil {
+			return err
+		}
+		if _, err := g.git(ctx, "commit", "-m", title, "-m", body); err != nil {
+			return err
+		}
+		g.Logger.Infow("config change committed", "repo", g.Dir, "title", title)
+		return nil
+	}
+
+	branch := branchName(change)
+
+	if g.Proposed(ctx, change) {
+		g.Logger.Infow("config change already proposed, skipping", "branch", branch)
+		_, err = g.git(ctx, "checkout", "--", rel)
+		return err
+	}
+
+	if _, err := g.git(ctx, "checkout", "-b", branch); err != nil {
+		return err
+	}
+	// whatever happens the working copy goes back to the base branch, and a
+	// branch that was not pushed is deleted so it doesn't look proposed and
+	// the change is tried again on the next cycle
+	pushed := false
+	defer func() {
+		if _, checkoutErr := g.git(ctx, "checkout", g.BaseBranch); checkoutErr != nil && err == nil {
+			err = checkoutErr
+		}
+		if pushed {
+			return
+		}
+		if _, resetErr := g.git(ctx, "checkout", "HEAD", "--", rel); resetErr != nil {
+			g.Logger.Warnw("unable to discard the config change", "path", rel, "error", resetErr)
+		}
+		if _, deleteErr := g.git(ctx, "branch", "-D", branch); deleteErr != nil {
+			g.Logger.Warnw("unable to delete the proposal branch", "branch", branch, "error", deleteErr)
+		}
+	}()
+
+	if _, err := g.git(ctx, "add", rel); err != nil {
+		return err
+	}
+	if _, err := g.git(ctx, "commit", "-m", title, "-m", body); err != nil {
+		return err
+	}
+
+	remote := g.remote()
+	if _, err := g.git(ctx, "push", remote, branch); err != nil {
+		return err
+	}
+	pushed = true
+
+	g.Logger.Infow("config change pushed", "remote", remote, "branch", branch)
+
+	if g.Forge == nil {
+		return nil
+	}
+
+	link, err := g.Forge.OpenMergeRequest(ctx, MergeRequest{
+		SourceBranch: branch,
+		TargetBranch: g.BaseBranch,
+		Title:        title,
+		Description:  body,
+	})
+	if err != nil {
+		return fmt.Errorf("error opening merge request for branch %s, %w", branch, err)
+	}
+
+	g.Logger.Infow("merge request opened", "url", link)
+	return nil
+}
+
+// GitLabForge opens merge requests through the GitLab v4 API.
+type GitLabForge struct {
+	HTTPClient *http.Client
+	BaseURL    string
+	Project    string
+	Token      string
+}
+
+func (f *GitLabForge) OpenMergeRequest(ctx context.Context, mr MergeRequest) (string, error) {
+	u := fmt.Sprintf("%s/api/v4/projects/%s/merge_requests", f.BaseURL, url.PathEscape(f.Project))
+
+	var result struct {
+		WebURL string `json:"web_url"`
+	}
+	err := postJSON(ctx, f.HTTPClient, u, map[string]string{"PRIVATE-TOKEN": f.Token}, map[string]string{
+		"source_branch": mr.SourceBranch,
+		"target_branch": mr.TargetBranch,
+		"title":         mr.Title,
+		"description":   mr.Description,
+	}, &result)
+	return result.WebURL, err
+}
+
+// GitHubForge opens pull requests through the GitHub REST API.
+type GitHubForge struct {
+	HTTPClient *http.Client
+	BaseURL    string
+	Repository string
+	Token      string
+}
+
+func (f *GitHubForge) OpenMergeRequest(ctx context.Context, mr MergeRequest) (string, error) {
+	u := fmt.Sprintf("%s/repos/%s/pulls", f.BaseURL, f.Repository)
+
+	var result struct {
+		HTMLURL string `json:"html_url"`
+	}
+	err := postJSON(ctx, f.HTTPClient, u, map[string]string{"Authorization": "token " + f.Token}, map[string]string{
+		"head":  mr.SourceBranch,
+		"base":  mr.TargetBranch,
+		"title": mr.Title,
+		"body":  mr.Description,
+	}, &result)
+	return result.HTMLURL, err
+}
+
+func postJSON(ctx context.Context, client *http.Client, u string, headers map[string]string, body interface{}, result interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("expected a 2xx status code from %s but was %d, body: %s", u, resp.StatusCode, respBody)
+	}
+
+	return json.Unmarshal(respBody, result)
+}
@@ -0,0 +1,252 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mclarke47/cardinanny/mock_v1"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test",
+		"GIT_AUTHOR_EMAIL=test@localhost",
+		"GIT_COMMITTER_NAME=test",
+		"GIT_COMMITTER_EMAIL=test@localhost",
+	)
+	out, err := cmd.CombinedOutput()
+	assert.Nil(t, err, string(out))
+	return string(out)
+}
+
+// setupGitRepo creates a bare "remote" and a working copy of it on the main
+// branch with the given fixture committed as prometheus.yml.
+func setupGitRepo(t *testing.T, fixture string) (string, string) {
+	root, err := ioutil.TempDir("", "cardinanny-git")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	bare := filepath.Join(root, "remote.git")
+	work := filepath.Join(root, "work")
+
+	runGit(t, root, "init", "--bare", bare)
+	runGit(t, root, "clone", bare, work)
+	runGit(t, work, "checkout", "-b", "main")
+
+	err = ioutil.WriteFile(filepath.Join(work, "prometheus.yml"), []byte(yamlFixture(t, fixture)), 0644)
+	assert.Nil(t, err)
+
+	runGit(t, work, "add", "prometheus.yml")
+	runGit(t, work, "commit", "-m", "initial config")
+	runGit(t, work, "push", "origin", "main")
+
+	return bare, work
+}
+
+func gitRewriter(t *testing.T, repo *GitConfigRepo) PromConfigRewriter {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	m.
+		EXPECT().
+		Config(gomock.Any()).
+		Return(v1.ConfigResult{
+			YAML: yamlFixture(t, "./fixtures/2-scrape-jobs.yaml"),
+		}, nil).
+		AnyTimes()
+
+	repo.Logger = zap.NewNop().Sugar()
+
+	return PromConfigRewriter{
+		PromAPI: m,
+		Logger:  zap.NewNop().Sugar(),
+		Git:     repo,
+	}
+}
+
+func TestGitConfigRepo_commitsLocally(t *testing.T) {
+	_, work := setupGitRepo(t, "./fixtures/2-scrape-jobs.yaml")
+
+	writer := gitRewriter(t, &GitConfigRepo{Dir: work, BaseBranch: "main"})
+
+	err := writer.DropLabelsInJobs(context.Background(), map[string][]string{
+		"some-job": {"somevalue"},
+	}, filepath.Join(work, "prometheus.yml"))
+	assert.Nil(t, err)
+
+	log := runGit(t, work, "log", "-1", "--format=%s%n%b")
+	assert.Equal(t, "cardinanny: drop 1 high cardinality label(s) in 1 job(s)\nsome-job: drop somevalue (1 label(s))\n\n", log)
+
+	f, err := os.Open(filepath.Join(work, "prometheus.yml"))
+	assert.Nil(t, err)
+	defer f.Close()
+	assertConfigFilesAreEqual(t, "./fixtures/2-scrape-jobs-expected-1-label.yaml", f)
+}
+
+func TestGitConfigRepo_commitsLocallyOverSeveralCycles(t *testing.T) {
+	_, work := setupGitRepo(t, "./fixtures/2-scrape-jobs.yaml")
+
+	// prometheus keeps running the initial config as the commits aren't
+	// deployed, which must not be taken for drift
+	writer := gitRewriter(t, &GitConfigRepo{Dir: work, BaseBranch: "main"})
+	configPath := filepath.Join(work, "prometheus.yml")
+
+	err := writer.DropLabelsInJobs(context.Background(), map[string][]string{"some-job": {"somevalue"}}, configPath)
+	assert.Nil(t, err)
+
+	err = writer.DropLabelsInJobs(context.Background(), map[string][]string{"some-job": {"anotherBadLabel"}}, configPath)
+	assert.Nil(t, err)
+
+	log := runGit(t, work, "log", "-2", "--format=%s")
+	assert.Equal(t, "cardinanny: drop 1 high cardinality label(s) in 1 job(s)\ncardinanny: drop 1 high cardinality label(s) in 1 job(s)\n", log)
+
+	f, err := os.Open(configPath)
+	assert.Nil(t, err)
+	defer f.Close()
+	assertConfigFilesAreEqual(t, "./fixtures/2-scrape-jobs-expected-2-label.yaml", f)
+}
+
+func TestGitConfigRepo_pushesBranchAndOpensMergeRequest(t *testing.T) {
+	bare, work := setupGitRepo(t, "./fixtures/2-scrape-jobs.yaml")
+
+	var requests []map[string]string
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v4/projects/infra%2Fprometheus/merge_requests", r.URL.EscapedPath())
+		assert.Equal(t, "some-token", r.Header.Get("PRIVATE-TOKEN"))
+
+		var body map[string]string
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		requests = append(requests, body)
+
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write([]byte(`{"web_url": "https://gitlab.example.com/mr/1"}`))
+	}))
+	defer ts.Close()
+
+	writer := gitRewriter(t, &GitConfigRepo{
+		Dir:        work,
+		BaseBranch: "main",
+		PushBranch: true,
+		Forge: &GitLabForge{
+			HTTPClient: ts.Client(),
+			BaseURL:    ts.URL,
+			Project:    "infra/prometheus",
+			Token:      "some-token",
+		},
+	})
+
+	jobsToLabels := map[string][]string{
+		"some-job":       {"anotherBadLabel"},
+		"some-other-job": {"somevalue"},
+	}
+
+	err := writer.DropLabelsInJobs(context.Background(), jobsToLabels, filepath.Join(work, "prometheus.yml"))
+	assert.Nil(t, err)
+
+	branch := branchName(DropChange(jobsToLabels))
+	assert.Contains(t, runGit(t, bare, "branch", "--list"), branch)
+
+	assert.Equal(t, "main\n", runGit(t, work, "rev-parse", "--abbrev-ref", "HEAD"))
+	assert.Equal(t, "", runGit(t, work, "status", "--porcelain"))
+
+	assert.Equal(t, []map[string]string{
+		{
+			"source_branch": branch,
+			"target_branch": "main",
+			"title":         "cardinanny: drop 2 high cardinality label(s) in 2 job(s)",
+			"description":   "some-job: drop anotherBadLabel (1 label(s))\nsome-other-job: drop somevalue (1 label(s))\n",
+		},
+	}, requests)
+
+	// the same finding on a later cycle must not open a second merge request
+	err = writer.DropLabelsInJobs(context.Background(), jobsToLabels, filepath.Join(work, "prometheus.yml"))
+	assert.Nil(t, err)
+	assert.Len(t, requests, 1)
+	assert.Equal(t, "", runGit(t, work, "status", "--porcelain"))
+}
+
+func TestGitConfigRepo_forgetsBranchesGoneFromTheRemote(t *testing.T) {
+	bare, work := setupGitRepo(t, "./fixtures/2-scrape-jobs.yaml")
+
+	writer := gitRewriter(t, &GitConfigRepo{Dir: work, BaseBranch: "main", PushBranch: true})
+
+	jobsToLabels := map[string][]string{"some-job": {"somevalue"}}
+	err := writer.DropLabelsInJobs(context.Background(), jobsToLabels, filepath.Join(work, "prometheus.yml"))
+	assert.Nil(t, err)
+
+	change := DropChange(jobsToLabels)
+	branch := branchName(change)
+	assert.True(t, writer.Git.Proposed(context.Background(), change))
+
+	// the merge request is merged and its branch deleted
+	runGit(t, bare, "update-ref", "refs/heads/main", "refs/heads/"+branch)
+	runGit(t, bare, "branch", "-D", branch)
+
+	assert.False(t, writer.Git.Proposed(context.Background(), change))
+	assert.Equal(t, "", runGit(t, work, "branch", "--list", branch))
+
+	f, err := os.Open(filepath.Join(work, "prometheus.yml"))
+	assert.Nil(t, err)
+	defer f.Close()
+	assertConfigFilesAreEqual(t, "./fixtures/2-scrape-jobs-expected-1-label.yaml", f)
+}
+
+func TestGitConfigRepo_failedPushRestoresBaseBranch(t *testing.T) {
+	_, work := setupGitRepo(t, "./fixtures/2-scrape-jobs.yaml")
+
+	writer := gitRewriter(t, &GitConfigRepo{Dir: work, Remote: "missing", BaseBranch: "main", PushBranch: true})
+
+	jobsToLabels := map[string][]string{"some-job": {"somevalue"}}
+	err := writer.DropLabelsInJobs(context.Background(), jobsToLabels, filepath.Join(work, "prometheus.yml"))
+	assert.NotNil(t, err)
+
+	assert.Equal(t, "main\n", runGit(t, work, "rev-parse", "--abbrev-ref", "HEAD"))
+	assert.Equal(t, "", runGit(t, work, "status", "--porcelain"))
+	assert.Equal(t, "", runGit(t, work, "branch", "--list", branchName(DropChange(jobsToLabels))))
+	assert.False(t, writer.Git.Proposed(context.Background(), DropChange(jobsToLabels)))
+}
+
+func TestGitConfigRepo_configOutsideRepoIsRejected(t *testing.T) {
+	_, work := setupGitRepo(t, "./fixtures/2-scrape-jobs.yaml")
+
+	repo := &GitConfigRepo{Logger: zap.NewNop().Sugar(), Dir: work, BaseBranch: "main"}
+	err := repo.CommitConfigChange(context.Background(), filepath.Join(filepath.Dir(work), "prometheus.yml"), DropChange(map[string][]string{"some-job": {"somevalue"}}))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "is not inside the git repository")
+}
+
+func TestGitHubForge_openMergeRequestReturnsError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/repos/infra/prometheus/pulls", r.URL.Path)
+		assert.Equal(t, "token some-token", r.Header.Get("Authorization"))
+
+		rw.WriteHeader(http.StatusUnprocessableEntity)
+		rw.Write([]byte("Validation Failed"))
+	}))
+	defer ts.Close()
+
+	forge := GitHubForge{
+		HTTPClient: ts.Client(),
+		BaseURL:    ts.URL,
+		Repository: "infra/prometheus",
+		Token:      "some-token",
+	}
+
+	_, err := forge.OpenMergeRequest(context.Background(), MergeRequest{SourceBranch: "a", TargetBranch: "main"})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "expected a 2xx status code from "+ts.URL+"/repos/infra/prometheus/pulls but was 422, body: Validation Failed", err.Error())
+}
@@ -0,0 +1,195 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+)
+
+// SeriesContribution estimates how many head series would go away if a label
+// was dropped. The series of its biggest value stay apart once it is dropped,
+// so a label with N values on S series collapses them to no fewer than S/N or
+// the share of the biggest value. A label with a few values spread over most
+// series, like job or instance, reclaims next to nothing.
+type SeriesContribution struct {
+	Label       string
+	ValueCount  uint64
+	Series      uint64
+	Reclaimable uint64
+}
+
+// HeadSeriesBudget picks the labels to drop when the number of head series is
+// over Budget, biggest contributors first, until the budget is respected.
+type HeadSeriesBudget struct {
+	Logger  *zap.SugaredLogger
+	PromAPI v1.API
+	Budget  uint64
+	// Protected labels are never dropped, on top of job, instance and the
+	// histogram labels.
+	Protected []string
+
+	mu   sync.Mutex
+	last []string
+}
+
+// The client's TSDBResult doesn't carry the head stats, so the head series
+// count comes from Prometheus' own metric, or counting every series if
+// Prometheus doesn't scrape itself.
+const (
+	headSeriesQuery         = "sum(prometheus_tsdb_head_series)"
+	headSeriesFallbackQuery = "count({__name__=~\".+\"})"
+)
+
+func seriesWithLabelQuery(labelName string) string {
+	return fmt.Sprintf("count({%s=~\".+\"})", labelName)
+}
+
+func biggestValueSeriesQuery(labelName string) string {
+	return fmt.Sprintf("max(count by (%s) ({%s=~\".+\"}))", labelName, labelName)
+}
+
+func (b *HeadSeriesBudget) queryScalar(ctx context.Context, q string, now time.Time) (uint64, bool, error) {
+	r, _, err := b.PromAPI.Query(ctx, q, now)
+	if err != nil {
+		return 0, false, fmt.Errorf("error querying the promtheus API, %w", err)
+	}
+	vec, ok := r.(model.Vector)
+	if !ok || len(vec) == 0 {
+		return 0, false, nil
+	}
+	return uint64(vec[0].Value), true, nil
+}
+
+func (b *HeadSeriesBudget) headSeries(ctx context.Context, now time.Time) (uint64, error) {
+	n, ok, err := b.queryScalar(ctx, headSeriesQuery, now)
+	if err != nil || ok {
+		return n, err
+	}
+	n, _, err = b.queryScalar(ctx, headSeriesFallbackQuery, now)
+	return n, err
+}
+
+// Contributions estimates the series contribution of every label in the TSDB
+// stats but the protected ones. The number of series carrying a label and
+// carrying its biggest value are queried, falling back to the label value
+// pairs of the stats.
+func (b *HeadSeriesBudget) Contributions(ctx context.Context, stats v1.TSDBResult, now time.Time) ([]SeriesContribution, error) {
+	pairSeries := map[string]uint64{}
+	biggestPair := map[string]uint64{}
+	for _, p := range stats.SeriesCountByLabelValuePair {
+		name := strings.SplitN(p.Name, "=", 2)[0]
+		pairSeries[name] += p.Value
+		if p.Value > biggestPair[name] {
+			biggestPair[name] = p.Value
+		}
+	}
+
+	var contributions []SeriesContribution
+	for _, lv := range stats.LabelValueCountByLabelName {
+		if lv.Name == model.MetricNameLabel || isProtectedLabel(b.Protected, lv.Name) || lv.Value == 0 {
+			continue
+		}
+
+		series, ok, err := b.queryScalar(ctx, seriesWithLabelQuery(lv.Name), now)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			series = pairSeries[lv.Name]
+		}
+
+		biggest, ok, err := b.queryScalar(ctx, biggestValueSeriesQuery(lv.Name), now)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			biggest = biggestPair[lv.Name]
+		}
+
+		remaining := series / lv.Value
+		if biggest > remaining {
+			remaining = biggest
+		}
+		if remaining > series {
+			remaining = series
+		}
+
+		contributions = append(contributions, SeriesContribution{
+			Label:       lv.Name,
+			ValueCount:  lv.Value,
+			Series:      series,
+			Reclaimable: series - remaining,
+		})
+	}
+
+	sort.SliceStable(contributions, func(i, j int) bool {
+		return contributions[i].Reclaimable > contributions[j].Reclaimable
+	})
+	return contributions, nil
+}
+
+// OverBudget returns the labels to drop, biggest contributor first, or nothing
+// when the head series are within budget.
+func (b *HeadSeriesBudget) OverBudget(ctx context.Context, stats v1.TSDBResult) ([]string, error) {
+	now := time.Now()
+
+	head, err := b.headSeries(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if head <= b.Budget {
+		b.setLast(nil)
+		return nil, nil
+	}
+
+	b.Logger.Infow("head series over budget", "headSeries", head, "budget", b.Budget, "topMetrics", stats.SeriesCountByMetricName)
+
+	contributions, err := b.Contributions(ctx, stats, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var labels []string
+	remaining := head
+	for _, c := range contributions {
+		if remaining <= b.Budget || c.Reclaimable == 0 {
+			break
+		}
+		labels = append(labels, c.Label)
+		if c.Reclaimable > remaining {
+			remaining = 0
+		} else {
+			remaining -= c.Reclaimable
+		}
+
+		b.Logger.Infow("dropping label to get back within the head series budget", "label", c.Label, "series", c.Series, "values", c.ValueCount, "reclaimable", c.Reclaimable, "projectedHeadSeries", remaining)
+	}
+
+	if remaining > b.Budget {
+		b.Logger.Warnw("dropping every known label won't get back within the head series budget", "projectedHeadSeries", remaining, "budget", b.Budget)
+	}
+	b.setLast(labels)
+	return labels, nil
+}
+
+func (b *HeadSeriesBudget) setLast(labels []string) {
+	b.mu.Lock()
+	b.last = labels
+	b.mu.Unlock()
+}
+
+// Last returns the labels the last check found over budget, biggest
+// contributor first.
+func (b *HeadSeriesBudget) Last() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.last
+}
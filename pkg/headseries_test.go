@@ -0,0 +1,169 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mclarke47/cardinanny/mock_v1"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func expectScalarQuery(m *mock_v1.MockAPI, q string, v float64) {
+	m.
+		EXPECT().
+		Query(gomock.Any(), gomock.Eq(q), gomock.Any()).
+		Return(model.Vector{{Value: model.SampleValue(v)}}, nil, nil)
+}
+
+var headSeriesStats = v1.TSDBResult{
+	SeriesCountByMetricName: []v1.Stat{{Name: "http_requests_total", Value: 90000}},
+	LabelValueCountByLabelName: []v1.Stat{
+		{Name: "__name__", Value: 300},
+		{Name: "path", Value: 5000},
+		{Name: "user_id", Value: 20000},
+		{Name: "pod", Value: 10},
+	},
+	SeriesCountByLabelValuePair: []v1.Stat{
+		{Name: "pod=a", Value: 6000},
+		{Name: "pod=b", Value: 4000},
+	},
+}
+
+func Test_HeadSeriesBudget_withinBudget(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	expectScalarQuery(m, "sum(prometheus_tsdb_head_series)", 50000)
+
+	b := HeadSeriesBudget{Logger: zap.NewNop().Sugar(), PromAPI: m, Budget: 100000}
+
+	labels, err := b.OverBudget(context.Background(), headSeriesStats)
+	assert.Nil(t, err)
+	assert.Nil(t, labels)
+}
+
+func Test_HeadSeriesBudget_dropsBiggestContributorsUntilWithinBudget(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	expectScalarQuery(m, "count({path=~\".+\"})", 100000)
+	expectScalarQuery(m, "max(count by (path) ({path=~\".+\"}))", 2000)
+	expectScalarQuery(m, "count({user_id=~\".+\"})", 60000)
+	expectScalarQuery(m, "max(count by (user_id) ({user_id=~\".+\"}))", 2)
+	for _, q := range []string{"count({pod=~\".+\"})", "max(count by (pod) ({pod=~\".+\"}))"} {
+		m.
+			EXPECT().
+			Query(gomock.Any(), gomock.Eq(q), gomock.Any()).
+			Return(model.Vector{}, nil, nil)
+	}
+
+	b := HeadSeriesBudget{Logger: zap.NewNop().Sugar(), PromAPI: m, Budget: 120000}
+
+	contributions, err := b.Contributions(context.Background(), headSeriesStats, trendStart)
+	assert.Nil(t, err)
+	assert.Equal(t, []SeriesContribution{
+		{Label: "path", ValueCount: 5000, Series: 100000, Reclaimable: 98000},
+		{Label: "user_id", ValueCount: 20000, Series: 60000, Reclaimable: 59997},
+		{Label: "pod", ValueCount: 10, Series: 10000, Reclaimable: 4000},
+	}, contributions)
+
+	expectScalarQuery(m, "sum(prometheus_tsdb_head_series)", 200000)
+	expectScalarQuery(m, "count({path=~\".+\"})", 100000)
+	expectScalarQuery(m, "max(count by (path) ({path=~\".+\"}))", 2000)
+	expectScalarQuery(m, "count({user_id=~\".+\"})", 60000)
+	expectScalarQuery(m, "max(count by (user_id) ({user_id=~\".+\"}))", 2)
+	expectScalarQuery(m, "count({pod=~\".+\"})", 10000)
+	expectScalarQuery(m, "max(count by (pod) ({pod=~\".+\"}))", 6000)
+
+	labels, err := b.OverBudget(context.Background(), headSeriesStats)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"path"}, labels)
+}
+
+func Test_HeadSeriesBudget_leavesProtectedAndWidespreadLabelsAlone(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	expectScalarQuery(m, "count({method=~\".+\"})", 95000)
+	expectScalarQuery(m, "max(count by (method) ({method=~\".+\"}))", 80000)
+	expectScalarQuery(m, "count({session=~\".+\"})", 30000)
+	expectScalarQuery(m, "max(count by (session) ({session=~\".+\"}))", 3)
+
+	b := HeadSeriesBudget{Logger: zap.NewNop().Sugar(), PromAPI: m, Budget: 50000, Protected: []string{"tenant"}}
+
+	contributions, err := b.Contributions(context.Background(), v1.TSDBResult{
+		LabelValueCountByLabelName: []v1.Stat{
+			{Name: "job", Value: 20},
+			{Name: "instance", Value: 400},
+			{Name: "tenant", Value: 50},
+			{Name: "method", Value: 5},
+			{Name: "session", Value: 15000},
+		},
+	}, trendStart)
+	assert.Nil(t, err)
+	assert.Equal(t, []SeriesContribution{
+		{Label: "session", ValueCount: 15000, Series: 30000, Reclaimable: 29997},
+		{Label: "method", ValueCount: 5, Series: 95000, Reclaimable: 15000},
+	}, contributions)
+}
+
+func Test_HeadSeriesBudget_fallsBackToCountingSeries(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	m.
+		EXPECT().
+		Query(gomock.Any(), gomock.Eq("sum(prometheus_tsdb_head_series)"), gomock.Any()).
+		Return(model.Vector{}, nil, nil)
+	expectScalarQuery(m, "count({__name__=~\".+\"})", 10)
+
+	b := HeadSeriesBudget{Logger: zap.NewNop().Sugar(), PromAPI: m, Budget: 100}
+
+	labels, err := b.OverBudget(context.Background(), headSeriesStats)
+	assert.Nil(t, err)
+	assert.Nil(t, labels)
+}
+
+func Test_CardinalityScanner_scanPrioritisesHeadSeriesBudget(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	m.
+		EXPECT().
+		TSDB(gomock.Any()).
+		Return(v1.TSDBResult{
+			LabelValueCountByLabelName: []v1.Stat{
+				{Name: "v1", Value: 100},
+				{Name: "v2", Value: 40},
+			},
+		}, nil).
+		Times(2)
+
+	expectScalarQuery(m, "sum(prometheus_tsdb_head_series)", 1000)
+	expectScalarQuery(m, "count({v1=~\".+\"})", 100)
+	expectScalarQuery(m, "max(count by (v1) ({v1=~\".+\"}))", 1)
+	expectScalarQuery(m, "count({v2=~\".+\"})", 800)
+	expectScalarQuery(m, "max(count by (v2) ({v2=~\".+\"}))", 20)
+
+	for _, l := range []string{"v1", "v2"} {
+		m.
+			EXPECT().
+			Query(gomock.Any(), gomock.Eq("sum({"+l+"=~\".+\"}) by (job)"), gomock.Any()).
+			Return(model.Vector{{Metric: model.Metric{"job": "some-job"}, Value: 1}}, nil, nil)
+	}
+
+	scanner := CardinalityScanner{
+		PromAPI:         m,
+		Logger:          zap.NewNop().Sugar(),
+		LabelCountLimit: 50,
+		HeadSeries:      &HeadSeriesBudget{Logger: zap.NewNop().Sugar(), PromAPI: m, Budget: 500},
+	}
+
+	result, err := scanner.Scan(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{"some-job": {"v2", "v1"}}, result)
+}
@@ -0,0 +1,100 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+)
+
+// histogramLabels are the bucket label of histograms and the quantile label
+// of summaries. Dropping them merges every bucket or quantile of a metric
+// into one series, which breaks histogram_quantile and every dashboard using
+// it, so they are never dropped.
+var histogramLabels = []string{"le", "quantile"}
+
+func isHistogramLabel(label string) bool {
+	return containsString(histogramLabels, label)
+}
+
+func bucketCountQuery(label string) string {
+	return fmt.Sprintf("count by (__name__, job) (count by (__name__, job, %s) ({%s!=\"\"}))", label, label)
+}
+
+// BucketExplosion is a histogram with too many buckets, or a summary with too
+// many quantiles, in a job.
+type BucketExplosion struct {
+	Metric         string `json:"metric"`
+	Job            string `json:"job"`
+	Label          string `json:"label"`
+	Buckets        uint64 `json:"buckets"`
+	Recommendation string `json:"recommendation"`
+}
+
+func newBucketExplosion(metric, job, label string, buckets uint64) BucketExplosion {
+	e := BucketExplosion{Metric: metric, Job: job, Label: label, Buckets: buckets}
+	if label == "le" {
+		e.Recommendation = fmt.Sprintf("reduce the buckets of %s, it has %d", strings.TrimSuffix(metric, "_bucket"), buckets)
+	} else {
+		e.Recommendation = fmt.Sprintf("reduce the quantiles of %s, it has %d", metric, buckets)
+	}
+	return e
+}
+
+// HistogramBucketCheck finds the metrics of each job with more than
+// MaxBuckets distinct le or quantile values. They are reported with a
+// recommendation to reduce the buckets rather than remediated, as the labels
+// can't be dropped.
+type HistogramBucketCheck struct {
+	Logger     *zap.SugaredLogger
+	PromAPI    v1.API
+	MaxBuckets uint64
+
+	mu   sync.Mutex
+	last []BucketExplosion
+}
+
+func (h *HistogramBucketCheck) Check(ctx context.Context, now time.Time) ([]BucketExplosion, error) {
+	var explosions []BucketExplosion
+	for _, label := range histogramLabels {
+		r, _, err := h.PromAPI.Query(ctx, bucketCountQuery(label), now)
+		if err != nil {
+			return nil, fmt.Errorf("error querying the promtheus API, %w", err)
+		}
+
+		vec, ok := r.(model.Vector)
+		if !ok {
+			continue
+		}
+		for _, s := range vec {
+			if uint64(s.Value) <= h.MaxBuckets {
+				continue
+			}
+			e := newBucketExplosion(string(s.Metric[model.MetricNameLabel]), string(s.Metric["job"]), label, uint64(s.Value))
+			h.Logger.Warnw("histogram bucket explosion", "metric", e.Metric, "job", e.Job, "label", e.Label, "buckets", e.Buckets, "recommendation", e.Recommendation)
+			explosions = append(explosions, e)
+		}
+	}
+
+	sort.SliceStable(explosions, func(i, j int) bool {
+		return explosions[i].Buckets > explosions[j].Buckets
+	})
+
+	h.mu.Lock()
+	h.last = explosions
+	h.mu.Unlock()
+	return explosions, nil
+}
+
+// Last returns the explosions found by the last check.
+func (h *HistogramBucketCheck) Last() []BucketExplosion {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.last
+}
@@ -0,0 +1,48 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mclarke47/cardinanny/mock_v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestHistogramBucketCheck(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := mock_v1.NewMockAPI(ctrl)
+
+	m.EXPECT().Query(gomock.Any(), `count by (__name__, job) (count by (__name__, job, le) ({le!=""}))`, gomock.Any()).Return(model.Vector{
+		{Metric: model.Metric{"__name__": "http_request_duration_seconds_bucket", "job": "api"}, Value: 120},
+		{Metric: model.Metric{"__name__": "http_request_duration_seconds_bucket", "job": "web"}, Value: 12},
+		{Metric: model.Metric{"__name__": "db_query_seconds_bucket", "job": "api"}, Value: 300},
+	}, nil, nil)
+	m.EXPECT().Query(gomock.Any(), `count by (__name__, job) (count by (__name__, job, quantile) ({quantile!=""}))`, gomock.Any()).Return(model.Vector{
+		{Metric: model.Metric{"__name__": "rpc_duration_seconds", "job": "worker"}, Value: 200},
+	}, nil, nil)
+
+	check := &HistogramBucketCheck{Logger: zap.NewNop().Sugar(), PromAPI: m, MaxBuckets: 100}
+	explosions, err := check.Check(context.Background(), time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, []BucketExplosion{
+		{Metric: "db_query_seconds_bucket", Job: "api", Label: "le", Buckets: 300, Recommendation: "reduce the buckets of db_query_seconds, it has 300"},
+		{Metric: "rpc_duration_seconds", Job: "worker", Label: "quantile", Buckets: 200, Recommendation: "reduce the quantiles of rpc_duration_seconds, it has 200"},
+		{Metric: "http_request_duration_seconds_bucket", Job: "api", Label: "le", Buckets: 120, Recommendation: "reduce the buckets of http_request_duration_seconds, it has 120"},
+	}, explosions)
+	assert.Equal(t, explosions, check.Last())
+}
+
+func TestHistogramBucketCheck_queryError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := mock_v1.NewMockAPI(ctrl)
+	m.EXPECT().Query(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, nil, errors.New("some-error"))
+
+	check := &HistogramBucketCheck{Logger: zap.NewNop().Sugar(), PromAPI: m, MaxBuckets: 100}
+	_, err := check.Check(context.Background(), time.Now())
+	assert.EqualError(t, err, "error querying the promtheus API, some-error")
+}
@@ -0,0 +1,171 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type HistoryAction string
+
+const (
+	HistoryDrop   HistoryAction = "drop"
+	HistoryRevert HistoryAction = "revert"
+)
+
+// HistoryEntry records one config change made to a job so it can be listed
+// and undone later.
+type HistoryEntry struct {
+	ID       string        `json:"id"`
+	Time     time.Time     `json:"time"`
+	Instance string        `json:"instance"`
+	Action   HistoryAction `json:"action"`
+	Job      string        `json:"job"`
+	Labels   []string      `json:"labels"`
+	Reverts  string        `json:"reverts,omitempty"`
+}
+
+var ErrHistoryEntryNotFound = errors.New("history entry not found")
+
+// History is an append only log of config changes, one JSON entry per line.
+type History struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (h *History) Entries() ([]HistoryEntry, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.entries()
+}
+
+func (h *History) entries() ([]HistoryEntry, error) {
+	f, err := os.Open(h.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading history file, %w", err)
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("error parsing history file %s line %d, %w", h.Path, line, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading history file, %w", err)
+	}
+	return entries, nil
+}
+
+func (h *History) Find(id string) (HistoryEntry, error) {
+	entries, err := h.Entries()
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	for _, e := range entries {
+		if e.ID == id {
+			return e, nil
+		}
+	}
+	return HistoryEntry{}, fmt.Errorf("%w: %s", ErrHistoryEntryNotFound, id)
+}
+
+// Record appends the entries, numbering them after the ones already in the
+// file.
+func (h *History) Record(entries ...HistoryEntry) ([]HistoryEntry, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	existing, err := h.entries()
+	if err != nil {
+		return nil, err
+	}
+	nextID := len(existing) + 1
+
+	f, err := os.OpenFile(h.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening history file, %w", err)
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	for i := range entries {
+		entries[i].ID = strconv.Itoa(nextID)
+		nextID++
+		if entries[i].Time.IsZero() {
+			entries[i].Time = time.Now()
+		}
+		if err := enc.Encode(entries[i]); err != nil {
+			return nil, fmt.Errorf("error writing history file, %w", err)
+		}
+	}
+	return entries, nil
+}
+
+// DropEntries makes one history entry per job for a set of dropped labels.
+func DropEntries(instance string, jobNamesToLabelsToDrop map[string][]string) []HistoryEntry {
+	var entries []HistoryEntry
+	for _, j := range sortedJobs(jobNamesToLabelsToDrop) {
+		entries = append(entries, HistoryEntry{
+			Instance: instance,
+			Action:   HistoryDrop,
+			Job:      j,
+			Labels:   jobNamesToLabelsToDrop[j],
+		})
+	}
+	return entries
+}
+
+// Exemptions are the labels whose drop was reverted, which scans leave alone
+// until they are dropped again on purpose, through a plan.
+type Exemptions struct {
+	Instance string
+
+	mu   sync.Mutex
+	jobs map[string][]string
+}
+
+// Record replays history entries of the instance, in the order they were
+// made.
+func (e *Exemptions) Record(entries ...HistoryEntry) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.jobs == nil {
+		e.jobs = map[string][]string{}
+	}
+	for _, entry := range entries {
+		if entry.Instance != e.Instance {
+			continue
+		}
+		switch entry.Action {
+		case HistoryRevert:
+			e.jobs = MergeJobLabels(e.jobs, map[string][]string{entry.Job: entry.Labels})
+		case HistoryDrop:
+			e.jobs = WithoutJobLabels(e.jobs, map[string][]string{entry.Job: entry.Labels})
+		}
+	}
+}
+
+// Filter leaves the exempt labels out.
+func (e *Exemptions) Filter(jobNamesToLabels map[string][]string) map[string][]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return WithoutJobLabels(jobNamesToLabels, e.jobs)
+}
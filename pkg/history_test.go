@@ -0,0 +1,109 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mclarke47/cardinanny/mock_v1"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func tempHistory(t *testing.T) *History {
+	dir, err := ioutil.TempDir("", "cardinanny-history")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return &History{Path: filepath.Join(dir, "history.jsonl")}
+}
+
+func TestHistory_recordAndFind(t *testing.T) {
+	h := tempHistory(t)
+
+	entries, err := h.Entries()
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	recorded, err := h.Record(DropEntries("default", map[string][]string{
+		"some-other-job": {"somevalue"},
+		"some-job":       {"somevalue", "anotherBadLabel"},
+	})...)
+	assert.Nil(t, err)
+	assert.Len(t, recorded, 2)
+	assert.Equal(t, "1", recorded[0].ID)
+	assert.Equal(t, "some-job", recorded[0].Job)
+	assert.Equal(t, "2", recorded[1].ID)
+	assert.Equal(t, "some-other-job", recorded[1].Job)
+
+	reverted, err := h.Record(HistoryEntry{Instance: "default", Action: HistoryRevert, Job: "some-job", Labels: []string{"somevalue"}, Reverts: "1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "3", reverted[0].ID)
+
+	entries, err = h.Entries()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 3)
+
+	e, err := h.Find("2")
+	assert.Nil(t, err)
+	assert.Equal(t, HistoryDrop, e.Action)
+	assert.Equal(t, []string{"somevalue"}, e.Labels)
+
+	_, err = h.Find("4")
+	assert.True(t, errors.Is(err, ErrHistoryEntryNotFound))
+}
+
+func TestHistory_corruptFile(t *testing.T) {
+	h := tempHistory(t)
+	assert.Nil(t, ioutil.WriteFile(h.Path, []byte("{\"id\": \"1\"}\nnot json\n"), 0644))
+
+	_, err := h.Entries()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "line 2")
+}
+
+func TestExemptions_scanAfterRevertDoesNotDropAgain(t *testing.T) {
+	h := tempHistory(t)
+
+	_, err := h.Record(DropEntries("default", map[string][]string{"some-job": {"somevalue", "anotherBadLabel"}})...)
+	assert.Nil(t, err)
+	_, err = h.Record(HistoryEntry{Instance: "default", Action: HistoryRevert, Job: "some-job", Labels: []string{"somevalue"}, Reverts: "1"})
+	assert.Nil(t, err)
+	// the same label reverted on another instance
+	_, err = h.Record(HistoryEntry{Instance: "other", Action: HistoryRevert, Job: "some-job", Labels: []string{"anotherBadLabel"}})
+	assert.Nil(t, err)
+
+	entries, err := h.Entries()
+	assert.Nil(t, err)
+	exemptions := &Exemptions{Instance: "default"}
+	exemptions.Record(entries...)
+
+	ctrl := gomock.NewController(t)
+	m := mock_v1.NewMockAPI(ctrl)
+	m.EXPECT().TSDB(gomock.Any()).Return(v1.TSDBResult{
+		LabelValueCountByLabelName: []v1.Stat{
+			{Name: "somevalue", Value: 51},
+			{Name: "anotherBadLabel", Value: 51},
+		},
+	}, nil)
+	for _, l := range []string{"somevalue", "anotherBadLabel"} {
+		m.EXPECT().Query(gomock.Any(), `sum({`+l+`=~".+"}) by (job)`, gomock.Any()).Return(model.Vector{
+			{Metric: model.Metric{"job": "some-job"}, Value: 51},
+		}, nil, nil)
+	}
+
+	scanner := CardinalityScanner{PromAPI: m, Logger: zap.NewNop().Sugar(), LabelCountLimit: 50}
+	found, err := scanner.Scan(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{"some-job": {"anotherBadLabel"}}, exemptions.Filter(found))
+
+	// dropping the label again on purpose lifts the exemption
+	exemptions.Record(DropEntries("default", map[string][]string{"some-job": {"somevalue"}})...)
+	assert.Equal(t, map[string][]string{"some-job": {"somevalue", "anotherBadLabel"}}, exemptions.Filter(found))
+}
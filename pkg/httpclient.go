@@ -0,0 +1,73 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"github.com/prometheus/common/config"
+	"gopkg.in/yaml.v2"
+)
+
+// PromClientConfig is how cardinanny connects to Prometheus. It uses the same
+// format as a scrape config's HTTP client settings, plus custom headers.
+type PromClientConfig struct {
+	HTTPClientConfig config.HTTPClientConfig `yaml:",inline"`
+	Headers          map[string]string       `yaml:"headers,omitempty"`
+}
+
+func (c *PromClientConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = PromClientConfig{HTTPClientConfig: config.DefaultHTTPClientConfig}
+	type plain PromClientConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	return c.HTTPClientConfig.Validate()
+}
+
+func LoadPromClientConfigFile(path string) (*PromClientConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading prometheus client config file, %w", err)
+	}
+
+	c := &PromClientConfig{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("error parsing prometheus client config file %s, %w", path, err)
+	}
+	c.HTTPClientConfig.SetDirectory(filepath.Dir(path))
+	return c, nil
+}
+
+func (c *PromClientConfig) NewRoundTripper() (http.RoundTripper, error) {
+	rt, err := config.NewRoundTripperFromConfig(c.HTTPClientConfig, "cardinanny")
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Headers) == 0 {
+		return rt, nil
+	}
+	return &headersRoundTripper{headers: c.Headers, next: rt}, nil
+}
+
+func (c *PromClientConfig) NewHTTPClient() (*http.Client, error) {
+	rt, err := c.NewRoundTripper()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: rt}, nil
+}
+
+type headersRoundTripper struct {
+	headers map[string]string
+	next    http.RoundTripper
+}
+
+func (rt *headersRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range rt.headers {
+		req.Header.Set(k, v)
+	}
+	return rt.next.RoundTrip(req)
+}
@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeClientConfig(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "cardinanny-client-config")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, content := range files {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	return filepath.Join(dir, "client.yaml")
+}
+
+func TestPromClientConfig_basicAuthHeadersAndCA(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "prom", user)
+		assert.Equal(t, "s3cret", pass)
+		assert.Equal(t, "tenant-a", r.Header.Get("X-Scope-OrgID"))
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+
+	path := writeClientConfig(t, map[string]string{
+		"ca.pem": string(ca),
+		"client.yaml": `
+basic_auth:
+  username: prom
+  password: s3cret
+tls_config:
+  ca_file: ca.pem
+headers:
+  X-Scope-OrgID: tenant-a
+`,
+	})
+
+	cfg, err := LoadPromClientConfigFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(filepath.Dir(path), "ca.pem"), cfg.HTTPClientConfig.TLSConfig.CAFile)
+
+	client, err := cfg.NewHTTPClient()
+	assert.Nil(t, err)
+
+	resp, err := client.Get(ts.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestPromClientConfig_bearerTokenFileAndInsecureSkipVerify(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer some-token", r.Header.Get("Authorization"))
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	path := writeClientConfig(t, map[string]string{
+		"token": "some-token",
+		"client.yaml": `
+bearer_token_file: token
+tls_config:
+  insecure_skip_verify: true
+`,
+	})
+
+	cfg, err := LoadPromClientConfigFile(path)
+	assert.Nil(t, err)
+
+	client, err := cfg.NewHTTPClient()
+	assert.Nil(t, err)
+
+	resp, err := client.Get(ts.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestPromClientConfig_invalidConfig(t *testing.T) {
+	path := writeClientConfig(t, map[string]string{
+		"client.yaml": `
+bearer_token: a
+bearer_token_file: b
+`,
+	})
+
+	_, err := LoadPromClientConfigFile(path)
+	assert.NotNil(t, err)
+	assert.Equal(t, "error parsing prometheus client config file "+path+", at most one of bearer_token & bearer_token_file must be configured", err.Error())
+}
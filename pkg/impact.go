@@ -0,0 +1,149 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ImpactAction is what happens to a label drop which would break a rule or
+// dashboard using the label.
+type ImpactAction string
+
+const (
+	// ImpactBlock never drops the label.
+	ImpactBlock ImpactAction = "block"
+	// ImpactApproval proposes the label drop for approval whatever the
+	// remediation policy of the job.
+	ImpactApproval ImpactAction = "approval"
+	// ImpactWarn drops the label, listing what it breaks in the plan.
+	ImpactWarn ImpactAction = "warn"
+	// ImpactIgnore does not look for anything using the label.
+	ImpactIgnore ImpactAction = "ignore"
+)
+
+func ParseImpactAction(s string) (ImpactAction, error) {
+	switch ImpactAction(s) {
+	case ImpactBlock, ImpactApproval, ImpactWarn, ImpactIgnore:
+		return ImpactAction(s), nil
+	}
+	return "", fmt.Errorf("unknown impact action %s, expected %s, %s, %s or %s", s, ImpactBlock, ImpactApproval, ImpactWarn, ImpactIgnore)
+}
+
+// strictness orders the actions, the strictest impact on a label wins.
+func (a ImpactAction) strictness() int {
+	switch a {
+	case ImpactBlock:
+		return 3
+	case ImpactApproval:
+		return 2
+	case ImpactWarn:
+		return 1
+	}
+	return 0
+}
+
+const (
+	ImpactAlertingRule  = "alerting_rule"
+	ImpactRecordingRule = "recording_rule"
+)
+
+// Impact is something which uses labels of a job about to be dropped.
+type Impact struct {
+	Job    string   `json:"job"`
+	Labels []string `json:"labels"`
+	// Source is the kind of thing using the labels, Name and Group which one.
+	Source string       `json:"source"`
+	Name   string       `json:"name"`
+	Group  string       `json:"group,omitempty"`
+	Query  string       `json:"query,omitempty"`
+	Action ImpactAction `json:"action"`
+}
+
+func (i Impact) String() string {
+	if i.Group != "" {
+		return fmt.Sprintf("%s %s/%s", i.Source, i.Group, i.Name)
+	}
+	return fmt.Sprintf("%s %s", i.Source, i.Name)
+}
+
+// ImpactAnalyzer finds what uses the labels about to be dropped.
+type ImpactAnalyzer interface {
+	Impacts(ctx context.Context, jobNamesToLabelsToDrop map[string][]string) ([]Impact, error)
+}
+
+// impactsOn returns the impacts on a label of a job.
+func impactsOn(impacts []Impact, job, label string) []Impact {
+	var result []Impact
+	for _, i := range impacts {
+		if i.Job == job && containsString(i.Labels, label) {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+// ImpactReason lists what a label drop would break, for logs and outcomes.
+func ImpactReason(impacts []Impact, job, label string) string {
+	var used []string
+	for _, i := range impactsOn(impacts, job, label) {
+		used = append(used, i.String())
+	}
+	sort.Strings(used)
+	return "used by " + strings.Join(used, ", ")
+}
+
+// SplitByImpact separates the label drops which can go ahead from the ones
+// which need approval and the blocked ones, going by the strictest action of
+// the impacts on each label.
+func SplitByImpact(jobNamesToLabelsToDrop map[string][]string, impacts []Impact) (map[string][]string, map[string][]string, map[string][]string) {
+	proceed := map[string][]string{}
+	approval := map[string][]string{}
+	blocked := map[string][]string{}
+
+	for job, labels := range jobNamesToLabelsToDrop {
+		for _, label := range labels {
+			strictest := ImpactIgnore
+			for _, i := range impactsOn(impacts, job, label) {
+				if i.Action.strictness() > strictest.strictness() {
+					strictest = i.Action
+				}
+			}
+
+			switch strictest {
+			case ImpactBlock:
+				blocked[job] = append(blocked[job], label)
+			case ImpactApproval:
+				approval[job] = append(approval[job], label)
+			default:
+				proceed[job] = append(proceed[job], label)
+			}
+		}
+	}
+	return proceed, approval, blocked
+}
+
+// AnnotateImpacts lists in the plan what each job's dropped labels break.
+func AnnotateImpacts(plan *Plan, impacts []Impact) {
+	dropped := plan.Dropped()
+	for j := range plan.Jobs {
+		job := &plan.Jobs[j]
+		job.Impacts = nil
+		for _, i := range impacts {
+			if i.Job != job.Job {
+				continue
+			}
+			var labels []string
+			for _, l := range i.Labels {
+				if containsString(dropped[job.Job], l) {
+					labels = append(labels, l)
+				}
+			}
+			if len(labels) > 0 {
+				i.Labels = labels
+				job.Impacts = append(job.Impacts, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	plog "github.com/go-kit/log"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	promconfig "github.com/prometheus/prometheus/config"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+type ForgeConfig struct {
+	Type      string `yaml:"type"`
+	URL       string `yaml:"url"`
+	Project   string `yaml:"project"`
+	TokenFile string `yaml:"token_file"`
+}
+
+func NewForge(c ForgeConfig) (Forge, error) {
+	token, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading forge token file, %w", err)
+	}
+
+	switch c.Type {
+	case "gitlab":
+		return &GitLabForge{
+			HTTPClient: &http.Client{},
+			BaseURL:    c.URL,
+			Project:    c.Project,
+			Token:      strings.TrimSpace(string(token)),
+		}, nil
+	case "github":
+		return &GitHubForge{
+			HTTPClient: &http.Client{},
+			BaseURL:    c.URL,
+			Repository: c.Project,
+			Token:      strings.TrimSpace(string(token)),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown forge %s, expected gitlab or github", c.Type)
+}
+
+type GitConfig struct {
+	Dir        string       `yaml:"dir"`
+	Remote     string       `yaml:"remote,omitempty"`
+	BaseBranch string       `yaml:"base_branch,omitempty"`
+	PushBranch bool         `yaml:"push_branch,omitempty"`
+	Forge      *ForgeConfig `yaml:"forge,omitempty"`
+}
+
+// DefaultGitBaseBranch is the branch prometheus is deployed from when
+// base_branch is not set.
+const DefaultGitBaseBranch = "main"
+
+func (g *GitConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*g = GitConfig{BaseBranch: DefaultGitBaseBranch}
+	type plain GitConfig
+	return unmarshal((*plain)(g))
+}
+
+func (g *GitConfig) NewGitConfigRepo(logger *zap.SugaredLogger) (*GitConfigRepo, error) {
+	repo := &GitConfigRepo{
+		Logger:     logger,
+		Dir:        g.Dir,
+		Remote:     g.Remote,
+		BaseBranch: g.BaseBranch,
+		PushBranch: g.PushBranch,
+	}
+	if repo.BaseBranch == "" {
+		repo.BaseBranch = DefaultGitBaseBranch
+	}
+
+	if g.Forge != nil {
+		forge, err := NewForge(*g.Forge)
+		if err != nil {
+			return nil, err
+		}
+		repo.Forge = forge
+	}
+	return repo, nil
+}
+
+type NotifyConfig struct {
+	WebhookURL string `yaml:"webhook_url"`
+}
+
+func (n *NotifyConfig) NewNotifier() Notifier {
+	return &WebhookNotifier{HTTPClient: &http.Client{Timeout: 10 * time.Second}, URL: n.WebhookURL}
+}
+
+type ReloadConfig struct {
+	Method      string `yaml:"method,omitempty"`
+	PIDFile     string `yaml:"pid_file,omitempty"`
+	ProcessName string `yaml:"process_name,omitempty"`
+}
+
+func (r ReloadConfig) Validate() error {
+	switch r.Method {
+	case ReloadAuto, ReloadHTTP, ReloadWait:
+		return nil
+	case ReloadSignal:
+		if r.PIDFile == "" && r.ProcessName == "" {
+			return fmt.Errorf("reload method signal needs a pid_file or process_name")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown reload method %s, expected %s, %s, %s or %s", r.Method, ReloadAuto, ReloadHTTP, ReloadSignal, ReloadWait)
+}
+
+// NewReloader picks how prometheus is reloaded. auto uses the lifecycle
+// endpoint when it is enabled, then SIGHUP if the process is known and
+// otherwise leaves it to a config reloader sidecar.
+func (r ReloadConfig) NewReloader(caps Capabilities, httpClient *http.Client, baseURL string, logger *zap.SugaredLogger) Reloader {
+	method := r.Method
+	if method == ReloadAuto || method == "" {
+		switch {
+		case caps.Lifecycle:
+			method = ReloadHTTP
+		case r.PIDFile != "" || r.ProcessName != "":
+			method = ReloadSignal
+		default:
+			method = ReloadWait
+		}
+	} else if method == ReloadHTTP && caps.TSDBStats && !caps.Lifecycle {
+		logger.Warnw("prometheus does not look like it runs with --web.enable-lifecycle, reloads will probably fail")
+	}
+
+	logger.Infow("reloading prometheus config", "method", method)
+	switch method {
+	case ReloadSignal:
+		return &SignalReloader{PIDFile: r.PIDFile, ProcessName: r.ProcessName}
+	case ReloadWait:
+		return WaitReloader{}
+	}
+	return &HTTPReloader{HTTPClient: httpClient, BaseURL: baseURL}
+}
+
+type PolicyConfig struct {
+	Default              RemediationMode `yaml:"default,omitempty"`
+	ApprovalRequiredJobs []string        `yaml:"approval_required_jobs,omitempty"`
+	AutoApplyJobs        []string        `yaml:"auto_apply_jobs,omitempty"`
+	ProposalTTL          model.Duration  `yaml:"proposal_ttl,omitempty"`
+	// Scope is whether labels are dropped from the whole job or only from
+	// the instances responsible for them.
+	Scope RemediationScope `yaml:"scope,omitempty"`
+}
+
+func (p PolicyConfig) RemediationPolicy() RemediationPolicy {
+	policy := RemediationPolicy{
+		Default: p.Default,
+		Jobs:    map[string]RemediationMode{},
+	}
+	for _, j := range p.ApprovalRequiredJobs {
+		policy.Jobs[j] = ApprovalRequired
+	}
+	for _, j := range p.AutoApplyJobs {
+		policy.Jobs[j] = AutoApply
+	}
+	return policy
+}
+
+type TrendConfig struct {
+	MaxGrowthPerHour float64        `yaml:"max_growth_per_hour,omitempty"`
+	Horizon          model.Duration `yaml:"horizon,omitempty"`
+	Window           model.Duration `yaml:"window,omitempty"`
+}
+
+func (t *TrendConfig) NewTrendDetector(limit uint64) *TrendDetector {
+	window := time.Duration(t.Window)
+	if window == 0 {
+		window = 6 * time.Hour
+	}
+	return &TrendDetector{
+		Limit:            limit,
+		MaxGrowthPerHour: t.MaxGrowthPerHour,
+		Horizon:          time.Duration(t.Horizon),
+		Window:           window,
+	}
+}
+
+// ScanConfig bounds the load a scan puts on prometheus.
+type ScanConfig struct {
+	// Concurrency is how many labels are queried at the same time.
+	Concurrency int `yaml:"concurrency,omitempty"`
+	// QueryRateLimit caps the label queries per second, 0 is unlimited.
+	QueryRateLimit float64 `yaml:"query_rate_limit,omitempty"`
+	// MaxHistogramBuckets reports the histograms with more buckets, or
+	// summaries with more quantiles, 0 disables the check.
+	MaxHistogramBuckets uint64 `yaml:"max_histogram_buckets,omitempty"`
+	// ExemplarLookback is how far back exemplar labels are counted, 0
+	// disables it.
+	ExemplarLookback model.Duration `yaml:"exemplar_lookback,omitempty"`
+	// AttributeTargets breaks high cardinality labels down by instance, it
+	// is always done when label drops are scoped to instances.
+	AttributeTargets bool `yaml:"attribute_targets,omitempty"`
+	// TargetOutlierFactor is how many times more values than the median of
+	// the other instances of its job an instance needs to be held
+	// responsible for a label.
+	TargetOutlierFactor float64 `yaml:"target_outlier_factor,omitempty"`
+	// ProtectedLabels are never dropped, on top of job, instance, le and
+	// quantile.
+	ProtectedLabels []string `yaml:"protected_labels,omitempty"`
+}
+
+func (s ScanConfig) Validate() error {
+	if s.Concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1, was %d", s.Concurrency)
+	}
+	if s.QueryRateLimit < 0 {
+		return fmt.Errorf("query_rate_limit can not be negative, was %v", s.QueryRateLimit)
+	}
+	if s.TargetOutlierFactor < 0 {
+		return fmt.Errorf("target_outlier_factor can not be negative, was %v", s.TargetOutlierFactor)
+	}
+	return nil
+}
+
+// ImpactConfig decides what happens to label drops which break something
+// using the label.
+type ImpactConfig struct {
+	Rules      ImpactAction `yaml:"rules,omitempty"`
+	Dashboards ImpactAction `yaml:"dashboards,omitempty"`
+	// DashboardsDir holds grafana dashboards exported as JSON, dashboards
+	// are not looked at without it.
+	DashboardsDir string `yaml:"dashboards_dir,omitempty"`
+}
+
+func (c ImpactConfig) Validate() error {
+	if _, err := ParseImpactAction(string(c.Rules)); err != nil {
+		return err
+	}
+	_, err := ParseImpactAction(string(c.Dashboards))
+	return err
+}
+
+// NewImpactAnalyzers makes the analyzers of the instance's config.
+func (c ImpactConfig) NewImpactAnalyzers(promAPI v1.API, logger *zap.SugaredLogger) []ImpactAnalyzer {
+	var analyzers []ImpactAnalyzer
+	if c.Rules != ImpactIgnore {
+		analyzers = append(analyzers, &RulesImpactAnalyzer{Logger: logger, PromAPI: promAPI, Action: c.Rules})
+	}
+	if c.DashboardsDir != "" && c.Dashboards != ImpactIgnore {
+		analyzers = append(analyzers, &DashboardsImpactAnalyzer{Logger: logger, Dir: c.DashboardsDir, Action: c.Dashboards})
+	}
+	return analyzers
+}
+
+// InstanceConfig is everything cardinanny needs to look after one Prometheus.
+type InstanceConfig struct {
+	Name          string            `yaml:"name"`
+	BaseURL       string            `yaml:"base_url"`
+	ConfigFile    string            `yaml:"config_file"`
+	ClientConfig  PromClientConfig  `yaml:"client,omitempty"`
+	LabelLimit    uint64            `yaml:"label_limit,omitempty"`
+	ScanBackend   string            `yaml:"scan_backend,omitempty"`
+	ScanLookback  model.Duration    `yaml:"scan_lookback,omitempty"`
+	Scan          ScanConfig        `yaml:"scan,omitempty"`
+	Trend         *TrendConfig      `yaml:"trend,omitempty"`
+	SeriesBudget  uint64            `yaml:"head_series_budget,omitempty"`
+	Policy        PolicyConfig      `yaml:"policy,omitempty"`
+	Git           *GitConfig        `yaml:"git,omitempty"`
+	Notify        *NotifyConfig     `yaml:"notify,omitempty"`
+	DriftPolicy   DriftPolicy       `yaml:"drift_policy,omitempty"`
+	ReloadTimeout model.Duration    `yaml:"reload_timeout,omitempty"`
+	Reload        ReloadConfig      `yaml:"reload,omitempty"`
+	APIRetry      APIRetryConfig    `yaml:"api_retry,omitempty"`
+	Limits        RemediationLimits `yaml:"limits,omitempty"`
+	Impact        ImpactConfig      `yaml:"impact,omitempty"`
+}
+
+var DefaultInstanceConfig = InstanceConfig{
+	ClientConfig:  PromClientConfig{HTTPClientConfig: config.DefaultHTTPClientConfig},
+	LabelLimit:    1000000,
+	ScanBackend:   ScanBackendAuto,
+	ScanLookback:  model.Duration(time.Hour),
+	Scan:          ScanConfig{Concurrency: 4, QueryRateLimit: 10},
+	DriftPolicy:   DriftRefuse,
+	ReloadTimeout: model.Duration(DefaultReloadTimeout),
+	Reload:        ReloadConfig{Method: ReloadAuto},
+	Impact:        ImpactConfig{Rules: ImpactApproval, Dashboards: ImpactWarn},
+	APIRetry: APIRetryConfig{
+		MaxAttempts: DefaultAPIMaxAttempts,
+		Backoff:     model.Duration(DefaultAPIRetryBackoff),
+		MaxBackoff:  model.Duration(DefaultAPIMaxRetryBackoff),
+	},
+	Policy: PolicyConfig{
+		Default:     AutoApply,
+		ProposalTTL: model.Duration(24 * time.Hour),
+		Scope:       ScopeJob,
+	},
+}
+
+func (c *InstanceConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultInstanceConfig
+	type plain InstanceConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.Name == "" {
+		return fmt.Errorf("instance name is required")
+	}
+	if c.BaseURL == "" {
+		return fmt.Errorf("base_url is required for instance %s", c.Name)
+	}
+	if c.ConfigFile == "" {
+		return fmt.Errorf("config_file is required for instance %s", c.Name)
+	}
+	if _, err := ParseRemediationMode(string(c.Policy.Default)); err != nil {
+		return fmt.Errorf("invalid policy for instance %s, %w", c.Name, err)
+	}
+	if _, err := ParseRemediationScope(string(c.Policy.Scope)); err != nil {
+		return fmt.Errorf("invalid policy for instance %s, %w", c.Name, err)
+	}
+	if _, err := ParseDriftPolicy(string(c.DriftPolicy)); err != nil {
+		return fmt.Errorf("invalid drift_policy for instance %s, %w", c.Name, err)
+	}
+	if err := c.Reload.Validate(); err != nil {
+		return fmt.Errorf("invalid reload config for instance %s, %w", c.Name, err)
+	}
+	if err := c.Scan.Validate(); err != nil {
+		return fmt.Errorf("invalid scan config for instance %s, %w", c.Name, err)
+	}
+	if err := c.APIRetry.Validate(); err != nil {
+		return fmt.Errorf("invalid api_retry config for instance %s, %w", c.Name, err)
+	}
+	if err := c.Limits.Validate(); err != nil {
+		return fmt.Errorf("invalid limits for instance %s, %w", c.Name, err)
+	}
+	if err := c.Impact.Validate(); err != nil {
+		return fmt.Errorf("invalid impact config for instance %s, %w", c.Name, err)
+	}
+	return nil
+}
+
+func (c *InstanceConfig) setDirectory(dir string) {
+	c.ConfigFile = config.JoinDir(dir, c.ConfigFile)
+	c.ClientConfig.HTTPClientConfig.SetDirectory(dir)
+	c.Reload.PIDFile = config.JoinDir(dir, c.Reload.PIDFile)
+	c.Impact.DashboardsDir = config.JoinDir(dir, c.Impact.DashboardsDir)
+	if c.Git != nil {
+		c.Git.Dir = config.JoinDir(dir, c.Git.Dir)
+		if c.Git.Forge != nil {
+			c.Git.Forge.TokenFile = config.JoinDir(dir, c.Git.Forge.TokenFile)
+		}
+	}
+}
+
+// Validate checks the files the instance refers to can be loaded, without
+// connecting to prometheus.
+func (c *InstanceConfig) Validate() error {
+	if _, err := promconfig.LoadFile(c.ConfigFile, false, plog.NewNopLogger()); err != nil {
+		return fmt.Errorf("invalid prometheus config file for instance %s, %w", c.Name, err)
+	}
+	if _, err := c.ClientConfig.NewHTTPClient(); err != nil {
+		return fmt.Errorf("invalid client config for instance %s, %w", c.Name, err)
+	}
+	if c.Git != nil {
+		if _, err := os.Stat(c.Git.Dir); err != nil {
+			return fmt.Errorf("invalid git config for instance %s, %w", c.Name, err)
+		}
+		if _, err := c.Git.NewGitConfigRepo(zap.NewNop().Sugar()); err != nil {
+			return fmt.Errorf("invalid git config for instance %s, %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+type CardinannyConfig struct {
+	Instances   []*InstanceConfig `yaml:"instances"`
+	HistoryFile string            `yaml:"history_file,omitempty"`
+}
+
+func LoadCardinannyConfigFile(path string) (*CardinannyConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cardinanny config file, %w", err)
+	}
+
+	c := &CardinannyConfig{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("error parsing cardinanny config file %s, %w", path, err)
+	}
+
+	if len(c.Instances) == 0 {
+		return nil, fmt.Errorf("no instances configured in cardinanny config file %s", path)
+	}
+
+	names := map[string]bool{}
+	for _, inst := range c.Instances {
+		if names[inst.Name] {
+			return nil, fmt.Errorf("instance %s is configured more than once in cardinanny config file %s", inst.Name, path)
+		}
+		names[inst.Name] = true
+		inst.setDirectory(filepath.Dir(path))
+	}
+	if c.HistoryFile != "" {
+		c.HistoryFile = config.JoinDir(filepath.Dir(path), c.HistoryFile)
+	}
+	return c, nil
+}
@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCardinannyConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "cardinanny-config")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "cardinanny.yml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadCardinannyConfigFile_multipleInstances(t *testing.T) {
+	path := writeCardinannyConfig(t, `
+instances:
+  - name: eu-west-1
+    base_url: http://prometheus-eu:9090
+    config_file: eu/prometheus.yml
+    label_limit: 500
+    client:
+      bearer_token_file: token
+    policy:
+      default: approval
+      auto_apply_jobs: [node]
+      proposal_ttl: 1h
+  - name: us-east-1
+    base_url: http://prometheus-us:9090
+    config_file: /etc/prometheus/prometheus.yml
+    git:
+      dir: us
+      push_branch: true
+`)
+	dir := filepath.Dir(path)
+
+	cfg, err := LoadCardinannyConfigFile(path)
+	assert.Nil(t, err)
+	assert.Len(t, cfg.Instances, 2)
+
+	eu := cfg.Instances[0]
+	assert.Equal(t, "eu-west-1", eu.Name)
+	assert.Equal(t, filepath.Join(dir, "eu/prometheus.yml"), eu.ConfigFile)
+	assert.Equal(t, uint64(500), eu.LabelLimit)
+	assert.Equal(t, filepath.Join(dir, "token"), eu.ClientConfig.HTTPClientConfig.Authorization.CredentialsFile)
+	assert.Equal(t, RemediationPolicy{
+		Default: ApprovalRequired,
+		Jobs:    map[string]RemediationMode{"node": AutoApply},
+	}, eu.Policy.RemediationPolicy())
+	assert.Equal(t, model.Duration(time.Hour), eu.Policy.ProposalTTL)
+
+	us := cfg.Instances[1]
+	assert.Equal(t, "/etc/prometheus/prometheus.yml", us.ConfigFile)
+	assert.Equal(t, DefaultInstanceConfig.LabelLimit, us.LabelLimit)
+	assert.Equal(t, AutoApply, us.Policy.Default)
+	assert.True(t, us.ClientConfig.HTTPClientConfig.FollowRedirects)
+	assert.Equal(t, &GitConfig{Dir: filepath.Join(dir, "us"), BaseBranch: DefaultGitBaseBranch, PushBranch: true}, us.Git)
+}
+
+func TestLoadCardinannyConfigFile_duplicateInstance(t *testing.T) {
+	path := writeCardinannyConfig(t, `
+instances:
+  - name: eu-west-1
+    base_url: http://prometheus-eu:9090
+    config_file: prometheus.yml
+  - name: eu-west-1
+    base_url: http://prometheus-eu-2:9090
+    config_file: prometheus.yml
+`)
+
+	_, err := LoadCardinannyConfigFile(path)
+	assert.NotNil(t, err)
+	assert.Equal(t, "instance eu-west-1 is configured more than once in cardinanny config file "+path, err.Error())
+}
+
+func TestLoadCardinannyConfigFile_missingBaseURL(t *testing.T) {
+	path := writeCardinannyConfig(t, `
+instances:
+  - name: eu-west-1
+    config_file: prometheus.yml
+`)
+
+	_, err := LoadCardinannyConfigFile(path)
+	assert.NotNil(t, err)
+	assert.Equal(t, "error parsing cardinanny config file "+path+", base_url is required for instance eu-west-1", err.Error())
+}
+
+func TestLoadCardinannyConfigFile_noInstances(t *testing.T) {
+	path := writeCardinannyConfig(t, "instances: []\n")
+
+	_, err := LoadCardinannyConfigFile(path)
+	assert.NotNil(t, err)
+	assert.Equal(t, "no instances configured in cardinanny config file "+path, err.Error())
+}
+
+func TestInstanceConfig_Validate(t *testing.T) {
+	path := writeCardinannyConfig(t, `
+history_file: history.jsonl
+instances:
+  - name: default
+    base_url: http://localhost:9090
+    config_file: prometheus.yml
+`)
+	dir := filepath.Dir(path)
+
+	cfg, err := LoadCardinannyConfigFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "history.jsonl"), cfg.HistoryFile)
+
+	err = cfg.Instances[0].Validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid prometheus config file for instance default")
+
+	fixture, err := ioutil.ReadFile("./fixtures/2-scrape-jobs.yaml")
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "prometheus.yml"), fixture, 0644))
+
+	assert.Nil(t, cfg.Instances[0].Validate())
+}
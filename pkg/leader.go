@@ -0,0 +1,329 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	LeaderElectionNone       = "none"
+	LeaderElectionFile       = "file"
+	LeaderElectionKubernetes = "kubernetes"
+)
+
+// LeaderElector decides which of several cardinanny replicas makes changes.
+type LeaderElector interface {
+	// TryAcquireOrRenew takes or keeps the leadership, returning whether this
+	// replica is the leader.
+	TryAcquireOrRenew(ctx context.Context) (bool, error)
+	Release(ctx context.Context) error
+}
+
+// Leadership keeps trying to become or stay the leader in the background.
+// A nil Leadership always leads, for a single replica.
+type Leadership struct {
+	Logger      *zap.SugaredLogger
+	Elector     LeaderElector
+	RetryPeriod time.Duration
+
+	leader int32
+}
+
+func (l *Leadership) IsLeader() bool {
+	return l == nil || atomic.LoadInt32(&l.leader) == 1
+}
+
+func (l *Leadership) try(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, l.RetryPeriod)
+	defer cancel()
+
+	leading, err := l.Elector.TryAcquireOrRenew(ctx)
+	if err != nil {
+		l.Logger.Warnw("unable to acquire or renew leadership, following until it works again", "error", err)
+		leading = false
+	}
+
+	var v int32
+	if leading {
+		v = 1
+	}
+	if atomic.SwapInt32(&l.leader, v) != v {
+		l.Logger.Infow("leadership changed", "leader", leading)
+	}
+	Leader.Set(float64(v))
+}
+
+// Run tries to acquire or renew the leadership every RetryPeriod until the
+// context is done, then releases it.
+func (l *Leadership) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.RetryPeriod)
+	defer ticker.Stop()
+
+	for {
+		l.try(ctx)
+
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&l.leader, 0)
+			Leader.Set(0)
+			releaseCtx, cancel := context.WithTimeout(context.Background(), l.RetryPeriod)
+			defer cancel()
+			if err := l.Elector.Release(releaseCtx); err != nil {
+				l.Logger.Warnw("unable to release leadership", "error", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// FileLockElector leads while it holds an exclusive lock on a file, on a
+// volume shared by the replicas. The lock is released when the process dies.
+type FileLockElector struct {
+	Path     string
+	Identity string
+
+	file *os.File
+}
+
+func (f *FileLockElector) TryAcquireOrRenew(ctx context.Context) (bool, error) {
+	if f.file != nil {
+		return true, nil
+	}
+
+	file, err := os.OpenFile(f.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, fmt.Errorf("error opening leader lock file, %w", err)
+	}
+	locked, err := tryLockFile(file)
+	if !locked {
+		file.Close()
+		return false, err
+	}
+
+	// only informational, for whoever wonders which replica leads
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(f.Identity+"\n"), 0)
+	}
+	f.file = file
+	return true, nil
+}
+
+func (f *FileLockElector) Release(ctx context.Context) error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// leaseTimeFormat is the MicroTime format of the Kubernetes API.
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+func (l *lease) expired(now time.Time) bool {
+	renewed, err := time.Parse(time.RFC3339Nano, l.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second).Before(now)
+}
+
+var errLeaseConflict = errors.New("lease was changed by another replica")
+
+// KubernetesLeaseElector leads while it holds a coordination.k8s.io Lease,
+// the same way Kubernetes controllers elect their leader.
+type KubernetesLeaseElector struct {
+	HTTPClient *http.Client
+	// BaseURL is the Kubernetes API server.
+	BaseURL string
+	// TokenFile is read for every request as the token is rotated.
+	TokenFile     string
+	Namespace     string
+	Name          string
+	Identity      string
+	LeaseDuration time.Duration
+}
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// NewInClusterLeaseElector uses the API server and service account of the pod
+// cardinanny runs in, in the pod's namespace unless one is given.
+func NewInClusterLeaseElector(name, namespace, identity string, leaseDuration time.Duration) (*KubernetesLeaseElector, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("kubernetes leader election only works inside a cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("error reading the service account CA, %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in the service account CA")
+	}
+
+	if namespace == "" {
+		b, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("error reading the service account namespace, %w", err)
+		}
+		namespace = strings.TrimSpace(string(b))
+	}
+
+	return &KubernetesLeaseElector{
+		HTTPClient: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		BaseURL:       "https://" + net.JoinHostPort(host, port),
+		TokenFile:     serviceAccountDir + "/token",
+		Namespace:     namespace,
+		Name:          name,
+		Identity:      identity,
+		LeaseDuration: leaseDuration,
+	}, nil
+}
+
+func (k *KubernetesLeaseElector) leasesURL() string {
+	return fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", k.BaseURL, k.Namespace)
+}
+
+// do sends the request, returning a nil lease when it does not exist.
+func (k *KubernetesLeaseElector) do(ctx context.Context, method, url string, body *lease) (*lease, error) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, &reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if k.TokenFile != "" {
+		token, err := ioutil.ReadFile(k.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the service account token, %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := k.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode == http.StatusConflict:
+		return nil, errLeaseConflict
+	case resp.StatusCode/100 != 2:
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("error %s lease %s/%s, expected a 2xx status code but was %d, body: %s", method, k.Namespace, k.Name, resp.StatusCode, b)
+	}
+
+	var l lease
+	if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+		return nil, fmt.Errorf("error parsing lease %s/%s, %w", k.Namespace, k.Name, err)
+	}
+	return &l, nil
+}
+
+func (k *KubernetesLeaseElector) TryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := time.Now()
+	current, err := k.do(ctx, http.MethodGet, k.leasesURL()+"/"+k.Name, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if current == nil {
+		_, err := k.do(ctx, http.MethodPost, k.leasesURL(), &lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   leaseMetadata{Name: k.Name, Namespace: k.Namespace},
+			Spec: leaseSpec{
+				HolderIdentity:       k.Identity,
+				LeaseDurationSeconds: int(k.LeaseDuration / time.Second),
+				AcquireTime:          now.Format(leaseTimeFormat),
+				RenewTime:            now.Format(leaseTimeFormat),
+			},
+		})
+		if errors.Is(err, errLeaseConflict) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	holder := current.Spec.HolderIdentity
+	if holder != "" && holder != k.Identity && !current.expired(now) {
+		return false, nil
+	}
+
+	if holder != k.Identity {
+		current.Spec.HolderIdentity = k.Identity
+		current.Spec.AcquireTime = now.Format(leaseTimeFormat)
+		current.Spec.LeaseTransitions++
+	}
+	current.Spec.RenewTime = now.Format(leaseTimeFormat)
+	current.Spec.LeaseDurationSeconds = int(k.LeaseDuration / time.Second)
+
+	// the resource version makes the update fail if another replica got there
+	// first
+	_, err = k.do(ctx, http.MethodPut, k.leasesURL()+"/"+k.Name, current)
+	if errors.Is(err, errLeaseConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (k *KubernetesLeaseElector) Release(ctx context.Context) error {
+	current, err := k.do(ctx, http.MethodGet, k.leasesURL()+"/"+k.Name, nil)
+	if err != nil || current == nil || current.Spec.HolderIdentity != k.Identity {
+		return err
+	}
+
+	current.Spec.HolderIdentity = ""
+	_, err = k.do(ctx, http.MethodPut, k.leasesURL()+"/"+k.Name, current)
+	return err
+}
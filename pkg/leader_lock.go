@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func tryLockFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error locking leader lock file, %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,10 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+)
+
+func tryLockFile(f *os.File) (bool, error) {
+	return false, errors.New("file lock leader election is not supported on windows")
+}
@@ -0,0 +1,212 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestFileLockElector(t *testing.T) {
+	path := filepath.Join(filepath.Dir(writeConfigFile(t, "")), "leader.lock")
+	ctx := context.Background()
+
+	a := &FileLockElector{Path: path, Identity: "a"}
+	b := &FileLockElector{Path: path, Identity: "b"}
+
+	leading, err := a.TryAcquireOrRenew(ctx)
+	assert.Nil(t, err)
+	assert.True(t, leading)
+	assert.Equal(t, "a\n", yamlFixture(t, path))
+
+	leading, err = b.TryAcquireOrRenew(ctx)
+	assert.Nil(t, err)
+	assert.False(t, leading)
+
+	leading, err = a.TryAcquireOrRenew(ctx)
+	assert.Nil(t, err)
+	assert.True(t, leading)
+
+	assert.Nil(t, a.Release(ctx))
+	leading, err = b.TryAcquireOrRenew(ctx)
+	assert.Nil(t, err)
+	assert.True(t, leading)
+	assert.Equal(t, "b\n", yamlFixture(t, path))
+}
+
+// fakeLeaseAPI is just enough of the Kubernetes API to hold one lease.
+type fakeLeaseAPI struct {
+	mu      sync.Mutex
+	lease   *lease
+	version int
+}
+
+func (f *fakeLeaseAPI) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer some-token" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var body lease
+	if r.Method != http.MethodGet {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/apis/coordination.k8s.io/v1/namespaces/monitoring/leases/cardinanny":
+		if f.lease == nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+	case r.Method == http.MethodPost && r.URL.Path == "/apis/coordination.k8s.io/v1/namespaces/monitoring/leases":
+		if f.lease != nil {
+			rw.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.version++
+		body.Metadata.ResourceVersion = strconv.Itoa(f.version)
+		f.lease = &body
+	case r.Method == http.MethodPut && r.URL.Path == "/apis/coordination.k8s.io/v1/namespaces/monitoring/leases/cardinanny":
+		if f.lease == nil || body.Metadata.ResourceVersion != f.lease.Metadata.ResourceVersion {
+			rw.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.version++
+		body.Metadata.ResourceVersion = strconv.Itoa(f.version)
+		f.lease = &body
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(rw).Encode(f.lease)
+}
+
+func TestKubernetesLeaseElector(t *testing.T) {
+	api := &fakeLeaseAPI{}
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	tokenFile := writeConfigFile(t, "some-token\n")
+	elector := func(identity string) *KubernetesLeaseElector {
+		return &KubernetesLeaseElector{
+			HTTPClient:    ts.Client(),
+			BaseURL:       ts.URL,
+			TokenFile:     tokenFile,
+			Namespace:     "monitoring",
+			Name:          "cardinanny",
+			Identity:      identity,
+			LeaseDuration: 15 * time.Second,
+		}
+	}
+	a, b := elector("a"), elector("b")
+	ctx := context.Background()
+
+	leading, err := a.TryAcquireOrRenew(ctx)
+	assert.Nil(t, err)
+	assert.True(t, leading)
+	assert.Equal(t, "a", api.lease.Spec.HolderIdentity)
+	assert.Equal(t, 15, api.lease.Spec.LeaseDurationSeconds)
+
+	leading, err = b.TryAcquireOrRenew(ctx)
+	assert.Nil(t, err)
+	assert.False(t, leading)
+
+	leading, err = a.TryAcquireOrRenew(ctx)
+	assert.Nil(t, err)
+	assert.True(t, leading)
+
+	// a stops renewing
+	api.lease.Spec.RenewTime = time.Now().Add(-time.Minute).Format(leaseTimeFormat)
+	leading, err = b.TryAcquireOrRenew(ctx)
+	assert.Nil(t, err)
+	assert.True(t, leading)
+	assert.Equal(t, "b", api.lease.Spec.HolderIdentity)
+	assert.Equal(t, 1, api.lease.Spec.LeaseTransitions)
+
+	leading, err = a.TryAcquireOrRenew(ctx)
+	assert.Nil(t, err)
+	assert.False(t, leading)
+
+	assert.Nil(t, b.Release(ctx))
+	assert.Equal(t, "", api.lease.Spec.HolderIdentity)
+	leading, err = a.TryAcquireOrRenew(ctx)
+	assert.Nil(t, err)
+	assert.True(t, leading)
+}
+
+func TestKubernetesLeaseElector_conflict(t *testing.T) {
+	api := &fakeLeaseAPI{}
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			// another replica updated the lease since it was read
+			api.mu.Lock()
+			api.version++
+			api.lease.Metadata.ResourceVersion = strconv.Itoa(api.version)
+			api.mu.Unlock()
+		}
+		api.ServeHTTP(rw, r)
+	}))
+	defer ts.Close()
+
+	api.lease = &lease{Metadata: leaseMetadata{Name: "cardinanny", Namespace: "monitoring", ResourceVersion: "0"}}
+	elector := &KubernetesLeaseElector{
+		HTTPClient:    ts.Client(),
+		BaseURL:       ts.URL,
+		TokenFile:     writeConfigFile(t, "some-token"),
+		Namespace:     "monitoring",
+		Name:          "cardinanny",
+		Identity:      "a",
+		LeaseDuration: 15 * time.Second,
+	}
+
+	leading, err := elector.TryAcquireOrRenew(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, leading)
+}
+
+func TestLeadership_Run(t *testing.T) {
+	var nobody *Leadership
+	assert.True(t, nobody.IsLeader())
+
+	path := filepath.Join(filepath.Dir(writeConfigFile(t, "")), "leader.lock")
+	holder := &FileLockElector{Path: path, Identity: "holder"}
+	leading, err := holder.TryAcquireOrRenew(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, leading)
+
+	l := &Leadership{
+		Logger:      zap.NewNop().Sugar(),
+		Elector:     &FileLockElector{Path: path, Identity: "follower"},
+		RetryPeriod: 10 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.Run(ctx)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, l.IsLeader())
+
+	assert.Nil(t, holder.Release(context.Background()))
+	assert.Eventually(t, l.IsLeader, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+	assert.False(t, l.IsLeader())
+}
@@ -0,0 +1,48 @@
+package pkg
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ConfigDrift = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cardinanny_config_drift",
+		Help: "1 if the prometheus config file on disk differs from the config prometheus is running.",
+	}, []string{"instance"})
+
+	ConfigDriftRefused = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cardinanny_config_drift_refused_total",
+		Help: "Config changes not made because the prometheus config file on disk had drifted.",
+	}, []string{"instance"})
+
+	ConfigReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cardinanny_config_reloads_total",
+		Help: "Prometheus config reloads by result, success once prometheus runs the new config, failed if the reload request failed and timeout if it never ran it.",
+	}, []string{"instance", "result"})
+
+	LabelOutcomes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cardinanny_label_status",
+		Help: "1 for the current status of each high cardinality label of a job: found, remediated or failed. The job is empty for labels whose jobs could not be queried.",
+	}, []string{"instance", "job", "label", "status"})
+
+	RemediationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cardinanny_remediation_failures_total",
+		Help: "High cardinality labels which failed to be remediated, by the step they failed at: scan, config or clean.",
+	}, []string{"instance", "step"})
+
+	APIRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cardinanny_prometheus_api_retries_total",
+		Help: "Prometheus API calls retried after a transient error, by call.",
+	}, []string{"instance", "call"})
+
+	RemediationPaused = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cardinanny_remediation_paused",
+		Help: "1 while label drops are paused because a remediation limit was hit, until they are resumed by hand.",
+	}, []string{"instance"})
+
+	Leader = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cardinanny_leader",
+		Help: "1 if this cardinanny replica is the leader and makes changes.",
+	})
+)
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+type NotificationEvent string
+
+const (
+	NotifyProposed NotificationEvent = "proposed"
+	NotifyApplied  NotificationEvent = "applied"
+	NotifyReverted NotificationEvent = "reverted"
+	NotifyPaused   NotificationEvent = "paused"
+)
+
+type Notification struct {
+	Instance string            `json:"instance"`
+	Event    NotificationEvent `json:"event"`
+	Time     time.Time         `json:"time"`
+	Message  string            `json:"message"`
+	Plan     *Plan             `json:"plan,omitempty"`
+}
+
+// Notifier tells people about config changes cardinanny makes or proposes.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// WebhookNotifier posts notifications as JSON to a URL.
+type WebhookNotifier struct {
+	HTTPClient *http.Client
+	URL        string
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := w.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending notification to webhook, %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("expected a 2xx status code from %s but was %d, body: %s", w.URL, resp.StatusCode, body)
+	}
+	return nil
+}
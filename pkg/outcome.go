@@ -0,0 +1,321 @@
+package pkg
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type OutcomeStatus string
+
+const (
+	OutcomeFound      OutcomeStatus = "found"
+	OutcomePending    OutcomeStatus = "pending"
+	OutcomeBlocked    OutcomeStatus = "blocked"
+	OutcomeRemediated OutcomeStatus = "remediated"
+	OutcomeFailed     OutcomeStatus = "failed"
+)
+
+// The steps of a remediation a label can fail at.
+const (
+	StepScan   = "scan"
+	StepConfig = "config"
+	StepClean  = "clean"
+)
+
+const (
+	DefaultRetryBackoff    = 2 * time.Minute
+	DefaultMaxRetryBackoff = time.Hour
+)
+
+// LabelOutcome is what happened to a high cardinality label of a job.
+type LabelOutcome struct {
+	Job    string        `json:"job,omitempty"`
+	Label  string        `json:"label"`
+	Status OutcomeStatus `json:"status"`
+	// Step and Reason say what failed, Attempts how many times in a row.
+	Step      string     `json:"step,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Attempts  int        `json:"attempts,omitempty"`
+	RetryAt   *time.Time `json:"retryAt,omitempty"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+// RemediationOutcomes tracks every high cardinality label of an instance
+// through the scan, config change and cleaning, so one failing label does not
+// hold the others back and only the failures are retried, with an exponential
+// backoff.
+type RemediationOutcomes struct {
+	Instance string
+	// Backoff is how long the first retry waits, doubling up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	mu sync.Mutex
+	// jobs has the labels found in each job, unscanned the labels whose jobs
+	// could not be queried.
+	jobs      map[string]map[string]*LabelOutcome
+	unscanned map[string]*LabelOutcome
+	now       func() time.Time
+}
+
+func (o *RemediationOutcomes) clock() time.Time {
+	if o.now != nil {
+		return o.now()
+	}
+	return time.Now()
+}
+
+func (o *RemediationOutcomes) backoff(attempts int) time.Duration {
+	backoff, max := o.Backoff, o.MaxBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxRetryBackoff
+	}
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
+
+func (o *RemediationOutcomes) outcome(job, label string) *LabelOutcome {
+	if o.jobs == nil {
+		o.jobs = map[string]map[string]*LabelOutcome{}
+	}
+	if o.jobs[job] == nil {
+		o.jobs[job] = map[string]*LabelOutcome{}
+	}
+	out, ok := o.jobs[job][label]
+	if !ok {
+		out = &LabelOutcome{Job: job, Label: label}
+		o.jobs[job][label] = out
+	}
+	return out
+}
+
+func (o *RemediationOutcomes) set(out *LabelOutcome, status OutcomeStatus) {
+	if out.Status != status {
+		if out.Status != "" {
+			LabelOutcomes.DeleteLabelValues(o.Instance, out.Job, out.Label, string(out.Status))
+		}
+		LabelOutcomes.WithLabelValues(o.Instance, out.Job, out.Label, string(status)).Set(1)
+	}
+	out.Status = status
+	out.UpdatedAt = o.clock()
+	if status != OutcomeFailed {
+		out.Step, out.Reason, out.Attempts, out.RetryAt = "", "", 0, nil
+	}
+}
+
+func (o *RemediationOutcomes) fail(out *LabelOutcome, step string, err error) {
+	o.set(out, OutcomeFailed)
+	out.Step = step
+	out.Reason = err.Error()
+	out.Attempts++
+	retryAt := out.UpdatedAt.Add(o.backoff(out.Attempts))
+	out.RetryAt = &retryAt
+	RemediationFailures.WithLabelValues(o.Instance, step).Inc()
+}
+
+// Scanned records the labels found by a scan, leaving the ones already being
+// remediated alone, and the labels whose jobs could not be queried.
+func (o *RemediationOutcomes) Scanned(found map[string][]string, failed map[string]error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for job, labels := range found {
+		for _, label := range labels {
+			if out := o.outcome(job, label); out.Status == "" {
+				o.set(out, OutcomeFound)
+			}
+		}
+	}
+
+	previous := o.unscanned
+	o.unscanned = map[string]*LabelOutcome{}
+	for label, err := range failed {
+		out, ok := previous[label]
+		if !ok {
+			out = &LabelOutcome{Label: label}
+		}
+		o.fail(out, StepScan, err)
+		o.unscanned[label] = out
+	}
+	for label, out := range previous {
+		if _, ok := o.unscanned[label]; !ok {
+			LabelOutcomes.DeleteLabelValues(o.Instance, "", label, string(out.Status))
+		}
+	}
+}
+
+// Remediated records the labels dropped and, when the admin API is there,
+// cleaned.
+func (o *RemediationOutcomes) Remediated(jobs map[string][]string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for job, labels := range jobs {
+		for _, label := range labels {
+			o.set(o.outcome(job, label), OutcomeRemediated)
+		}
+	}
+}
+
+// AlreadyRemediated records the labels the config already drops, keeping the
+// ones whose series still have to be cleaned as they were.
+func (o *RemediationOutcomes) AlreadyRemediated(jobs map[string][]string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for job, labels := range jobs {
+		for _, label := range labels {
+			if out := o.outcome(job, label); out.Status != OutcomeFailed || out.Step != StepClean {
+				o.set(out, OutcomeRemediated)
+			}
+		}
+	}
+}
+
+// Pending records the labels held back by a remediation limit.
+func (o *RemediationOutcomes) Pending(jobs map[string][]string, reason string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for job, labels := range jobs {
+		for _, label := range labels {
+			out := o.outcome(job, label)
+			o.set(out, OutcomePending)
+			out.Reason = reason
+		}
+	}
+}
+
+// Blocked records the labels which are not dropped because of what uses
+// them, unless they were dropped before.
+func (o *RemediationOutcomes) Blocked(jobs map[string][]string, impacts []Impact) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for job, labels := range jobs {
+		for _, label := range labels {
+			out := o.outcome(job, label)
+			if out.Status == OutcomeRemediated {
+				continue
+			}
+			o.set(out, OutcomeBlocked)
+			out.Reason = ImpactReason(impacts, job, label)
+		}
+	}
+}
+
+// Failed records the labels which failed at a step, to be retried once their
+// backoff is over.
+func (o *RemediationOutcomes) Failed(step string, jobs map[string][]string, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for job, labels := range jobs {
+		for _, label := range labels {
+			o.fail(o.outcome(job, label), step, err)
+		}
+	}
+}
+
+// Forget removes labels which are no longer dropped.
+func (o *RemediationOutcomes) Forget(job string, labels []string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, label := range labels {
+		if out, ok := o.jobs[job][label]; ok {
+			LabelOutcomes.DeleteLabelValues(o.Instance, job, label, string(out.Status))
+			delete(o.jobs[job], label)
+		}
+	}
+	if len(o.jobs[job]) == 0 {
+		delete(o.jobs, job)
+	}
+}
+
+// Ready leaves out the labels which failed and are still backing off.
+func (o *RemediationOutcomes) Ready(jobs map[string][]string) (map[string][]string, map[string][]string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := o.clock()
+	ready := map[string][]string{}
+	waiting := map[string][]string{}
+	for job, labels := range jobs {
+		for _, label := range labels {
+			out, ok := o.jobs[job][label]
+			if ok && out.Status == OutcomeFailed && out.RetryAt != nil && now.Before(*out.RetryAt) {
+				waiting[job] = append(waiting[job], label)
+				continue
+			}
+			ready[job] = append(ready[job], label)
+		}
+	}
+	return ready, waiting
+}
+
+// Due returns the labels which failed at a step and are done backing off.
+func (o *RemediationOutcomes) Due(step string) map[string][]string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := o.clock()
+	due := map[string][]string{}
+	for _, job := range sortedOutcomeJobs(o.jobs) {
+		for _, out := range sortedOutcomes(o.jobs[job]) {
+			if out.Status == OutcomeFailed && out.Step == step && (out.RetryAt == nil || !now.Before(*out.RetryAt)) {
+				due[job] = append(due[job], out.Label)
+			}
+		}
+	}
+	return due
+}
+
+// OutcomesSnapshot is the state of every label, for /summary.
+type OutcomesSnapshot struct {
+	Jobs      map[string][]LabelOutcome `json:"jobs"`
+	Unscanned []LabelOutcome            `json:"unscanned,omitempty"`
+}
+
+func (o *RemediationOutcomes) Snapshot() OutcomesSnapshot {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	s := OutcomesSnapshot{Jobs: map[string][]LabelOutcome{}}
+	for job, labels := range o.jobs {
+		for _, out := range sortedOutcomes(labels) {
+			s.Jobs[job] = append(s.Jobs[job], *out)
+		}
+	}
+	for _, out := range sortedOutcomes(o.unscanned) {
+		s.Unscanned = append(s.Unscanned, *out)
+	}
+	return s
+}
+
+func sortedOutcomeJobs(jobs map[string]map[string]*LabelOutcome) []string {
+	var names []string
+	for job := range jobs {
+		names = append(names, job)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedOutcomes(labels map[string]*LabelOutcome) []*LabelOutcome {
+	var outs []*LabelOutcome
+	for _, out := range labels {
+		outs = append(outs, out)
+	}
+	sort.Slice(outs, func(i, j int) bool { return outs[i].Label < outs[j].Label })
+	return outs
+}
@@ -0,0 +1,80 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemediationOutcomes_retriesFailuresWithBackoff(t *testing.T) {
+	now := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	o := &RemediationOutcomes{Instance: "outcomes-test", Backoff: time.Minute, MaxBackoff: 3 * time.Minute, now: func() time.Time { return now }}
+
+	o.Scanned(map[string][]string{"api": {"user_id", "request_id"}, "worker": {"task_id"}}, nil)
+	o.Failed(StepClean, map[string][]string{"api": {"user_id", "request_id"}}, errors.New("some-error"))
+	o.Remediated(map[string][]string{"worker": {"task_id"}})
+
+	found := map[string][]string{"api": {"request_id", "user_id"}, "worker": {"task_id"}}
+	ready, waiting := o.Ready(found)
+	assert.Equal(t, map[string][]string{"worker": {"task_id"}}, ready)
+	assert.Equal(t, map[string][]string{"api": {"request_id", "user_id"}}, waiting)
+	assert.Equal(t, map[string][]string{}, o.Due(StepClean))
+
+	now = now.Add(time.Minute)
+	ready, _ = o.Ready(found)
+	assert.Equal(t, found, ready)
+	assert.Equal(t, map[string][]string{"api": {"request_id", "user_id"}}, o.Due(StepClean))
+	assert.Equal(t, map[string][]string{}, o.Due(StepConfig))
+
+	// the backoff doubles up to the max
+	for _, backoff := range []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		o.Failed(StepClean, map[string][]string{"api": {"user_id"}}, errors.New("some-error"))
+		out := o.Snapshot().Jobs["api"][1]
+		assert.Equal(t, now.Add(backoff), *out.RetryAt)
+	}
+
+	o.Remediated(map[string][]string{"api": {"user_id"}})
+	s := o.Snapshot()
+	assert.Equal(t, []LabelOutcome{
+		{Job: "api", Label: "request_id", Status: OutcomeFailed, Step: StepClean, Reason: "some-error", Attempts: 1, RetryAt: s.Jobs["api"][0].RetryAt, UpdatedAt: now.Add(-time.Minute)},
+		{Job: "api", Label: "user_id", Status: OutcomeRemediated, UpdatedAt: now},
+	}, s.Jobs["api"])
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(LabelOutcomes.WithLabelValues("outcomes-test", "api", "user_id", "remediated")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(LabelOutcomes.WithLabelValues("outcomes-test", "api", "request_id", "failed")))
+}
+
+func TestRemediationOutcomes_alreadyRemediatedKeepsCleaningFailures(t *testing.T) {
+	o := &RemediationOutcomes{Instance: "outcomes-test"}
+
+	o.Scanned(map[string][]string{"api": {"user_id", "request_id"}}, nil)
+	o.Failed(StepConfig, map[string][]string{"api": {"user_id"}}, errors.New("config-error"))
+	o.Failed(StepClean, map[string][]string{"api": {"request_id"}}, errors.New("clean-error"))
+
+	o.AlreadyRemediated(map[string][]string{"api": {"user_id", "request_id"}})
+	s := o.Snapshot()
+	assert.Equal(t, OutcomeFailed, s.Jobs["api"][0].Status)
+	assert.Equal(t, OutcomeRemediated, s.Jobs["api"][1].Status)
+
+	o.Forget("api", []string{"user_id", "request_id"})
+	assert.Empty(t, o.Snapshot().Jobs)
+}
+
+func TestRemediationOutcomes_unscannedLabels(t *testing.T) {
+	o := &RemediationOutcomes{Instance: "outcomes-test"}
+
+	o.Scanned(map[string][]string{}, map[string]error{"user_id": errors.New("some-error")})
+	o.Scanned(map[string][]string{}, map[string]error{"user_id": errors.New("some-error")})
+	s := o.Snapshot()
+	assert.Len(t, s.Unscanned, 1)
+	assert.Equal(t, StepScan, s.Unscanned[0].Step)
+	assert.Equal(t, 2, s.Unscanned[0].Attempts)
+
+	o.Scanned(map[string][]string{"api": {"user_id"}}, nil)
+	s = o.Snapshot()
+	assert.Empty(t, s.Unscanned)
+	assert.Equal(t, []LabelOutcome{{Job: "api", Label: "user_id", Status: OutcomeFound, UpdatedAt: s.Jobs["api"][0].UpdatedAt}}, s.Jobs["api"])
+}
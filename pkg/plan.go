@@ -0,0 +1,314 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	plog "github.com/go-kit/log"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/prometheus/prometheus/config"
+)
+
+var (
+	ErrPlanOutdated = errors.New("the prometheus config changed since the plan was made")
+	ErrPlanMismatch = errors.New("the planned config does not match the planned changes")
+	ErrPlanInstance = errors.New("the plan was made for another instance")
+)
+
+// JobPlan is what a plan changes in the labeldrop rule of one job. Added
+// labels go into a new rule, merged ones into the rule the job already has.
+// Scoped labels are only dropped from some of the job's instances.
+type JobPlan struct {
+	Job     string       `json:"job"`
+	Added   []string     `json:"added,omitempty"`
+	Merged  []string     `json:"merged,omitempty"`
+	Scoped  []ScopedDrop `json:"scoped,omitempty"`
+	Removed []string     `json:"removed,omitempty"`
+	// Impacts lists the rules the dropped labels break.
+	Impacts []Impact `json:"impacts,omitempty"`
+}
+
+// Plan is a config change worked out against the running config, which can
+// be reviewed and applied later as long as that config has not changed.
+type Plan struct {
+	Instance       string    `json:"instance,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	BaseConfigHash string    `json:"baseConfigHash"`
+	BaseFileHash   string    `json:"baseFileHash,omitempty"`
+	Jobs           []JobPlan `json:"jobs"`
+	Diff           string    `json:"diff"`
+	Config         string    `json:"config"`
+}
+
+func configHash(yaml string) string {
+	h := sha256.Sum256([]byte(yaml))
+	return hex.EncodeToString(h[:])
+}
+
+func (p *Plan) Empty() bool {
+	return len(p.Jobs) == 0
+}
+
+// Dropped returns the labels the plan drops per job.
+func (p *Plan) Dropped() map[string][]string {
+	result := map[string][]string{}
+	for _, j := range p.Jobs {
+		labels := append(append([]string{}, j.Added...), j.Merged...)
+		for _, d := range j.Scoped {
+			if !containsString(labels, d.Label) {
+				labels = append(labels, d.Label)
+			}
+		}
+		if len(labels) > 0 {
+			result[j.Job] = labels
+		}
+	}
+	return result
+}
+
+// edits returns the labels the plan adds to new rules, merges into existing
+// ones and drops from some instances, per job.
+func (p *Plan) edits() (map[string][]string, map[string][]string, map[string][]ScopedDrop) {
+	added := map[string][]string{}
+	merged := map[string][]string{}
+	scoped := map[string][]ScopedDrop{}
+	for _, j := range p.Jobs {
+		if len(j.Added) > 0 {
+			added[j.Job] = j.Added
+		}
+		if len(j.Merged) > 0 {
+			merged[j.Job] = j.Merged
+		}
+		if len(j.Scoped) > 0 {
+			scoped[j.Job] = j.Scoped
+		}
+	}
+	return added, merged, scoped
+}
+
+// Restored returns the labels the plan stops dropping per job.
+func (p *Plan) Restored() map[string][]string {
+	result := map[string][]string{}
+	for _, j := range p.Jobs {
+		if len(j.Removed) > 0 {
+			result[j.Job] = j.Removed
+		}
+	}
+	return result
+}
+
+// HistoryEntries makes the entries recording the plan was applied.
+func (p *Plan) HistoryEntries() []HistoryEntry {
+	entries := DropEntries(p.Instance, p.Dropped())
+	restored := p.Restored()
+	for _, j := range sortedJobs(restored) {
+		entries = append(entries, HistoryEntry{
+			Instance: p.Instance,
+			Action:   HistoryRevert,
+			Job:      j,
+			Labels:   restored[j],
+		})
+	}
+	return entries
+}
+
+// Change is what applying the plan changes, for commit messages and to find
+// the branch it is proposed on.
+func (p *Plan) Change() ConfigChange {
+	dropped, restored := p.Dropped(), p.Restored()
+	switch {
+	case len(restored) == 0:
+		return DropChange(dropped)
+	case len(dropped) == 0:
+		return ConfigChange{Action: "restore", Jobs: restored}
+	}
+	return ConfigChange{Action: "change", Jobs: MergeJobLabels(dropped, restored)}
+}
+
+func (p *Plan) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+func LoadPlans(path string) ([]*Plan, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading plan file, %w", err)
+	}
+
+	var plans []*Plan
+	if err := json.Unmarshal(b, &plans); err != nil {
+		return nil, fmt.Errorf("error parsing plan file %s, %w", path, err)
+	}
+	return plans, nil
+}
+
+func fileHash(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return configHash(string(b)), nil
+}
+
+// Plan works out the config change which drops and restores the given labels
+// without applying it. Only the relabel rules are edited, the rest of the
+// config document is kept as it was written.
+func (p *PromConfigRewriter) Plan(ctx context.Context, labelsToDrop map[string][]string, labelsToRestore map[string][]string, configPath string) (*Plan, error) {
+	running, doc, err := p.baseConfig(ctx, configPath)
+	if err != nil {
+		return nil, err
+	}
+	cfgFile, err := config.Load(doc, false, plog.NewNopLogger())
+	if err != nil {
+		return nil, fmt.Errorf("error parsing prometheus config, %w", err)
+	}
+	if len(labelsToDrop) > 0 && len(cfgFile.ScrapeConfigs) == 0 {
+		return nil, fmt.Errorf("had labels to drop %v, but no scrapeConfigs in config file at %s", labelsToDrop, configPath)
+	}
+	baseFileHash, err := fileHash(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := map[string]*JobPlan{}
+	jobPlan := func(job string) *JobPlan {
+		if _, ok := jobs[job]; !ok {
+			jobs[job] = &JobPlan{Job: job}
+		}
+		return jobs[job]
+	}
+
+	for _, job := range sortedJobs(labelsToRestore) {
+		removed, err := removeLabelDrops(job, labelsToRestore[job], cfgFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(removed) > 0 {
+			jobPlan(job).Removed = removed
+		}
+	}
+
+	jobWide, scopedDrops := p.scope(labelsToDrop)
+	added, merged := addLabelDrops(jobWide, cfgFile)
+	scoped := addScopedDrops(scopedDrops, cfgFile)
+	for job, labels := range added {
+		jobPlan(job).Added = labels
+	}
+	for job, labels := range merged {
+		jobPlan(job).Merged = labels
+	}
+	for job, drops := range scoped {
+		jobPlan(job).Scoped = drops
+	}
+
+	plan := &Plan{
+		CreatedAt:      time.Now(),
+		BaseConfigHash: configHash(running),
+		BaseFileHash:   baseFileHash,
+		Jobs:           []JobPlan{},
+		Config:         running,
+	}
+	if len(jobs) == 0 {
+		return plan, nil
+	}
+
+	for _, j := range jobs {
+		plan.Jobs = append(plan.Jobs, *j)
+	}
+	sort.Slice(plan.Jobs, func(i, j int) bool { return plan.Jobs[i].Job < plan.Jobs[j].Job })
+
+	plan.Config, err = editConfigDocument(doc, added, merged, scoped, plan.Restored())
+	if err != nil {
+		return nil, fmt.Errorf("error editing prometheus config, %w", err)
+	}
+	// Both are loaded again so the defaults of the new relabel rules are filled
+	// in the same way.
+	planned, err := config.Load(plan.Config, false, plog.NewNopLogger())
+	if err != nil {
+		return nil, fmt.Errorf("planned config is invalid, %w", err)
+	}
+	want, err := config.Load(cfgFile.String(), false, plog.NewNopLogger())
+	if err != nil {
+		return nil, fmt.Errorf("planned config is invalid, %w", err)
+	}
+	if planned.String() != want.String() {
+		return nil, fmt.Errorf("planned config does not match the planned changes")
+	}
+	if err := checkNoRedactedSecrets(plan.Config); err != nil {
+		return nil, err
+	}
+
+	plan.Diff, err = difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(doc),
+		B:        difflib.SplitLines(plan.Config),
+		FromFile: "current",
+		ToFile:   "planned",
+		Context:  3,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// ApplyPlan writes and applies the planned config, unless the running config
+// is no longer the one the plan was made against.
+func (p *PromConfigRewriter) ApplyPlan(ctx context.Context, plan *Plan, configPath string) error {
+	if plan.Empty() {
+		return nil
+	}
+
+	running, cfgFile, err := p.getConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if configHash(running) != plan.BaseConfigHash {
+		return fmt.Errorf("%w, expected config hash %s but was %s", ErrPlanOutdated, plan.BaseConfigHash, configHash(running))
+	}
+	current, err := fileHash(configPath)
+	if err != nil {
+		return err
+	}
+	if current != plan.BaseFileHash {
+		return fmt.Errorf("%w, config file %s was modified", ErrPlanOutdated, configPath)
+	}
+	doc, err := p.baseDocument(running, cfgFile, configPath)
+	if err != nil {
+		return err
+	}
+	// The config is worked out again from the plan's changes rather than
+	// trusted, so what is written is what the history and notifications say.
+	added, merged, scoped := plan.edits()
+	want, err := editConfigDocument(doc, added, merged, scoped, plan.Restored())
+	if err != nil {
+		return fmt.Errorf("error editing prometheus config, %w", err)
+	}
+	if want != plan.Config {
+		return ErrPlanMismatch
+	}
+	if err := checkNoRedactedSecrets(plan.Config); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(configPath, []byte(plan.Config), 0644); err != nil {
+		return err
+	}
+
+	p.Logger.Debugw("Config file written from plan", "jobs", plan.Jobs)
+
+	return p.applyConfigChange(ctx, configPath, plan.Change())
+}
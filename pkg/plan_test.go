@@ -0,0 +1,187 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	plog "github.com/go-kit/log"
+	"github.com/golang/mock/gomock"
+	"github.com/mclarke47/cardinanny/mock_v1"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/prometheus/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// runningConfig is the fixture as the prometheus config API returns it.
+func runningConfig(t *testing.T, fixture string) string {
+	cfg, err := config.Load(yamlFixture(t, fixture), false, plog.NewNopLogger())
+	assert.Nil(t, err)
+	return cfg.String()
+}
+
+func planRewriter(t *testing.T, reload http.HandlerFunc, running ...string) PromConfigRewriter {
+	ts := httptest.NewServer(reload)
+	t.Cleanup(ts.Close)
+
+	ctrl := gomock.NewController(t)
+	m := mock_v1.NewMockAPI(ctrl)
+	for _, r := range running {
+		m.
+			EXPECT().
+			Config(gomock.Any()).
+			Return(v1.ConfigResult{YAML: r}, nil)
+	}
+
+	return PromConfigRewriter{
+		PromAPI:    m,
+		HTTPClient: ts.Client(),
+		BaseURL:    ts.URL,
+		Logger:     zap.NewNop().Sugar(),
+	}
+}
+
+func TestPromConfigRewriter_Plan(t *testing.T) {
+	running := runningConfig(t, "./fixtures/2-scrape-jobs-expected-1-label.yaml")
+	writer := planRewriter(t, nil, running)
+
+	plan, err := writer.Plan(context.Background(), map[string][]string{
+		"some-job":       {"somevalue", "anotherBadLabel"},
+		"some-other-job": {"somevalue"},
+	}, nil, "../some/path")
+	assert.Nil(t, err)
+
+	assert.Equal(t, configHash(running), plan.BaseConfigHash)
+	assert.Equal(t, []JobPlan{
+		{Job: "some-job", Merged: []string{"anotherBadLabel"}},
+		{Job: "some-other-job", Added: []string{"somevalue"}},
+	}, plan.Jobs)
+	assert.Equal(t, map[string][]string{
+		"some-job":       {"anotherBadLabel"},
+		"some-other-job": {"somevalue"},
+	}, plan.Dropped())
+
+	assert.True(t, strings.HasPrefix(plan.Diff, "--- current\n+++ planned\n"))
+	assert.Contains(t, plan.Diff, "-    regex: somevalue\n+    regex: somevalue|anotherBadLabel\n")
+	assert.Contains(t, plan.Diff, "+  metric_relabel_configs:\n+  - regex: somevalue\n+    action: labeldrop\n")
+
+	planned, err := config.Load(plan.Config, false, plog.NewNopLogger())
+	assert.Nil(t, err)
+	for i, expected := range [][]string{{"somevalue", "anotherBadLabel"}, {"somevalue"}} {
+		assert.Len(t, planned.ScrapeConfigs[i].MetricRelabelConfigs, 1)
+		names, ok := regexLabelNames(planned.ScrapeConfigs[i].MetricRelabelConfigs[0].Regex)
+		assert.True(t, ok)
+		assert.Equal(t, expected, names)
+	}
+}
+
+func TestPromConfigRewriter_PlanAlreadyDropped(t *testing.T) {
+	running := runningConfig(t, "./fixtures/2-scrape-jobs-expected-2-label.yaml")
+	writer := planRewriter(t, nil, running)
+
+	plan, err := writer.Plan(context.Background(), map[string][]string{"some-job": {"somevalue"}}, nil, "../some/path")
+	assert.Nil(t, err)
+	assert.True(t, plan.Empty())
+	assert.Equal(t, "", plan.Diff)
+}
+
+func TestPromConfigRewriter_ApplyPlan(t *testing.T) {
+	running := yamlFixture(t, "./fixtures/2-scrape-jobs.yaml")
+
+	reloads := 0
+	writer := planRewriter(t, func(rw http.ResponseWriter, r *http.Request) {
+		reloads++
+		rw.WriteHeader(http.StatusOK)
+	}, running, running)
+
+	configFile, err := ioutil.TempFile("", "prometheus.yml")
+	assert.Nil(t, err)
+	defer os.Remove(configFile.Name())
+
+	expectReload(writer.PromAPI.(*mock_v1.MockAPI), configFile.Name())
+	plan, err := writer.Plan(context.Background(), map[string][]string{"some-job": {"somevalue"}}, nil, configFile.Name())
+	assert.Nil(t, err)
+
+	// plans are saved and applied later
+	b, err := json.Marshal([]*Plan{plan})
+	assert.Nil(t, err)
+	planFile, err := ioutil.TempFile("", "plans.json")
+	assert.Nil(t, err)
+	defer os.Remove(planFile.Name())
+	assert.Nil(t, ioutil.WriteFile(planFile.Name(), b, 0644))
+
+	plans, err := LoadPlans(planFile.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, plan.Jobs, plans[0].Jobs)
+
+	assert.Nil(t, writer.ApplyPlan(context.Background(), plans[0], configFile.Name()))
+	assert.Equal(t, 1, reloads)
+	assertConfigFilesAreEqual(t, "./fixtures/2-scrape-jobs-expected-1-label.yaml", configFile)
+}
+
+func TestPromConfigRewriter_ApplyOutdatedPlan(t *testing.T) {
+	writer := planRewriter(t, func(rw http.ResponseWriter, r *http.Request) {
+		t.Error("prometheus must not be reloaded")
+	}, runningConfig(t, "./fixtures/2-scrape-jobs.yaml"), runningConfig(t, "./fixtures/2-scrape-jobs-expected-1-label.yaml"))
+
+	plan, err := writer.Plan(context.Background(), map[string][]string{"some-job": {"anotherBadLabel"}}, nil, "../some/path")
+	assert.Nil(t, err)
+
+	err = writer.ApplyPlan(context.Background(), plan, "../some/path")
+	assert.True(t, errors.Is(err, ErrPlanOutdated))
+}
+
+func TestPromConfigRewriter_ApplyTamperedPlan(t *testing.T) {
+	running := yamlFixture(t, "./fixtures/2-scrape-jobs.yaml")
+	writer := planRewriter(t, func(rw http.ResponseWriter, r *http.Request) {
+		t.Error("prometheus must not be reloaded")
+	}, running, running, running)
+
+	configFile, err := ioutil.TempFile("", "prometheus.yml")
+	assert.Nil(t, err)
+	defer os.Remove(configFile.Name())
+
+	plan, err := writer.Plan(context.Background(), map[string][]string{"some-job": {"somevalue"}}, nil, configFile.Name())
+	assert.Nil(t, err)
+
+	// a config which isn't what the plan says it changes
+	tampered := *plan
+	tampered.Config = running
+	err = writer.ApplyPlan(context.Background(), &tampered, configFile.Name())
+	assert.True(t, errors.Is(err, ErrPlanMismatch))
+
+	// changes which aren't what the config does
+	tampered = *plan
+	tampered.Jobs = []JobPlan{{Job: "some-job", Added: []string{"anotherBadLabel"}}}
+	err = writer.ApplyPlan(context.Background(), &tampered, configFile.Name())
+	assert.True(t, errors.Is(err, ErrPlanMismatch))
+
+	b, err := ioutil.ReadFile(configFile.Name())
+	assert.Nil(t, err)
+	assert.Empty(t, b)
+}
+
+func TestWebhookNotifier_Notify(t *testing.T) {
+	var received Notification
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	n := WebhookNotifier{HTTPClient: ts.Client(), URL: ts.URL}
+	plan := &Plan{Instance: "default", Jobs: []JobPlan{{Job: "some-job", Added: []string{"somevalue"}}}}
+
+	err := n.Notify(context.Background(), Notification{Instance: "default", Event: NotifyApplied, Plan: plan})
+	assert.Nil(t, err)
+	assert.Equal(t, NotifyApplied, received.Event)
+	assert.Equal(t, plan.Jobs, received.Plan.Jobs)
+}
@@ -0,0 +1,123 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	ReloadAuto   = "auto"
+	ReloadHTTP   = "http"
+	ReloadSignal = "signal"
+	ReloadWait   = "wait"
+)
+
+// Reloader makes prometheus load its config file again.
+type Reloader interface {
+	Reload(ctx context.Context) error
+}
+
+// HTTPReloader uses the /-/reload endpoint, which needs prometheus to run
+// with --web.enable-lifecycle.
+type HTTPReloader struct {
+	HTTPClient *http.Client
+	BaseURL    string
+}
+
+func (h *HTTPReloader) Reload(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/-/reload", h.BaseURL), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := h.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("error when reloading prometheus config, expected status code 200 but was %d, body was unreadable", resp.StatusCode)
+		}
+		return fmt.Errorf("error when reloading prometheus config, expected status code 200 but was %d, body: %s", resp.StatusCode, b)
+	}
+	return nil
+}
+
+// SignalReloader sends SIGHUP to the prometheus process, found through its
+// pid file or by name. It only works when cardinanny shares the process
+// namespace with prometheus.
+type SignalReloader struct {
+	PIDFile     string
+	ProcessName string
+	// ProcDir is where processes are looked up by name, /proc when not set.
+	ProcDir string
+}
+
+func (s *SignalReloader) pid() (int, error) {
+	if s.PIDFile != "" {
+		b, err := ioutil.ReadFile(s.PIDFile)
+		if err != nil {
+			return 0, fmt.Errorf("error reading prometheus pid file, %w", err)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			return 0, fmt.Errorf("error parsing prometheus pid file %s, %w", s.PIDFile, err)
+		}
+		return pid, nil
+	}
+
+	procDir := s.ProcDir
+	if procDir == "" {
+		procDir = "/proc"
+	}
+	comms, err := filepath.Glob(filepath.Join(procDir, "[0-9]*", "comm"))
+	if err != nil {
+		return 0, err
+	}
+	for _, comm := range comms {
+		b, err := ioutil.ReadFile(comm)
+		if err != nil {
+			// the process exited since it was listed
+			continue
+		}
+		if strings.TrimSpace(string(b)) == s.ProcessName {
+			return strconv.Atoi(filepath.Base(filepath.Dir(comm)))
+		}
+	}
+	return 0, fmt.Errorf("no %s process found in %s", s.ProcessName, procDir)
+}
+
+func (s *SignalReloader) Reload(ctx context.Context) error {
+	pid, err := s.pid()
+	if err != nil {
+		return err
+	}
+
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		return fmt.Errorf("error sending SIGHUP to prometheus process %d, %w", pid, err)
+	}
+	return nil
+}
+
+// WaitReloader does nothing, leaving it to a config reloader sidecar to
+// notice the config file changed. The change is still only done once the
+// running config matches the file.
+type WaitReloader struct{}
+
+func (WaitReloader) Reload(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,69 @@
+package pkg
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestSignalReloader_pidFile(t *testing.T) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	pidFile := writeConfigFile(t, strconv.Itoa(os.Getpid())+"\n")
+	reloader := SignalReloader{PIDFile: pidFile}
+	assert.Nil(t, reloader.Reload(context.Background()))
+
+	select {
+	case <-hup:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGHUP was not sent")
+	}
+}
+
+func TestSignalReloader_processName(t *testing.T) {
+	procDir, err := ioutil.TempDir("", "cardinanny-proc")
+	assert.Nil(t, err)
+	defer os.RemoveAll(procDir)
+
+	for pid, comm := range map[string]string{"12": "node_exporter", "34": "prometheus", "self": "cardinanny"} {
+		assert.Nil(t, os.MkdirAll(filepath.Join(procDir, pid), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(procDir, pid, "comm"), []byte(comm+"\n"), 0644))
+	}
+
+	reloader := SignalReloader{ProcessName: "prometheus", ProcDir: procDir}
+	pid, err := reloader.pid()
+	assert.Nil(t, err)
+	assert.Equal(t, 34, pid)
+
+	reloader.ProcessName = "thanos"
+	_, err = reloader.pid()
+	assert.EqualError(t, err, "no thanos process found in "+procDir)
+}
+
+func TestReloadConfig_NewReloader(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	prometheus := Capabilities{TSDBStats: true}
+
+	assert.IsType(t, &HTTPReloader{}, ReloadConfig{Method: ReloadAuto}.NewReloader(Capabilities{TSDBStats: true, Lifecycle: true}, nil, "", logger))
+	assert.IsType(t, &SignalReloader{}, ReloadConfig{Method: ReloadAuto, ProcessName: "prometheus"}.NewReloader(prometheus, nil, "", logger))
+	assert.IsType(t, WaitReloader{}, ReloadConfig{Method: ReloadAuto}.NewReloader(prometheus, nil, "", logger))
+	assert.IsType(t, &HTTPReloader{}, ReloadConfig{Method: ReloadHTTP}.NewReloader(prometheus, nil, "", logger))
+}
+
+func TestReloadConfig_Validate(t *testing.T) {
+	assert.Nil(t, ReloadConfig{Method: ReloadWait}.Validate())
+	assert.Nil(t, ReloadConfig{Method: ReloadSignal, PIDFile: "/run/prometheus.pid"}.Validate())
+	assert.EqualError(t, ReloadConfig{Method: ReloadSignal}.Validate(), "reload method signal needs a pid_file or process_name")
+	assert.EqualError(t, ReloadConfig{Method: "restart"}.Validate(), "unknown reload method restart, expected auto, http, signal or wait")
+}
@@ -0,0 +1,289 @@
+package pkg
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+type LabelReport struct {
+	Name       string            `json:"name"`
+	ValueCount uint64            `json:"valueCount"`
+	OverLimit  bool              `json:"overLimit"`
+	Jobs       map[string]uint64 `json:"jobs,omitempty"`
+}
+
+// Report is a point in time snapshot of label cardinality which can be saved
+// and compared against later.
+type Report struct {
+	GeneratedAt time.Time      `json:"generatedAt"`
+	LabelLimit  uint64         `json:"labelLimit"`
+	Labels      []LabelReport  `json:"labels"`
+	TopMetrics  []v1.Stat      `json:"topMetrics,omitempty"`
+	TSDB        *v1.TSDBResult `json:"tsdb,omitempty"`
+}
+
+func ReportFromTSDB(result v1.TSDBResult, limit uint64, generatedAt time.Time) *Report {
+	report := &Report{
+		GeneratedAt: generatedAt,
+		LabelLimit:  limit,
+		TopMetrics:  result.SeriesCountByMetricName,
+		TSDB:        &result,
+	}
+	for _, lv := range result.LabelValueCountByLabelName {
+		report.Labels = append(report.Labels, LabelReport{
+			Name:       lv.Name,
+			ValueCount: lv.Value,
+			OverLimit:  lv.Value > limit,
+		})
+	}
+	return report
+}
+
+// Report runs a scan without remediating anything and breaks the value count
+// of every label down by job.
+func (c *CardinalityScanner) Report(ctx context.Context) (*Report, error) {
+	now := time.Now()
+
+	var report *Report
+	if _, ok := c.Source.(*TSDBSource); ok || c.Source == nil {
+		result, err := c.PromAPI.TSDB(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving TSDB stats from the promtheus API, %w", err)
+		}
+		report = ReportFromTSDB(result, c.LabelCountLimit, now)
+	} else {
+		stats, err := c.Source.LabelValueCounts(ctx)
+		if err != nil {
+			return nil, err
+		}
+		report = ReportFromTSDB(v1.TSDBResult{LabelValueCountByLabelName: stats}, c.LabelCountLimit, now)
+		report.TSDB = nil
+	}
+
+	for i, l := range report.Labels {
+		if l.Name == model.MetricNameLabel {
+			continue
+		}
+
+		r, _, err := c.PromAPI.Query(ctx, countValuesByJobQuery(l.Name), now)
+		if err != nil {
+			return nil, fmt.Errorf("error querying the promtheus API, %w", err)
+		}
+
+		if vec, ok := r.(model.Vector); ok {
+			report.Labels[i].Jobs = map[string]uint64{}
+			for _, s := range vec {
+				report.Labels[i].Jobs[string(s.Metric["job"])] = uint64(s.Value)
+			}
+		}
+	}
+	return report, nil
+}
+
+// LoadReport reads a report saved with WriteJSON, or the raw JSON of a TSDB
+// stats response.
+func LoadReport(path string, limit uint64) (*Report, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading report file, %w", err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("error parsing report file %s, %w", path, err)
+	}
+
+	if _, ok := fields["labels"]; ok {
+		report := &Report{}
+		if err := json.Unmarshal(b, report); err != nil {
+			return nil, fmt.Errorf("error parsing report file %s, %w", path, err)
+		}
+		return report, nil
+	}
+
+	// the TSDB stats API wraps the result in {"status": ..., "data": ...}
+	if data, ok := fields["data"]; ok {
+		b = data
+	}
+
+	var result v1.TSDBResult
+	if err := json.Unmarshal(b, &result); err != nil {
+		return nil, fmt.Errorf("error parsing TSDB stats file %s, %w", path, err)
+	}
+	return ReportFromTSDB(result, limit, time.Time{}), nil
+}
+
+func sortedJobNames(jobs map[string]uint64) []string {
+	var names []string
+	for j := range jobs {
+		names = append(names, j)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func (r *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"label", "job", "value_count", "over_limit"})
+	for _, l := range r.Labels {
+		cw.Write([]string{l.Name, "", strconv.FormatUint(l.ValueCount, 10), strconv.FormatBool(l.OverLimit)})
+		for _, j := range sortedJobNames(l.Jobs) {
+			cw.Write([]string{l.Name, j, strconv.FormatUint(l.Jobs[j], 10), strconv.FormatBool(l.Jobs[j] > r.LabelLimit)})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (r *Report) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "LABEL\tJOB\tVALUES\tOVER LIMIT")
+	for _, l := range r.Labels {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%t\n", l.Name, "*", l.ValueCount, l.OverLimit)
+		for _, j := range sortedJobNames(l.Jobs) {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%t\n", l.Name, j, l.Jobs[j], l.Jobs[j] > r.LabelLimit)
+		}
+	}
+
+	if len(r.TopMetrics) > 0 {
+		fmt.Fprintln(tw, "\nMETRIC\tSERIES\t\t")
+		for _, m := range r.TopMetrics {
+			fmt.Fprintf(tw, "%s\t%d\t\t\n", m.Name, m.Value)
+		}
+	}
+	return tw.Flush()
+}
+
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case "table":
+		return r.WriteTable(w)
+	case "json":
+		return r.WriteJSON(w)
+	case "csv":
+		return r.WriteCSV(w)
+	}
+	return fmt.Errorf("unknown report format %s, expected table, json or csv", format)
+}
+
+// LabelDiff is the change in value count of a label, overall when Job is
+// empty, between two reports.
+type LabelDiff struct {
+	Label string  `json:"label"`
+	Job   string  `json:"job,omitempty"`
+	Old   uint64  `json:"old"`
+	New   uint64  `json:"new"`
+	Delta int64   `json:"delta"`
+	Ratio float64 `json:"ratio"`
+}
+
+func newLabelDiff(label, job string, old, new uint64) LabelDiff {
+	d := LabelDiff{Label: label, Job: job, Old: old, New: new, Delta: int64(new) - int64(old)}
+	if old > 0 {
+		d.Ratio = float64(d.Delta) / float64(old)
+	} else if new > 0 {
+		d.Ratio = 1
+	}
+	return d
+}
+
+// DiffReports lists every label and label/job pair whose value count changed.
+func DiffReports(old, new *Report) []LabelDiff {
+	oldLabels := map[string]LabelReport{}
+	for _, l := range old.Labels {
+		oldLabels[l.Name] = l
+	}
+	newLabels := map[string]LabelReport{}
+	for _, l := range new.Labels {
+		newLabels[l.Name] = l
+	}
+
+	names := map[string]bool{}
+	for n := range oldLabels {
+		names[n] = true
+	}
+	for n := range newLabels {
+		names[n] = true
+	}
+
+	var diffs []LabelDiff
+	for name := range names {
+		o, n := oldLabels[name], newLabels[name]
+
+		if o.ValueCount != n.ValueCount {
+			diffs = append(diffs, newLabelDiff(name, "", o.ValueCount, n.ValueCount))
+		}
+
+		jobs := map[string]uint64{}
+		for j := range o.Jobs {
+			jobs[j] = 0
+		}
+		for j := range n.Jobs {
+			jobs[j] = 0
+		}
+		for j := range jobs {
+			if o.Jobs[j] != n.Jobs[j] {
+				diffs = append(diffs, newLabelDiff(name, j, o.Jobs[j], n.Jobs[j]))
+			}
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Label != diffs[j].Label {
+			return diffs[i].Label < diffs[j].Label
+		}
+		return diffs[i].Job < diffs[j].Job
+	})
+	return diffs
+}
+
+func WriteDiff(w io.Writer, diffs []LabelDiff, format string) error {
+	switch format {
+	case "table":
+		return WriteDiffTable(w, diffs)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diffs)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"label", "job", "old", "new", "delta", "ratio"})
+		for _, d := range diffs {
+			cw.Write([]string{d.Label, d.Job, strconv.FormatUint(d.Old, 10), strconv.FormatUint(d.New, 10), strconv.FormatInt(d.Delta, 10), strconv.FormatFloat(d.Ratio, 'f', -1, 64)})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown report format %s, expected table, json or csv", format)
+}
+
+func WriteDiffTable(w io.Writer, diffs []LabelDiff) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LABEL\tJOB\tOLD\tNEW\tCHANGE")
+	for _, d := range diffs {
+		job := d.Job
+		if job == "" {
+			job = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%+.1f%%\n", d.Label, job, d.Old, d.New, d.Ratio*100)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,129 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mclarke47/cardinanny/mock_v1"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func reportScanner(t *testing.T) CardinalityScanner {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	m.
+		EXPECT().
+		TSDB(gomock.Any()).
+		Return(v1.TSDBResult{
+			SeriesCountByMetricName: []v1.Stat{{Name: "http_requests_total", Value: 300}},
+			LabelValueCountByLabelName: []v1.Stat{
+				{Name: "__name__", Value: 20},
+				{Name: "path", Value: 120},
+				{Name: "method", Value: 4},
+			},
+		}, nil)
+
+	m.
+		EXPECT().
+		Query(gomock.Any(), gomock.Eq("count by (job) (count by (job, path)({path=~\".+\"}))"), gomock.Any()).
+		Return(model.Vector{
+			{Metric: model.Metric{"job": "api"}, Value: 100},
+			{Metric: model.Metric{"job": "web"}, Value: 30},
+		}, nil, nil)
+
+	m.
+		EXPECT().
+		Query(gomock.Any(), gomock.Eq("count by (job) (count by (job, method)({method=~\".+\"}))"), gomock.Any()).
+		Return(model.Vector{
+			{Metric: model.Metric{"job": "api"}, Value: 4},
+		}, nil, nil)
+
+	return CardinalityScanner{
+		PromAPI:         m,
+		Logger:          zap.NewNop().Sugar(),
+		LabelCountLimit: 50,
+	}
+}
+
+func Test_CardinalityScanner_Report(t *testing.T) {
+	scanner := reportScanner(t)
+
+	report, err := scanner.Report(context.Background())
+	assert.Nil(t, err)
+
+	assert.Equal(t, []LabelReport{
+		{Name: "__name__", ValueCount: 20},
+		{Name: "path", ValueCount: 120, OverLimit: true, Jobs: map[string]uint64{"api": 100, "web": 30}},
+		{Name: "method", ValueCount: 4, Jobs: map[string]uint64{"api": 4}},
+	}, report.Labels)
+	assert.Equal(t, []v1.Stat{{Name: "http_requests_total", Value: 300}}, report.TopMetrics)
+
+	var csv bytes.Buffer
+	assert.Nil(t, report.Write(&csv, "csv"))
+	assert.Equal(t, `label,job,value_count,over_limit
+__name__,,20,false
+path,,120,true
+path,api,100,true
+path,web,30,false
+method,,4,false
+method,api,4,false
+`, csv.String())
+}
+
+func Test_LoadReport_savedReportAndTSDBStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cardinanny-report")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	scanner := reportScanner(t)
+	report, err := scanner.Report(context.Background())
+	assert.Nil(t, err)
+
+	var saved bytes.Buffer
+	assert.Nil(t, report.WriteJSON(&saved))
+	reportPath := filepath.Join(dir, "report.json")
+	assert.Nil(t, ioutil.WriteFile(reportPath, saved.Bytes(), 0644))
+
+	loaded, err := LoadReport(reportPath, 50)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Labels, loaded.Labels)
+
+	tsdbPath := filepath.Join(dir, "tsdb.json")
+	assert.Nil(t, ioutil.WriteFile(tsdbPath, []byte(`{
+  "status": "success",
+  "data": {
+    "labelValueCountByLabelName": [{"name": "path", "value": 60}]
+  }
+}`), 0644))
+
+	fromTSDB, err := LoadReport(tsdbPath, 50)
+	assert.Nil(t, err)
+	assert.Equal(t, []LabelReport{{Name: "path", ValueCount: 60, OverLimit: true}}, fromTSDB.Labels)
+
+	assert.Equal(t, []LabelDiff{
+		{Label: "__name__", Old: 20, New: 0, Delta: -20, Ratio: -1},
+		{Label: "method", Old: 4, New: 0, Delta: -4, Ratio: -1},
+		{Label: "method", Job: "api", Old: 4, New: 0, Delta: -4, Ratio: -1},
+		{Label: "path", Old: 120, New: 60, Delta: -60, Ratio: -0.5},
+		{Label: "path", Job: "api", Old: 100, New: 0, Delta: -100, Ratio: -1},
+		{Label: "path", Job: "web", Old: 30, New: 0, Delta: -30, Ratio: -1},
+	}, DiffReports(loaded, fromTSDB))
+}
+
+func Test_DiffReports_newLabel(t *testing.T) {
+	old := &Report{Labels: []LabelReport{{Name: "path", ValueCount: 100}}}
+	new := &Report{Labels: []LabelReport{{Name: "path", ValueCount: 100}, {Name: "user_id", ValueCount: 10}}}
+
+	assert.Equal(t, []LabelDiff{
+		{Label: "user_id", Old: 0, New: 10, Delta: 10, Ratio: 1},
+	}, DiffReports(old, new))
+}
@@ -0,0 +1,317 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultAPIMaxAttempts     = 4
+	DefaultAPIRetryBackoff    = time.Second
+	DefaultAPIMaxRetryBackoff = 10 * time.Second
+)
+
+// IsRetryable tells transient errors, such as the 503s Prometheus answers
+// with during compaction or right after a reload, from the ones retrying
+// would not fix like a bad query.
+func IsRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *v1.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Type {
+		case v1.ErrServer, v1.ErrTimeout:
+			return apiErr.Msg != fmt.Sprintf("server error: %d", http.StatusNotImplemented)
+		case v1.ErrClient:
+			return apiErr.Msg == fmt.Sprintf("client error: %d", http.StatusTooManyRequests)
+		}
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// the connection was closed or reset while prometheus restarted
+	msg := err.Error()
+	return strings.Contains(msg, "connection refused") || strings.Contains(msg, "connection reset") || strings.HasSuffix(msg, "EOF")
+}
+
+// APIRetryConfig is how calls to the prometheus API are retried.
+type APIRetryConfig struct {
+	MaxAttempts int            `yaml:"max_attempts,omitempty"`
+	Backoff     model.Duration `yaml:"backoff,omitempty"`
+	MaxBackoff  model.Duration `yaml:"max_backoff,omitempty"`
+}
+
+func (c APIRetryConfig) Validate() error {
+	if c.MaxAttempts < 1 {
+		return fmt.Errorf("max_attempts must be at least 1, was %d", c.MaxAttempts)
+	}
+	if c.MaxBackoff < c.Backoff {
+		return fmt.Errorf("max_backoff %s is shorter than backoff %s", c.MaxBackoff, c.Backoff)
+	}
+	return nil
+}
+
+// Wrap retries the calls made to promAPI.
+func (c APIRetryConfig) Wrap(promAPI v1.API, instance string, logger *zap.SugaredLogger) *RetryingAPI {
+	return &RetryingAPI{
+		API:         promAPI,
+		Logger:      logger,
+		Instance:    instance,
+		MaxAttempts: c.MaxAttempts,
+		Backoff:     time.Duration(c.Backoff),
+		MaxBackoff:  time.Duration(c.MaxBackoff),
+	}
+}
+
+// RetryingAPI retries the calls to the wrapped API which fail with a
+// retryable error, waiting Backoff before the first retry and twice as long
+// before each of the next ones, up to MaxBackoff. Snapshot is not retried as
+// every call makes a new snapshot.
+type RetryingAPI struct {
+	v1.API
+	Logger   *zap.SugaredLogger
+	Instance string
+	// MaxAttempts includes the first call, one disables retries.
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	// Retryable classifies errors, IsRetryable when not set.
+	Retryable func(error) bool
+
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (r *RetryingAPI) retry(ctx context.Context, call string, f func() error) error {
+	retryable := r.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	sleep := r.sleep
+	if sleep == nil {
+		sleep = sleepContext
+	}
+
+	backoff := r.Backoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= r.MaxAttempts || !retryable(err) {
+			return err
+		}
+
+		r.Logger.Debugw("prometheus API call failed, retrying", "call", call, "attempt", attempt, "backoff", backoff, "error", err)
+		APIRetries.WithLabelValues(r.Instance, call).Inc()
+		if sleepErr := sleep(ctx, backoff); sleepErr != nil {
+			return err
+		}
+
+		backoff *= 2
+		if r.MaxBackoff > 0 && backoff > r.MaxBackoff {
+			backoff = r.MaxBackoff
+		}
+	}
+}
+
+func (r *RetryingAPI) Alerts(ctx context.Context) (v1.AlertsResult, error) {
+	var result v1.AlertsResult
+	err := r.retry(ctx, "alerts", func() (err error) {
+		result, err = r.API.Alerts(ctx)
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryingAPI) AlertManagers(ctx context.Context) (v1.AlertManagersResult, error) {
+	var result v1.AlertManagersResult
+	err := r.retry(ctx, "alertmanagers", func() (err error) {
+		result, err = r.API.AlertManagers(ctx)
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryingAPI) CleanTombstones(ctx context.Context) error {
+	return r.retry(ctx, "clean_tombstones", func() error {
+		return r.API.CleanTombstones(ctx)
+	})
+}
+
+func (r *RetryingAPI) Config(ctx context.Context) (v1.ConfigResult, error) {
+	var result v1.ConfigResult
+	err := r.retry(ctx, "config", func() (err error) {
+		result, err = r.API.Config(ctx)
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryingAPI) DeleteSeries(ctx context.Context, matches []string, startTime, endTime time.Time) error {
+	return r.retry(ctx, "delete_series", func() error {
+		return r.API.DeleteSeries(ctx, matches, startTime, endTime)
+	})
+}
+
+func (r *RetryingAPI) Flags(ctx context.Context) (v1.FlagsResult, error) {
+	var result v1.FlagsResult
+	err := r.retry(ctx, "flags", func() (err error) {
+		result, err = r.API.Flags(ctx)
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryingAPI) LabelNames(ctx context.Context, matches []string, startTime, endTime time.Time) ([]string, v1.Warnings, error) {
+	var (
+		result   []string
+		warnings v1.Warnings
+	)
+	err := r.retry(ctx, "label_names", func() (err error) {
+		result, warnings, err = r.API.LabelNames(ctx, matches, startTime, endTime)
+		return err
+	})
+	return result, warnings, err
+}
+
+func (r *RetryingAPI) LabelValues(ctx context.Context, label string, matches []string, startTime, endTime time.Time) (model.LabelValues, v1.Warnings, error) {
+	var (
+		result   model.LabelValues
+		warnings v1.Warnings
+	)
+	err := r.retry(ctx, "label_values", func() (err error) {
+		result, warnings, err = r.API.LabelValues(ctx, label, matches, startTime, endTime)
+		return err
+	})
+	return result, warnings, err
+}
+
+func (r *RetryingAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, v1.Warnings, error) {
+	var (
+		result   model.Value
+		warnings v1.Warnings
+	)
+	err := r.retry(ctx, "query", func() (err error) {
+		result, warnings, err = r.API.Query(ctx, query, ts)
+		return err
+	})
+	return result, warnings, err
+}
+
+func (r *RetryingAPI) QueryRange(ctx context.Context, query string, rng v1.Range) (model.Value, v1.Warnings, error) {
+	var (
+		result   model.Value
+		warnings v1.Warnings
+	)
+	err := r.retry(ctx, "query_range", func() (err error) {
+		result, warnings, err = r.API.QueryRange(ctx, query, rng)
+		return err
+	})
+	return result, warnings, err
+}
+
+func (r *RetryingAPI) QueryExemplars(ctx context.Context, query string, startTime, endTime time.Time) ([]v1.ExemplarQueryResult, error) {
+	var result []v1.ExemplarQueryResult
+	err := r.retry(ctx, "query_exemplars", func() (err error) {
+		result, err = r.API.QueryExemplars(ctx, query, startTime, endTime)
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryingAPI) Buildinfo(ctx context.Context) (v1.BuildinfoResult, error) {
+	var result v1.BuildinfoResult
+	err := r.retry(ctx, "buildinfo", func() (err error) {
+		result, err = r.API.Buildinfo(ctx)
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryingAPI) Runtimeinfo(ctx context.Context) (v1.RuntimeinfoResult, error) {
+	var result v1.RuntimeinfoResult
+	err := r.retry(ctx, "runtimeinfo", func() (err error) {
+		result, err = r.API.Runtimeinfo(ctx)
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryingAPI) Series(ctx context.Context, matches []string, startTime, endTime time.Time) ([]model.LabelSet, v1.Warnings, error) {
+	var (
+		result   []model.LabelSet
+		warnings v1.Warnings
+	)
+	err := r.retry(ctx, "series", func() (err error) {
+		result, warnings, err = r.API.Series(ctx, matches, startTime, endTime)
+		return err
+	})
+	return result, warnings, err
+}
+
+func (r *RetryingAPI) Rules(ctx context.Context) (v1.RulesResult, error) {
+	var result v1.RulesResult
+	err := r.retry(ctx, "rules", func() (err error) {
+		result, err = r.API.Rules(ctx)
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryingAPI) Targets(ctx context.Context) (v1.TargetsResult, error) {
+	var result v1.TargetsResult
+	err := r.retry(ctx, "targets", func() (err error) {
+		result, err = r.API.Targets(ctx)
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryingAPI) TargetsMetadata(ctx context.Context, matchTarget, metric, limit string) ([]v1.MetricMetadata, error) {
+	var result []v1.MetricMetadata
+	err := r.retry(ctx, "targets_metadata", func() (err error) {
+		result, err = r.API.TargetsMetadata(ctx, matchTarget, metric, limit)
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryingAPI) Metadata(ctx context.Context, metric, limit string) (map[string][]v1.Metadata, error) {
+	var result map[string][]v1.Metadata
+	err := r.retry(ctx, "metadata", func() (err error) {
+		result, err = r.API.Metadata(ctx, metric, limit)
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryingAPI) TSDB(ctx context.Context) (v1.TSDBResult, error) {
+	var result v1.TSDBResult
+	err := r.retry(ctx, "tsdb", func() (err error) {
+		result, err = r.API.TSDB(ctx)
+		return err
+	})
+	return result, err
+}
@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mclarke47/cardinanny/mock_v1"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func retryingAPI(m v1.API, slept *[]time.Duration) *RetryingAPI {
+	return &RetryingAPI{
+		API:         m,
+		Logger:      zap.NewNop().Sugar(),
+		Instance:    "retry-test",
+		MaxAttempts: 4,
+		Backoff:     time.Second,
+		MaxBackoff:  3 * time.Second,
+		sleep: func(ctx context.Context, d time.Duration) error {
+			*slept = append(*slept, d)
+			return ctx.Err()
+		},
+	}
+}
+
+var unavailable = &v1.Error{Type: v1.ErrServer, Msg: "server error: 503"}
+
+func TestRetryingAPI_retriesTransientErrors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := mock_v1.NewMockAPI(ctrl)
+
+	gomock.InOrder(
+		m.EXPECT().Query(gomock.Any(), "up", gomock.Any()).Return(nil, nil, unavailable),
+		m.EXPECT().Query(gomock.Any(), "up", gomock.Any()).Return(nil, nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}),
+		m.EXPECT().Query(gomock.Any(), "up", gomock.Any()).Return(model.Vector{}, v1.Warnings{"some-warning"}, nil),
+	)
+
+	var slept []time.Duration
+	result, warnings, err := retryingAPI(m, &slept).Query(context.Background(), "up", time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, model.Vector{}, result)
+	assert.Equal(t, v1.Warnings{"some-warning"}, warnings)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, slept)
+}
+
+func TestRetryingAPI_givesUpAfterMaxAttempts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := mock_v1.NewMockAPI(ctrl)
+
+	m.EXPECT().DeleteSeries(gomock.Any(), []string{"{a=~\".+\"}"}, gomock.Any(), gomock.Any()).Return(unavailable).Times(4)
+
+	var slept []time.Duration
+	err := retryingAPI(m, &slept).DeleteSeries(context.Background(), []string{"{a=~\".+\"}"}, time.Now(), time.Now())
+	assert.Equal(t, unavailable, err)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, slept)
+}
+
+func TestRetryingAPI_doesNotRetryFatalErrors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := mock_v1.NewMockAPI(ctrl)
+
+	badQuery := &v1.Error{Type: v1.ErrBadData, Msg: "parse error"}
+	m.EXPECT().Query(gomock.Any(), "up{", gomock.Any()).Return(nil, nil, badQuery).Times(1)
+
+	var slept []time.Duration
+	_, _, err := retryingAPI(m, &slept).Query(context.Background(), "up{", time.Now())
+	assert.Equal(t, badQuery, err)
+	assert.Empty(t, slept)
+}
+
+func TestRetryingAPI_stopsWhenTheContextIsDone(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := mock_v1.NewMockAPI(ctrl)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.EXPECT().TSDB(gomock.Any()).DoAndReturn(func(context.Context) (v1.TSDBResult, error) {
+		cancel()
+		return v1.TSDBResult{}, unavailable
+	}).Times(1)
+
+	var slept []time.Duration
+	_, err := retryingAPI(m, &slept).TSDB(ctx)
+	assert.Equal(t, unavailable, err)
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{unavailable, true},
+		{&v1.Error{Type: v1.ErrTimeout, Msg: "query timed out"}, true},
+		{&v1.Error{Type: v1.ErrClient, Msg: "client error: 429"}, true},
+		{&v1.Error{Type: v1.ErrServer, Msg: "server error: 501"}, false},
+		{&v1.Error{Type: v1.ErrClient, Msg: "client error: 404"}, false},
+		{&v1.Error{Type: v1.ErrBadData, Msg: "parse error"}, false},
+		{&v1.Error{Type: v1.ErrExec, Msg: "query processing would load too many samples"}, false},
+		{fmt.Errorf("Post \"http://prometheus:9090/api/v1/query\": %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), true},
+		{errors.New("Post \"http://prometheus:9090/api/v1/query\": EOF"), true},
+		{context.Canceled, false},
+		{fmt.Errorf("Post \"http://prometheus:9090/api/v1/query\": %w", context.DeadlineExceeded), false},
+	} {
+		assert.Equal(t, tc.retryable, IsRetryable(tc.err), tc.err.Error())
+	}
+}
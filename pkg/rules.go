@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"go.uber.org/zap"
+)
+
+// queryLabels returns the labels a PromQL query uses: in selectors, by and
+// without clauses, on, ignoring and group_left/right matching and as the
+// source of label_replace and label_join. ok is false when none of the
+// query's selectors can match series of the job.
+func queryLabels(expr parser.Expr, job string) ([]string, bool) {
+	used := map[string]bool{}
+	selectsJob := false
+
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			matchesJob := true
+			for _, m := range n.LabelMatchers {
+				if m.Name == labels.MetricName {
+					continue
+				}
+				// a dashboard variable could be any job
+				if m.Name == "job" && !m.Matches(job) && !strings.Contains(m.Value, grafanaVariable) {
+					matchesJob = false
+				}
+				used[m.Name] = true
+			}
+			selectsJob = selectsJob || matchesJob
+		case *parser.AggregateExpr:
+			for _, l := range n.Grouping {
+				used[l] = true
+			}
+		case *parser.BinaryExpr:
+			if n.VectorMatching != nil {
+				for _, l := range n.VectorMatching.MatchingLabels {
+					used[l] = true
+				}
+				for _, l := range n.VectorMatching.Include {
+					used[l] = true
+				}
+			}
+		case *parser.Call:
+			var sources parser.Expressions
+			switch n.Func.Name {
+			case "label_replace":
+				if len(n.Args) == 5 {
+					sources = n.Args[3:4]
+				}
+			case "label_join":
+				if len(n.Args) > 3 {
+					sources = n.Args[3:]
+				}
+			}
+			for _, arg := range sources {
+				if s, ok := arg.(*parser.StringLiteral); ok && s.Val != "" {
+					used[s.Val] = true
+				}
+			}
+		}
+		return nil
+	})
+
+	delete(used, grafanaVariable)
+	var result []string
+	for l := range used {
+		result = append(result, l)
+	}
+	sort.Strings(result)
+	return result, selectsJob
+}
+
+// templateLabel finds labels used in alert labels and annotations, as
+// {{ $labels.path }} or {{ index $labels "path" }}.
+var templateLabel = regexp.MustCompile(`\$labels\.([a-zA-Z_][a-zA-Z0-9_]*)|index\s+\$labels\s+"([a-zA-Z_][a-zA-Z0-9_]*)"`)
+
+func templateLabels(sets ...model.LabelSet) []string {
+	var result []string
+	for _, set := range sets {
+		for _, v := range set {
+			for _, m := range templateLabel.FindAllStringSubmatch(string(v), -1) {
+				result = append(result, m[1]+m[2])
+			}
+		}
+	}
+	return result
+}
+
+// RulesImpactAnalyzer finds the recording and alerting rules using labels
+// about to be dropped. Dropping a label an alert groups by silently breaks
+// the alert.
+type RulesImpactAnalyzer struct {
+	Logger  *zap.SugaredLogger
+	PromAPI v1.API
+	Action  ImpactAction
+}
+
+func (r *RulesImpactAnalyzer) Impacts(ctx context.Context, jobNamesToLabelsToDrop map[string][]string) ([]Impact, error) {
+	if r.Action == ImpactIgnore || len(jobNamesToLabelsToDrop) == 0 {
+		return nil, nil
+	}
+
+	rules, err := r.PromAPI.Rules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching prometheus rules, %w", err)
+	}
+
+	var impacts []Impact
+	for _, group := range rules.Groups {
+		for _, rule := range group.Rules {
+			var source, name, query string
+			var templated []string
+			switch rule := rule.(type) {
+			case v1.AlertingRule:
+				source, name, query = ImpactAlertingRule, rule.Name, rule.Query
+				templated = templateLabels(rule.Labels, rule.Annotations)
+			case v1.RecordingRule:
+				source, name, query = ImpactRecordingRule, rule.Name, rule.Query
+			default:
+				continue
+			}
+
+			expr, err := parser.ParseExpr(query)
+			if err != nil {
+				r.Logger.Warnw("unable to parse rule query, ignoring it", "group", group.Name, "rule", name, "error", err)
+				continue
+			}
+
+			for _, job := range sortedJobs(jobNamesToLabelsToDrop) {
+				used, selectsJob := queryLabels(expr, job)
+				if !selectsJob {
+					continue
+				}
+				used = append(used, templated...)
+
+				var affected []string
+				for _, l := range jobNamesToLabelsToDrop[job] {
+					if containsString(used, l) {
+						affected = append(affected, l)
+					}
+				}
+				if len(affected) == 0 {
+					continue
+				}
+				impacts = append(impacts, Impact{
+					Job:    job,
+					Labels: affected,
+					Source: source,
+					Name:   name,
+					Group:  group.Name,
+					Query:  query,
+					Action: r.Action,
+				})
+			}
+		}
+	}
+	return impacts, nil
+}
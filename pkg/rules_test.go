@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mclarke47/cardinanny/mock_v1"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestQueryLabels(t *testing.T) {
+	for _, tc := range []struct {
+		query      string
+		labels     []string
+		selectsJob bool
+	}{
+		{`sum by (path) (rate(http_requests_total[5m]))`, []string{"path"}, true},
+		{`sum without (instance, pod) (up{job="api"})`, []string{"instance", "job", "pod"}, true},
+		{`up{job="worker"} == 0`, []string{"job"}, false},
+		{`rate(http_requests_total{status=~"5..", job=~"api|web"}[5m])`, []string{"job", "status"}, true},
+		{`a * on (user_id) group_left (team) b`, []string{"team", "user_id"}, true},
+		{`label_replace(up, "host", "$1", "instance", "(.*):.*")`, []string{"instance"}, true},
+		{`label_join(up, "target", ",", "namespace", "pod")`, []string{"namespace", "pod"}, true},
+		{`max_over_time(sum by (route) (requests)[1h:5m])`, []string{"route"}, true},
+	} {
+		expr, err := parser.ParseExpr(tc.query)
+		assert.Nil(t, err)
+
+		labels, selectsJob := queryLabels(expr, "api")
+		assert.Equal(t, tc.labels, labels, tc.query)
+		assert.Equal(t, tc.selectsJob, selectsJob, tc.query)
+	}
+}
+
+func TestRulesImpactAnalyzer(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := mock_v1.NewMockAPI(ctrl)
+
+	m.EXPECT().Rules(gomock.Any()).Return(v1.RulesResult{Groups: []v1.RuleGroup{
+		{
+			Name: "api",
+			Rules: v1.Rules{
+				v1.AlertingRule{
+					Name:        "HighErrorRate",
+					Query:       `sum by (path) (rate(http_requests_total{status="500"}[5m])) > 1`,
+					Annotations: model.LabelSet{"summary": "errors on {{ $labels.path }}"},
+				},
+				v1.AlertingRule{
+					Name:        "SlowUser",
+					Query:       `histogram_quantile(0.99, rate(latency_bucket[5m])) > 1`,
+					Annotations: model.LabelSet{"summary": `{{ index $labels "user_id" }} is slow`},
+				},
+				v1.RecordingRule{
+					Name:  "job:requests:rate5m",
+					Query: `sum by (job) (rate(http_requests_total[5m]))`,
+				},
+				v1.RecordingRule{
+					Name:  "worker:tasks:rate5m",
+					Query: `sum by (task_id) (rate(tasks_total{job="worker"}[5m]))`,
+				},
+				v1.RecordingRule{
+					Name:  "broken",
+					Query: `sum by (`,
+				},
+			},
+		},
+	}}, nil)
+
+	analyzer := &RulesImpactAnalyzer{Logger: zap.NewNop().Sugar(), PromAPI: m, Action: ImpactBlock}
+	impacts, err := analyzer.Impacts(context.Background(), map[string][]string{
+		"api":    {"path", "user_id", "task_id"},
+		"worker": {"path"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []Impact{
+		{Job: "api", Labels: []string{"path"}, Source: ImpactAlertingRule, Name: "HighErrorRate", Group: "api", Query: `sum by (path) (rate(http_requests_total{status="500"}[5m])) > 1`, Action: ImpactBlock},
+		{Job: "worker", Labels: []string{"path"}, Source: ImpactAlertingRule, Name: "HighErrorRate", Group: "api", Query: `sum by (path) (rate(http_requests_total{status="500"}[5m])) > 1`, Action: ImpactBlock},
+		{Job: "api", Labels: []string{"user_id"}, Source: ImpactAlertingRule, Name: "SlowUser", Group: "api", Query: `histogram_quantile(0.99, rate(latency_bucket[5m])) > 1`, Action: ImpactBlock},
+	}, impacts)
+}
+
+func TestRulesImpactAnalyzer_rulesUnavailable(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := mock_v1.NewMockAPI(ctrl)
+	m.EXPECT().Rules(gomock.Any()).Return(v1.RulesResult{}, errors.New("some-error"))
+
+	analyzer := &RulesImpactAnalyzer{Logger: zap.NewNop().Sugar(), PromAPI: m, Action: ImpactApproval}
+	_, err := analyzer.Impacts(context.Background(), map[string][]string{"api": {"path"}})
+	assert.Equal(t, "error fetching prometheus rules, some-error", err.Error())
+}
+
+func TestSplitByImpact(t *testing.T) {
+	impacts := []Impact{
+		{Job: "api", Labels: []string{"path", "user_id"}, Source: ImpactRecordingRule, Name: "a", Action: ImpactWarn},
+		{Job: "api", Labels: []string{"path"}, Source: ImpactAlertingRule, Name: "b", Group: "g", Action: ImpactBlock},
+		{Job: "worker", Labels: []string{"task_id"}, Source: ImpactAlertingRule, Name: "c", Action: ImpactApproval},
+	}
+
+	proceed, approval, blocked := SplitByImpact(map[string][]string{
+		"api":    {"path", "user_id", "request_id"},
+		"worker": {"task_id"},
+	}, impacts)
+	assert.Equal(t, map[string][]string{"api": {"user_id", "request_id"}}, proceed)
+	assert.Equal(t, map[string][]string{"worker": {"task_id"}}, approval)
+	assert.Equal(t, map[string][]string{"api": {"path"}}, blocked)
+	assert.Equal(t, "used by alerting_rule g/b, recording_rule a", ImpactReason(impacts, "api", "path"))
+
+	plan := &Plan{Jobs: []JobPlan{{Job: "api", Added: []string{"user_id"}}, {Job: "worker", Removed: []string{"task_id"}}}}
+	AnnotateImpacts(plan, impacts)
+	assert.Equal(t, []Impact{{Job: "api", Labels: []string{"user_id"}, Source: ImpactRecordingRule, Name: "a", Action: ImpactWarn}}, plan.Jobs[0].Impacts)
+	assert.Empty(t, plan.Jobs[1].Impacts)
+}
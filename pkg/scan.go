@@ -3,17 +3,56 @@ package pkg
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
 type CardinalityScanner struct {
 	Logger          *zap.SugaredLogger
 	PromAPI         v1.API
+	Source          LabelCardinalitySource
 	LabelCountLimit uint64
+	Trend           *TrendDetector
+	HeadSeries      *HeadSeriesBudget
+	Histograms      *HistogramBucketCheck
+	Exemplars       *ExemplarScanner
+	Targets         *TargetAttributor
+	// ProtectedLabels are never dropped, on top of job, instance and the
+	// histogram labels.
+	ProtectedLabels []string
+	// Concurrency is how many labels are queried at the same time, one when
+	// not set.
+	Concurrency int
+	// QueryRateLimit caps the label queries per second, unlimited when not
+	// set.
+	QueryRateLimit float64
+}
+
+// PartialScanError lists the labels whose jobs could not be queried, the
+// scan result only has the others.
+type PartialScanError struct {
+	Labels map[string]error
+}
+
+func (e *PartialScanError) Error() string {
+	var labels []string
+	for l := range e.Labels {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	var msgs []string
+	for _, l := range labels {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", l, e.Labels[l]))
+	}
+	return fmt.Sprintf("error querying the promtheus API for %d label(s), %s", len(labels), strings.Join(msgs, ", "))
 }
 
 func queryByJob(labelName string) string {
@@ -22,44 +61,191 @@ func queryByJob(labelName string) string {
 
 func (c *CardinalityScanner) Scan(ctx context.Context) (map[string][]string, error) {
 
-	result, err := c.PromAPI.TSDB(ctx)
+	source := c.Source
+	if source == nil {
+		source = &TSDBSource{PromAPI: c.PromAPI}
+	}
+
+	labelValueCounts, err := source.LabelValueCounts(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("error retrieving TSDB stats from the promtheus API, %w", err)
+		return nil, err
 	}
 
 	jobToLabelToDrop := map[string][]string{}
 
-	c.Logger.Debugw("tsdb result", "tsdb.LabelValueCountByLabelName", result.LabelValueCountByLabelName)
+	c.Logger.Debugw("label value counts", "labelValueCounts", labelValueCounts)
+
+	now := time.Now()
 
-	for _, lv := range result.LabelValueCountByLabelName {
+	var labels []string
+
+	if c.HeadSeries != nil {
+		stats, err := c.PromAPI.TSDB(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving TSDB stats from the promtheus API, %w", err)
+		}
 
-		if lv.Value > c.LabelCountLimit {
+		// labels pushing the head series over budget are remediated first
+		labels, err = c.HeadSeries.OverBudget(ctx, stats)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-			r, _, err := c.PromAPI.Query(ctx, queryByJob(lv.Name), time.Now())
-			if err != nil {
-				return nil, fmt.Errorf("error querying the promtheus API, %w", err)
+	if c.Trend != nil {
+		if err := c.Trend.ObserveJobs(ctx, c.PromAPI, c.Trend.TopLabels(labelValueCounts), now); err != nil {
+			c.Logger.Warnw("unable to track label growth", "error", err)
+		}
+	}
+
+	for _, lv := range labelValueCounts {
+		if lv.Value > c.LabelCountLimit && !containsString(labels, lv.Name) {
+			labels = append(labels, lv.Name)
+		}
+	}
+
+	if c.Trend != nil {
+		for _, f := range c.Trend.Detect(now) {
+			c.Logger.Infow("label value count growing towards the limit", "label", f.Label, "job", f.Job, "current", f.Current, "growthPerHour", f.GrowthPerHour, "crossesLimit", f.CrossesLimit)
+
+			if isProtectedLabel(c.ProtectedLabels, f.Label) {
+				continue
+			}
+			if f.Job != "" {
+				addLabel(jobToLabelToDrop, f.Job, f.Label)
+			} else if !containsString(labels, f.Label) {
+				labels = append(labels, f.Label)
 			}
+		}
+	}
+
+	labels = c.withoutProtectedLabels(labels)
+
+	// le and quantile are reported with the histograms they blow up instead
+	if c.Histograms != nil {
+		if _, err := c.Histograms.Check(ctx, now); err != nil {
+			c.Logger.Warnw("unable to check histogram buckets", "error", err)
+		}
+	}
+	if c.Exemplars != nil {
+		if _, err := c.Exemplars.Scan(ctx, now); err != nil {
+			c.Logger.Warnw("unable to count exemplar label values", "error", err)
+		}
+	}
+
+	jobs, failed := c.queryJobs(ctx, labels, now)
+	for i, label := range labels {
+		for _, job := range jobs[i] {
+			addLabel(jobToLabelToDrop, job, label)
+		}
+	}
+
+	if c.Targets != nil {
+		if _, err := c.Targets.Attribute(ctx, jobToLabelToDrop, now); err != nil {
+			c.Logger.Warnw("unable to find the targets responsible for the high cardinality labels", "error", err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return jobToLabelToDrop, &PartialScanError{Labels: failed}
+	}
+	return jobToLabelToDrop, nil
+}
+
+// defaultProtectedLabels tell the targets of a job apart, dropping them would
+// merge the series of every target.
+var defaultProtectedLabels = []string{"job", "instance"}
 
-			if r.Type() == model.ValVector {
-				vec := r.(model.Vector)
+func isProtectedLabel(protected []string, label string) bool {
+	return isHistogramLabel(label) || containsString(defaultProtectedLabels, label) || containsString(protected, label)
+}
 
-				c.Logger.Debugw("vector found", "vec", vec)
+func (c *CardinalityScanner) withoutProtectedLabels(labels []string) []string {
+	var result []string
+	for _, l := range labels {
+		switch {
+		case isHistogramLabel(l):
+			c.Logger.Warnw("not dropping a histogram or summary label, reduce the buckets of the metrics with the most values instead", "label", l)
+			continue
+		case isProtectedLabel(c.ProtectedLabels, l):
+			c.Logger.Warnw("not dropping a protected label", "label", l)
+			continue
+		}
+		result = append(result, l)
+	}
+	return result
+}
 
-				for _, v := range vec {
-					if job, ok := v.Metric["job"]; ok {
-						j := string(job)
+// queryJobs finds the jobs with each label using a pool of workers, keeping
+// the order of the labels so results do not depend on which query finished
+// first.
+func (c *CardinalityScanner) queryJobs(ctx context.Context, labels []string, now time.Time) ([][]string, map[string]error) {
+	jobs := make([][]string, len(labels))
+	errs := make([]error, len(labels))
 
-						if labels, ok := jobToLabelToDrop[j]; ok {
-							jobToLabelToDrop[j] = append(labels, lv.Name)
-						} else {
-							jobToLabelToDrop[j] = []string{lv.Name}
-						}
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if c.QueryRateLimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(c.QueryRateLimit), 1)
+	}
+	workers := c.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
 
-					}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := limiter.Wait(ctx); err != nil {
+					errs[i] = err
+					continue
 				}
+				jobs[i], errs[i] = c.queryLabelJobs(ctx, labels[i], now)
 			}
+		}()
+	}
+	for i := range labels {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	failed := map[string]error{}
+	for i, err := range errs {
+		if err != nil {
+			c.Logger.Warnw("unable to find the jobs with a high cardinality label", "label", labels[i], "error", err)
+			failed[labels[i]] = err
 		}
 	}
+	return jobs, failed
+}
 
-	return jobToLabelToDrop, nil
+func (c *CardinalityScanner) queryLabelJobs(ctx context.Context, label string, now time.Time) ([]string, error) {
+	r, _, err := c.PromAPI.Query(ctx, queryByJob(label), now)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []string
+	if r.Type() == model.ValVector {
+		vec := r.(model.Vector)
+
+		c.Logger.Debugw("vector found", "vec", vec)
+
+		for _, v := range vec {
+			if job, ok := v.Metric["job"]; ok {
+				jobs = append(jobs, string(job))
+			}
+		}
+	}
+	return jobs, nil
+}
+
+func addLabel(jobToLabels map[string][]string, job, label string) {
+	if !containsString(jobToLabels[job], label) {
+		jobToLabels[job] = append(jobToLabels[job], label)
+	}
 }
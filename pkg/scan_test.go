@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/mclarke47/cardinanny/mock_v1"
@@ -211,8 +212,89 @@ func Test_CardinalityScanner_scanHandleQueryReturnsError(t *testing.T) {
 
 	result, err := scanner.Scan(context.Background())
 	assert.NotNil(t, err)
-	assert.Equal(t, "error querying the promtheus API, some-error", err.Error())
-	assert.Nil(t, result)
+	assert.Equal(t, "error querying the promtheus API for 1 label(s), v3: some-error", err.Error())
+	assert.Equal(t, map[string][]string{}, result)
+}
+
+func Test_CardinalityScanner_scanConcurrentlyKeepsPartialResults(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+
+	var stats []v1.Stat
+	for i := 1; i <= 8; i++ {
+		stats = append(stats, v1.Stat{Name: fmt.Sprintf("v%d", i), Value: 100})
+	}
+	m.
+		EXPECT().
+		TSDB(gomock.Any()).
+		Return(v1.TSDBResult{LabelValueCountByLabelName: stats}, nil).
+		MaxTimes(1)
+
+	m.
+		EXPECT().
+		Query(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, query string, ts time.Time) (model.Value, v1.Warnings, error) {
+			if query == "sum({v5=~\".+\"}) by (job)" {
+				return nil, nil, errors.New("some-error")
+			}
+			return model.Vector{
+				{Metric: model.Metric{"job": "some-job"}, Value: 1},
+				{Metric: model.Metric{"job": "some-other-job"}, Value: 1},
+			}, nil, nil
+		}).
+		Times(8)
+
+	scanner := CardinalityScanner{
+		PromAPI:         m,
+		Logger:          zap.NewNop().Sugar(),
+		LabelCountLimit: 50,
+		Concurrency:     3,
+	}
+
+	result, err := scanner.Scan(context.Background())
+	var partial *PartialScanError
+	assert.True(t, errors.As(err, &partial))
+	assert.Len(t, partial.Labels, 1)
+	assert.EqualError(t, partial.Labels["v5"], "some-error")
+	expected := []string{"v1", "v2", "v3", "v4", "v6", "v7", "v8"}
+	assert.Equal(t, map[string][]string{"some-job": expected, "some-other-job": expected}, result)
+}
+
+func Test_CardinalityScanner_scanRateLimited(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+
+	m.
+		EXPECT().
+		TSDB(gomock.Any()).
+		Return(v1.TSDBResult{LabelValueCountByLabelName: []v1.Stat{
+			{Name: "v1", Value: 100},
+			{Name: "v2", Value: 100},
+			{Name: "v3", Value: 100},
+		}}, nil).
+		MaxTimes(1)
+	m.
+		EXPECT().
+		Query(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(model.Vector{}, nil, nil).
+		Times(3)
+
+	scanner := CardinalityScanner{
+		PromAPI:         m,
+		Logger:          zap.NewNop().Sugar(),
+		LabelCountLimit: 50,
+		Concurrency:     3,
+		QueryRateLimit:  20,
+	}
+
+	start := time.Now()
+	_, err := scanner.Scan(context.Background())
+	assert.Nil(t, err)
+	// the first query is let through straight away, the other two wait 50ms
+	// each
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(90*time.Millisecond))
 }
 
 func runTest(t *testing.T, labelValueCountByLabelName []v1.Stat, expectedResult map[string][]string) {
@@ -253,3 +335,65 @@ func runTest(t *testing.T, labelValueCountByLabelName []v1.Stat, expectedResult
 	assert.Nil(t, err)
 	assert.Equal(t, expectedResult, result)
 }
+
+func Test_CardinalityScanner_scanNeverDropsHistogramLabels(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := mock_v1.NewMockAPI(ctrl)
+
+	m.EXPECT().TSDB(gomock.Any()).Return(v1.TSDBResult{
+		LabelValueCountByLabelName: []v1.Stat{
+			{Name: "le", Value: 400},
+			{Name: "quantile", Value: 60},
+			{Name: "v3", Value: 51},
+		},
+	}, nil)
+	m.EXPECT().Query(gomock.Any(), `sum({v3=~".+"}) by (job)`, gomock.Any()).Return(model.Vector{
+		{Metric: model.Metric{"job": "some-job"}, Value: 51},
+	}, nil, nil)
+	m.EXPECT().Query(gomock.Any(), bucketCountQuery("le"), gomock.Any()).Return(model.Vector{
+		{Metric: model.Metric{"__name__": "latency_bucket", "job": "some-job"}, Value: 400},
+	}, nil, nil)
+	m.EXPECT().Query(gomock.Any(), bucketCountQuery("quantile"), gomock.Any()).Return(model.Vector{}, nil, nil)
+
+	scanner := CardinalityScanner{
+		PromAPI:         m,
+		Logger:          zap.NewNop().Sugar(),
+		LabelCountLimit: 50,
+		Histograms:      &HistogramBucketCheck{Logger: zap.NewNop().Sugar(), PromAPI: m, MaxBuckets: 50},
+	}
+
+	result, err := scanner.Scan(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{"some-job": {"v3"}}, result)
+	assert.Equal(t, []BucketExplosion{
+		{Metric: "latency_bucket", Job: "some-job", Label: "le", Buckets: 400, Recommendation: "reduce the buckets of latency, it has 400"},
+	}, scanner.Histograms.Last())
+}
+
+func Test_CardinalityScanner_scanNeverDropsProtectedLabels(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := mock_v1.NewMockAPI(ctrl)
+
+	m.EXPECT().TSDB(gomock.Any()).Return(v1.TSDBResult{
+		LabelValueCountByLabelName: []v1.Stat{
+			{Name: "instance", Value: 400},
+			{Name: "job", Value: 60},
+			{Name: "tenant", Value: 70},
+			{Name: "v3", Value: 51},
+		},
+	}, nil)
+	m.EXPECT().Query(gomock.Any(), `sum({v3=~".+"}) by (job)`, gomock.Any()).Return(model.Vector{
+		{Metric: model.Metric{"job": "some-job"}, Value: 51},
+	}, nil, nil)
+
+	scanner := CardinalityScanner{
+		PromAPI:         m,
+		Logger:          zap.NewNop().Sugar(),
+		LabelCountLimit: 50,
+		ProtectedLabels: []string{"tenant"},
+	}
+
+	result, err := scanner.Scan(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{"some-job": {"v3"}}, result)
+}
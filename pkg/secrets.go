@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redactedSecret is what the prometheus config API shows instead of the
+// passwords, bearer tokens and other secrets in the config.
+const redactedSecret = "<secret>"
+
+var ErrRedactedSecret = errors.New("prometheus config contains redacted secrets")
+
+func redactedSecretPaths(n *yaml.Node, path string, found []string) []string {
+	switch n.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for i, c := range n.Content {
+			p := path
+			if n.Kind == yaml.SequenceNode {
+				p = fmt.Sprintf("%s[%d]", path, i)
+			}
+			found = redactedSecretPaths(c, p, found)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			p := n.Content[i].Value
+			if path != "" {
+				p = path + "." + p
+			}
+			found = redactedSecretPaths(n.Content[i+1], p, found)
+		}
+	case yaml.ScalarNode:
+		if n.Value == redactedSecret {
+			found = append(found, path)
+		}
+	}
+	return found
+}
+
+// checkNoRedactedSecrets refuses a config document which would replace real
+// secrets with the placeholder shown by the config API, which breaks scraping
+// or the next reload.
+func checkNoRedactedSecrets(doc string) error {
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(doc), &root); err != nil {
+		return err
+	}
+	if found := redactedSecretPaths(&root, "", nil); len(found) > 0 {
+		return fmt.Errorf("%w at %s, the config file with the real secrets is needed to change it", ErrRedactedSecret, strings.Join(found, ", "))
+	}
+	return nil
+}
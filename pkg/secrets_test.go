@@ -0,0 +1,62 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mclarke47/cardinanny/mock_v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromConfigRewriter_keepsSecretsFromConfigFile(t *testing.T) {
+	running := runningConfig(t, "./fixtures/2-scrape-jobs-with-secrets.yaml")
+	assert.Contains(t, running, redactedSecret)
+
+	path := writeConfigFile(t, yamlFixture(t, "./fixtures/2-scrape-jobs-with-secrets.yaml"))
+	writer := planRewriter(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}, running)
+	expectReload(writer.PromAPI.(*mock_v1.MockAPI), path)
+	writer.DriftPolicy = DriftRefuse
+
+	assert.Nil(t, writer.DropLabelsInJobs(context.Background(), map[string][]string{"some-other-job": {"somevalue"}}, path))
+
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(b), redactedSecret)
+	assert.Contains(t, string(b), "password: s3cr3t-p4ssw0rd\n")
+	assert.Contains(t, string(b), "credentials: s3cr3t-t0k3n\n")
+	assert.True(t, strings.HasSuffix(string(b), "    metric_relabel_configs:\n      - regex: somevalue\n        action: labeldrop\n"))
+}
+
+func TestPromConfigRewriter_refusesRedactedSecrets(t *testing.T) {
+	running := runningConfig(t, "./fixtures/2-scrape-jobs-with-secrets.yaml")
+	writer := planRewriter(t, func(rw http.ResponseWriter, r *http.Request) {
+		t.Error("prometheus must not be reloaded")
+	}, running, running)
+
+	// without a config file there is only the running config to start from
+	path := filepath.Join(filepath.Dir(writeConfigFile(t, "")), "missing.yml")
+	err := writer.DropLabelsInJobs(context.Background(), map[string][]string{"some-job": {"somevalue"}}, path)
+	assert.True(t, errors.Is(err, ErrRedactedSecret))
+	assert.Contains(t, err.Error(), "scrape_configs[0].basic_auth.password, scrape_configs[1].authorization.credentials")
+	_, statErr := os.Stat(path)
+	assert.True(t, os.IsNotExist(statErr))
+
+	// or when the drifted file is overwritten
+	path = writeConfigFile(t, yamlFixture(t, "./fixtures/2-scrape-jobs-with-secrets.yaml")+extraJob)
+	writer.DriftPolicy = DriftOverwrite
+	_, err = writer.Plan(context.Background(), map[string][]string{"some-job": {"somevalue"}}, nil, path)
+	assert.True(t, errors.Is(err, ErrRedactedSecret))
+}
+
+func TestCheckNoRedactedSecrets(t *testing.T) {
+	assert.Nil(t, checkNoRedactedSecrets(yamlFixture(t, "./fixtures/2-scrape-jobs-with-secrets.yaml")))
+	assert.True(t, errors.Is(checkNoRedactedSecrets("remote_write:\n- url: http://x\n  bearer_token: <secret>\n"), ErrRedactedSecret))
+}
@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// LabelCardinalitySource reports how many values each label name has.
+type LabelCardinalitySource interface {
+	LabelValueCounts(ctx context.Context) ([]v1.Stat, error)
+}
+
+// TSDBSource uses the TSDB stats of a Prometheus server, it is cheap but only
+// covers the head block and only the top 10 labels.
+type TSDBSource struct {
+	PromAPI v1.API
+}
+
+func (s *TSDBSource) LabelValueCounts(ctx context.Context) ([]v1.Stat, error) {
+	result, err := s.PromAPI.TSDB(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving TSDB stats from the promtheus API, %w", err)
+	}
+	return result.LabelValueCountByLabelName, nil
+}
+
+// PromQLSource counts label values with a query per label name, for stores
+// which don't implement the TSDB stats endpoint.
+type PromQLSource struct {
+	PromAPI  v1.API
+	Lookback time.Duration
+}
+
+func countValuesQuery(labelName string) string {
+	return fmt.Sprintf("count(count by (%s)({%s=~\".+\"}))", labelName, labelName)
+}
+
+func (s *PromQLSource) LabelValueCounts(ctx context.Context) ([]v1.Stat, error) {
+	now := time.Now()
+
+	names, _, err := s.PromAPI.LabelNames(ctx, nil, now.Add(-s.Lookback), now)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving label names from the promtheus API, %w", err)
+	}
+
+	var stats []v1.Stat
+	for _, name := range names {
+		if name == model.MetricNameLabel {
+			continue
+		}
+
+		r, _, err := s.PromAPI.Query(ctx, countValuesQuery(name), now)
+		if err != nil {
+			return nil, fmt.Errorf("error querying the promtheus API, %w", err)
+		}
+
+		if vec, ok := r.(model.Vector); ok && len(vec) > 0 {
+			stats = append(stats, v1.Stat{Name: name, Value: uint64(vec[0].Value)})
+		}
+	}
+	return sortStats(stats), nil
+}
+
+// LabelsAPISource lists the values of every label through the labels API.
+type LabelsAPISource struct {
+	PromAPI  v1.API
+	Lookback time.Duration
+}
+
+func (s *LabelsAPISource) LabelValueCounts(ctx context.Context) ([]v1.Stat, error) {
+	now := time.Now()
+
+	names, _, err := s.PromAPI.LabelNames(ctx, nil, now.Add(-s.Lookback), now)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving label names from the promtheus API, %w", err)
+	}
+
+	var stats []v1.Stat
+	for _, name := range names {
+		if name == model.MetricNameLabel {
+			continue
+		}
+
+		values, _, err := s.PromAPI.LabelValues(ctx, name, nil, now.Add(-s.Lookback), now)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving values of label %s from the promtheus API, %w", name, err)
+		}
+		stats = append(stats, v1.Stat{Name: name, Value: uint64(len(values))})
+	}
+	return sortStats(stats), nil
+}
+
+func sortStats(stats []v1.Stat) []v1.Stat {
+	sort.SliceStable(stats, func(i, j int) bool {
+		if stats[i].Value != stats[j].Value {
+			return stats[i].Value > stats[j].Value
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+const (
+	ScanBackendAuto   = "auto"
+	ScanBackendTSDB   = "tsdb"
+	ScanBackendPromQL = "promql"
+	ScanBackendLabels = "labels"
+)
+
+// NewLabelCardinalitySource picks the source for a scan backend, auto uses the
+// TSDB stats when the server has them and the labels API otherwise.
+func NewLabelCardinalitySource(backend string, promAPI v1.API, caps Capabilities, lookback time.Duration) (LabelCardinalitySource, error) {
+	switch backend {
+	case ScanBackendAuto, "":
+		if caps.TSDBStats {
+			return &TSDBSource{PromAPI: promAPI}, nil
+		}
+		return &LabelsAPISource{PromAPI: promAPI, Lookback: lookback}, nil
+	case ScanBackendTSDB:
+		return &TSDBSource{PromAPI: promAPI}, nil
+	case ScanBackendPromQL:
+		return &PromQLSource{PromAPI: promAPI, Lookback: lookback}, nil
+	case ScanBackendLabels:
+		return &LabelsAPISource{PromAPI: promAPI, Lookback: lookback}, nil
+	}
+	return nil, fmt.Errorf("unknown scan backend %s, expected one of %s, %s, %s or %s", backend, ScanBackendAuto, ScanBackendTSDB, ScanBackendPromQL, ScanBackendLabels)
+}
@@ -0,0 +1,98 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mclarke47/cardinanny/mock_v1"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PromQLSource_LabelValueCounts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	m.
+		EXPECT().
+		LabelNames(gomock.Any(), gomock.Nil(), gomock.Any(), gomock.Any()).
+		Return([]string{"__name__", "v1", "v2"}, nil, nil)
+
+	m.
+		EXPECT().
+		Query(gomock.Any(), gomock.Eq("count(count by (v1)({v1=~\".+\"}))"), gomock.Any()).
+		Return(model.Vector{{Value: 10}}, nil, nil)
+
+	m.
+		EXPECT().
+		Query(gomock.Any(), gomock.Eq("count(count by (v2)({v2=~\".+\"}))"), gomock.Any()).
+		Return(model.Vector{{Value: 500}}, nil, nil)
+
+	source := PromQLSource{PromAPI: m}
+
+	stats, err := source.LabelValueCounts(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []v1.Stat{{Name: "v2", Value: 500}, {Name: "v1", Value: 10}}, stats)
+}
+
+func Test_LabelsAPISource_LabelValueCounts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	m.
+		EXPECT().
+		LabelNames(gomock.Any(), gomock.Nil(), gomock.Any(), gomock.Any()).
+		Return([]string{"__name__", "v1", "v2"}, nil, nil)
+
+	m.
+		EXPECT().
+		LabelValues(gomock.Any(), gomock.Eq("v1"), gomock.Nil(), gomock.Any(), gomock.Any()).
+		Return(model.LabelValues{"a", "b", "c"}, nil, nil)
+
+	m.
+		EXPECT().
+		LabelValues(gomock.Any(), gomock.Eq("v2"), gomock.Nil(), gomock.Any(), gomock.Any()).
+		Return(model.LabelValues{"a"}, nil, nil)
+
+	source := LabelsAPISource{PromAPI: m}
+
+	stats, err := source.LabelValueCounts(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []v1.Stat{{Name: "v1", Value: 3}, {Name: "v2", Value: 1}}, stats)
+}
+
+func Test_LabelsAPISource_LabelNamesReturnsError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	m.
+		EXPECT().
+		LabelNames(gomock.Any(), gomock.Nil(), gomock.Any(), gomock.Any()).
+		Return(nil, nil, errors.New("some-error"))
+
+	source := LabelsAPISource{PromAPI: m}
+
+	_, err := source.LabelValueCounts(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, "error retrieving label names from the promtheus API, some-error", err.Error())
+}
+
+func Test_NewLabelCardinalitySource(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+
+	source, err := NewLabelCardinalitySource(ScanBackendAuto, m, Capabilities{TSDBStats: true}, 0)
+	assert.Nil(t, err)
+	assert.IsType(t, &TSDBSource{}, source)
+
+	source, err = NewLabelCardinalitySource(ScanBackendAuto, m, Capabilities{}, 0)
+	assert.Nil(t, err)
+	assert.IsType(t, &LabelsAPISource{}, source)
+
+	_, err = NewLabelCardinalitySource("nope", m, Capabilities{}, 0)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,279 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"go.uber.org/zap"
+)
+
+// RemediationScope is what a label drop applies to.
+type RemediationScope string
+
+const (
+	// ScopeJob drops the label from every target of the job.
+	ScopeJob RemediationScope = "job"
+	// ScopeInstance only drops the label from the targets responsible for
+	// its values when there are some, and from the whole job otherwise.
+	ScopeInstance RemediationScope = "instance"
+)
+
+func ParseRemediationScope(s string) (RemediationScope, error) {
+	switch RemediationScope(s) {
+	case ScopeJob, ScopeInstance:
+		return RemediationScope(s), nil
+	}
+	return "", fmt.Errorf("unknown remediation scope %s, expected %s or %s", s, ScopeJob, ScopeInstance)
+}
+
+// DefaultTargetOutlierFactor is how many times more values than the other
+// targets of its job a target needs to be held responsible for a label.
+const DefaultTargetOutlierFactor = 3
+
+func valuesByInstanceQuery(job, label string) string {
+	return fmt.Sprintf("count by (instance) (count by (instance, %s) ({job=%s,%s=~\".+\"}))", label, strconv.Quote(job), label)
+}
+
+// TargetContribution is how many values of a label one target of a job has.
+// Address is the discovered __address__ of the target, which relabel_configs
+// can drop the target by.
+type TargetContribution struct {
+	Instance    string `json:"instance"`
+	ValueCount  uint64 `json:"valueCount"`
+	Responsible bool   `json:"responsible"`
+	ScrapeURL   string `json:"scrapeUrl,omitempty"`
+	Address     string `json:"address,omitempty"`
+	Health      string `json:"health,omitempty"`
+}
+
+// LabelAttribution breaks the values of a high cardinality label of a job
+// down by target, most values first.
+type LabelAttribution struct {
+	Job     string               `json:"job"`
+	Label   string               `json:"label"`
+	Targets []TargetContribution `json:"targets"`
+}
+
+// Responsible returns the instances held responsible for the label.
+func (a LabelAttribution) Responsible() []string {
+	var instances []string
+	for _, t := range a.Targets {
+		if t.Responsible {
+			instances = append(instances, t.Instance)
+		}
+	}
+	return instances
+}
+
+// TargetAttributor finds which targets the values of the high cardinality
+// labels come from. A target is responsible for a label when it has more than
+// OutlierFactor times the median value count of the other targets of its
+// job, so a job with a single target, or whose targets all look alike, has
+// none.
+type TargetAttributor struct {
+	Logger        *zap.SugaredLogger
+	PromAPI       v1.API
+	OutlierFactor float64
+
+	mu   sync.Mutex
+	last map[[2]string]LabelAttribution
+}
+
+func median(values []uint64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]uint64{}, values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return float64(sorted[mid-1]+sorted[mid]) / 2
+	}
+	return float64(sorted[mid])
+}
+
+func (a *TargetAttributor) outlierFactor() float64 {
+	if a.OutlierFactor > 0 {
+		return a.OutlierFactor
+	}
+	return DefaultTargetOutlierFactor
+}
+
+// Attribute breaks each label of each job down by target. Targets which can't
+// be listed only leave out the scrape URL and address.
+func (a *TargetAttributor) Attribute(ctx context.Context, jobNamesToLabels map[string][]string, now time.Time) ([]LabelAttribution, error) {
+	if len(jobNamesToLabels) == 0 {
+		return nil, nil
+	}
+
+	targets := map[[2]string]v1.ActiveTarget{}
+	if result, err := a.PromAPI.Targets(ctx); err != nil {
+		a.Logger.Warnw("unable to list the targets, attributing labels by instance only", "error", err)
+	} else {
+		for _, t := range result.Active {
+			targets[[2]string{string(t.Labels["job"]), string(t.Labels["instance"])}] = t
+		}
+	}
+
+	var attributions []LabelAttribution
+	for _, job := range sortedJobs(jobNamesToLabels) {
+		for _, label := range jobNamesToLabels[job] {
+			r, _, err := a.PromAPI.Query(ctx, valuesByInstanceQuery(job, label), now)
+			if err != nil {
+				return nil, fmt.Errorf("error querying the promtheus API, %w", err)
+			}
+
+			attribution := LabelAttribution{Job: job, Label: label}
+			if vec, ok := r.(model.Vector); ok {
+				for _, s := range vec {
+					instance := string(s.Metric["instance"])
+					c := TargetContribution{Instance: instance, ValueCount: uint64(s.Value)}
+					if t, ok := targets[[2]string{job, instance}]; ok {
+						c.ScrapeURL = t.ScrapeURL
+						c.Address = t.DiscoveredLabels[model.AddressLabel]
+						c.Health = string(t.Health)
+					}
+					attribution.Targets = append(attribution.Targets, c)
+				}
+			}
+			a.markResponsible(&attribution)
+
+			if responsible := attribution.Responsible(); len(responsible) > 0 {
+				a.Logger.Infow("high cardinality label coming from some of the job's targets", "job", job, "label", label, "instances", responsible)
+			}
+			attributions = append(attributions, attribution)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.last == nil {
+		a.last = map[[2]string]LabelAttribution{}
+	}
+	for _, attribution := range attributions {
+		a.last[[2]string{attribution.Job, attribution.Label}] = attribution
+	}
+	return attributions, nil
+}
+
+func (a *TargetAttributor) markResponsible(attribution *LabelAttribution) {
+	sort.SliceStable(attribution.Targets, func(i, j int) bool {
+		return attribution.Targets[i].ValueCount > attribution.Targets[j].ValueCount
+	})
+
+	for i, t := range attribution.Targets {
+		var others []uint64
+		for j, o := range attribution.Targets {
+			if j != i {
+				others = append(others, o.ValueCount)
+			}
+		}
+		if len(others) > 0 && float64(t.ValueCount) > a.outlierFactor()*median(others) {
+			attribution.Targets[i].Responsible = true
+		}
+	}
+}
+
+// Last returns the latest attribution of every label attributed so far, by
+// job and label.
+func (a *TargetAttributor) Last() []LabelAttribution {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var result []LabelAttribution
+	for _, attribution := range a.last {
+		result = append(result, attribution)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Job != result[j].Job {
+			return result[i].Job < result[j].Job
+		}
+		return result[i].Label < result[j].Label
+	})
+	return result
+}
+
+// Responsible returns the instances last held responsible for a label of a
+// job, none when the label comes from the whole job or was never attributed.
+func (a *TargetAttributor) Responsible(job, label string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.last[[2]string{job, label}].Responsible()
+}
+
+// ScopedDropValue replaces the values of a label dropped from some targets
+// only. A relabel rule can't remove a label conditionally, and setting it to
+// an empty value would not survive prometheus writing its config back out.
+const ScopedDropValue = "cardinanny_dropped"
+
+// ScopedDrop is a label dropped from some instances of a job only.
+type ScopedDrop struct {
+	Label     string   `json:"label"`
+	Instances []string `json:"instances"`
+}
+
+func instancesRegex(instances []string) string {
+	var quoted []string
+	for _, i := range instances {
+		quoted = append(quoted, regexp.QuoteMeta(i))
+	}
+	return strings.Join(quoted, "|")
+}
+
+// regexInstances reverses instancesRegex. Only the exact form instancesRegex
+// writes is parsed, any other regex is returned whole.
+func regexInstances(regex string) []string {
+	var instances []string
+	var instance strings.Builder
+	for i := 0; i < len(regex); i++ {
+		switch c := regex[i]; {
+		case c == '\\' && i+1 < len(regex):
+			i++
+			instance.WriteByte(regex[i])
+		case c == '|':
+			instances = append(instances, instance.String())
+			instance.Reset()
+		default:
+			instance.WriteByte(c)
+		}
+	}
+	instances = append(instances, instance.String())
+
+	if instancesRegex(instances) != regex {
+		return []string{regex}
+	}
+	return instances
+}
+
+func scopedDropConfig(d ScopedDrop) *relabel.Config {
+	return &relabel.Config{
+		SourceLabels: model.LabelNames{"instance"},
+		Separator:    relabel.DefaultRelabelConfig.Separator,
+		Regex:        relabel.MustNewRegexp(instancesRegex(d.Instances)),
+		TargetLabel:  d.Label,
+		Replacement:  ScopedDropValue,
+		Action:       relabel.Replace,
+	}
+}
+
+// scopedDropLabel returns the label and instances of a rule made by
+// scopedDropConfig.
+func scopedDropLabel(rc *relabel.Config) (ScopedDrop, bool) {
+	if rc.Action != relabel.Replace || rc.Replacement != ScopedDropValue || len(rc.SourceLabels) != 1 || rc.SourceLabels[0] != "instance" {
+		return ScopedDrop{}, false
+	}
+	original, err := rc.Regex.MarshalYAML()
+	if err != nil || original == nil {
+		return ScopedDrop{}, false
+	}
+	return ScopedDrop{Label: rc.TargetLabel, Instances: regexInstances(original.(string))}, true
+}
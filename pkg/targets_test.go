@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	plog "github.com/go-kit/log"
+	"github.com/golang/mock/gomock"
+	"github.com/mclarke47/cardinanny/mock_v1"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestTargetAttributor(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := mock_v1.NewMockAPI(ctrl)
+
+	m.EXPECT().Targets(gomock.Any()).Return(v1.TargetsResult{Active: []v1.ActiveTarget{
+		{
+			Labels:           model.LabelSet{"job": "api", "instance": "api-0:8080"},
+			DiscoveredLabels: map[string]string{"__address__": "10.0.0.1:8080"},
+			ScrapeURL:        "http://10.0.0.1:8080/metrics",
+			Health:           v1.HealthGood,
+		},
+	}}, nil)
+	m.EXPECT().Query(gomock.Any(), `count by (instance) (count by (instance, user_id) ({job="api",user_id=~".+"}))`, gomock.Any()).Return(model.Vector{
+		{Metric: model.Metric{"instance": "api-1:8080"}, Value: 20},
+		{Metric: model.Metric{"instance": "api-0:8080"}, Value: 900},
+		{Metric: model.Metric{"instance": "api-2:8080"}, Value: 25},
+	}, nil, nil)
+	m.EXPECT().Query(gomock.Any(), `count by (instance) (count by (instance, task_id) ({job="worker",task_id=~".+"}))`, gomock.Any()).Return(model.Vector{
+		{Metric: model.Metric{"instance": "worker-0:8080"}, Value: 5000},
+	}, nil, nil)
+
+	attributor := &TargetAttributor{Logger: zap.NewNop().Sugar(), PromAPI: m}
+	attributions, err := attributor.Attribute(context.Background(), map[string][]string{
+		"api":    {"user_id"},
+		"worker": {"task_id"},
+	}, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, []LabelAttribution{
+		{Job: "api", Label: "user_id", Targets: []TargetContribution{
+			{Instance: "api-0:8080", ValueCount: 900, Responsible: true, ScrapeURL: "http://10.0.0.1:8080/metrics", Address: "10.0.0.1:8080", Health: "up"},
+			{Instance: "api-2:8080", ValueCount: 25},
+			{Instance: "api-1:8080", ValueCount: 20},
+		}},
+		{Job: "worker", Label: "task_id", Targets: []TargetContribution{
+			{Instance: "worker-0:8080", ValueCount: 5000},
+		}},
+	}, attributions)
+	assert.Equal(t, attributions, attributor.Last())
+	assert.Equal(t, []string{"api-0:8080"}, attributor.Responsible("api", "user_id"))
+	assert.Empty(t, attributor.Responsible("worker", "task_id"))
+	assert.Empty(t, attributor.Responsible("api", "path"))
+}
+
+func scopedAttributor(job, label string, instances ...string) *TargetAttributor {
+	attribution := LabelAttribution{Job: job, Label: label}
+	for _, i := range instances {
+		attribution.Targets = append(attribution.Targets, TargetContribution{Instance: i, Responsible: true})
+	}
+	return &TargetAttributor{last: map[[2]string]LabelAttribution{{job, label}: attribution}}
+}
+
+func TestPromConfigRewriter_Plan_scopedToInstances(t *testing.T) {
+	running := runningConfig(t, "./fixtures/2-scrape-jobs-expected-1-label.yaml")
+	writer := planRewriter(t, nil, running)
+	writer.Targets = scopedAttributor("some-job", "anotherBadLabel", "10.0.0.1:8080", "10.0.0.2:8080")
+
+	plan, err := writer.Plan(context.Background(), map[string][]string{
+		"some-job":       {"anotherBadLabel"},
+		"some-other-job": {"somevalue"},
+	}, nil, "../some/path")
+	assert.Nil(t, err)
+	assert.Equal(t, []JobPlan{
+		{Job: "some-job", Scoped: []ScopedDrop{{Label: "anotherBadLabel", Instances: []string{"10.0.0.1:8080", "10.0.0.2:8080"}}}},
+		{Job: "some-other-job", Added: []string{"somevalue"}},
+	}, plan.Jobs)
+	assert.Equal(t, map[string][]string{
+		"some-job":       {"anotherBadLabel"},
+		"some-other-job": {"somevalue"},
+	}, plan.Dropped())
+	assert.Contains(t, plan.Diff, `+  - source_labels: [instance]
++    regex: '10\.0\.0\.1:8080|10\.0\.0\.2:8080'
++    target_label: anotherBadLabel
++    replacement: cardinanny_dropped
++    action: replace
+`)
+
+	planned, err := config.Load(plan.Config, false, plog.NewNopLogger())
+	assert.Nil(t, err)
+	rules := planned.ScrapeConfigs[0].MetricRelabelConfigs
+	assert.Len(t, rules, 2)
+	drop, ok := scopedDropLabel(rules[1])
+	assert.True(t, ok)
+	assert.Equal(t, ScopedDrop{Label: "anotherBadLabel", Instances: []string{"10.0.0.1:8080", "10.0.0.2:8080"}}, drop)
+	assert.True(t, rules[1].Regex.MatchString("10.0.0.1:8080"))
+	assert.False(t, rules[1].Regex.MatchString("10.0.0.10:8080"))
+
+	// planning the same drop again changes nothing
+	writer = planRewriter(t, nil, planned.String())
+	writer.Targets = scopedAttributor("some-job", "anotherBadLabel", "10.0.0.1:8080")
+	again, err := writer.Plan(context.Background(), map[string][]string{"some-job": {"anotherBadLabel"}}, nil, "../some/path")
+	assert.Nil(t, err)
+	assert.True(t, again.Empty())
+
+	// restoring the label removes the scoped rule
+	writer = planRewriter(t, nil, planned.String())
+	restore, err := writer.Plan(context.Background(), nil, map[string][]string{"some-job": {"anotherBadLabel"}}, "../some/path")
+	assert.Nil(t, err)
+	assert.Equal(t, []JobPlan{{Job: "some-job", Removed: []string{"anotherBadLabel"}}}, restore.Jobs)
+	assert.NotContains(t, restore.Config, ScopedDropValue)
+	assert.Contains(t, restore.Config, "regex: somevalue")
+}
+
+func TestEditConfigDocument_scopedDropsInFlowStyle(t *testing.T) {
+	edited, err := editConfigDocument(`scrape_configs: [{job_name: api}]
+`, nil, nil, map[string][]ScopedDrop{"api": {{Label: "user_id", Instances: []string{"api-0:8080"}}}}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, `scrape_configs: [{job_name: api, metric_relabel_configs: [{source_labels: [instance], regex: 'api-0:8080', target_label: user_id, replacement: cardinanny_dropped, action: replace}]}]
+`, edited)
+
+	restored, err := editConfigDocument(edited, nil, nil, nil, map[string][]string{"api": {"user_id"}})
+	assert.Nil(t, err)
+	assert.Equal(t, `scrape_configs: [{job_name: api}]
+`, restored)
+}
+
+func TestRegexInstances(t *testing.T) {
+	for _, instances := range [][]string{
+		{"api-0:8080"},
+		{"api-0:8080", "api-1:8080"},
+		{`a|b:80`, `c\d:80`},
+	} {
+		assert.Equal(t, instances, regexInstances(instancesRegex(instances)))
+	}
+
+	// a regex written by hand is kept whole
+	assert.Equal(t, []string{`api-.*:8080|web-0`}, regexInstances(`api-.*:8080|web-0`))
+}
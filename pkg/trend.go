@@ -0,0 +1,223 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+type TrendSample struct {
+	Time  time.Time
+	Value uint64
+}
+
+// TrendFinding is a label whose value count is growing fast enough to be
+// remediated before it reaches the limit. An empty Job means the count is
+// across all jobs.
+type TrendFinding struct {
+	Label         string
+	Job           string
+	Current       uint64
+	GrowthPerHour float64
+	CrossesLimit  time.Time
+}
+
+type trendKey struct {
+	label string
+	job   string
+}
+
+// DefaultTrendLabels is how many of the labels with the most values have
+// their growth tracked.
+const DefaultTrendLabels = 10
+
+// TrendDetector keeps a history of label value counts per job and flags
+// labels which grow faster than MaxGrowthPerHour, or which are projected to
+// cross Limit within Horizon, in a job. Either check is disabled when zero.
+type TrendDetector struct {
+	Limit            uint64
+	MaxGrowthPerHour float64
+	Horizon          time.Duration
+	Window           time.Duration
+	// Labels is how many of the labels with the most values are tracked,
+	// DefaultTrendLabels when not set.
+	Labels int
+
+	mu      sync.Mutex
+	history map[trendKey][]TrendSample
+}
+
+func (d *TrendDetector) Observe(t time.Time, job, label string, value uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.history == nil {
+		d.history = map[trendKey][]TrendSample{}
+	}
+
+	k := trendKey{label: label, job: job}
+	samples := append(d.history[k], TrendSample{Time: t, Value: value})
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+
+	cutoff := t.Add(-d.Window)
+	for len(samples) > 0 && d.Window > 0 && samples[0].Time.Before(cutoff) {
+		samples = samples[1:]
+	}
+	d.history[k] = samples
+}
+
+// growthPerHour is the least squares slope of the samples.
+func growthPerHour(samples []TrendSample) float64 {
+	n := float64(len(samples))
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range samples {
+		x := s.Time.Sub(samples[0].Time).Hours()
+		y := float64(s.Value)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// Detect flags the labels growing too fast. Labels which have not been seen
+// for a whole window are forgotten.
+func (d *TrendDetector) Detect(now time.Time) []TrendFinding {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var findings []TrendFinding
+	for k, samples := range d.history {
+		if d.Window > 0 && len(samples) > 0 && samples[len(samples)-1].Time.Before(now.Add(-d.Window)) {
+			delete(d.history, k)
+			continue
+		}
+		if len(samples) < 2 {
+			continue
+		}
+
+		last := samples[len(samples)-1]
+		if last.Value > d.Limit {
+			// already over the hard limit, the scan will find it anyway
+			continue
+		}
+
+		growth := growthPerHour(samples)
+		if growth <= 0 {
+			continue
+		}
+
+		crosses := last.Time.Add(time.Duration(float64(d.Limit-last.Value) / growth * float64(time.Hour)))
+
+		tooFast := d.MaxGrowthPerHour > 0 && growth > d.MaxGrowthPerHour
+		crossesSoon := d.Horizon > 0 && !crosses.After(now.Add(d.Horizon))
+
+		if tooFast || crossesSoon {
+			findings = append(findings, TrendFinding{
+				Label:         k.label,
+				Job:           k.job,
+				Current:       last.Value,
+				GrowthPerHour: growth,
+				CrossesLimit:  crosses,
+			})
+		}
+	}
+
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].Label != findings[j].Label {
+			return findings[i].Label < findings[j].Label
+		}
+		return findings[i].Job < findings[j].Job
+	})
+	return findings
+}
+
+func countValuesByJobQuery(labelName string) string {
+	return fmt.Sprintf("count by (job) (count by (job, %s)({%s=~\".+\"}))", labelName, labelName)
+}
+
+// TopLabels returns the labels to track out of label value counts, the ones
+// with the most values.
+func (d *TrendDetector) TopLabels(stats []v1.Stat) []string {
+	n := d.Labels
+	if n <= 0 {
+		n = DefaultTrendLabels
+	}
+
+	sorted := append([]v1.Stat{}, stats...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Value > sorted[j].Value })
+
+	var labels []string
+	for _, s := range sorted {
+		if len(labels) == n {
+			break
+		}
+		if s.Name == model.MetricNameLabel || s.Name == "job" {
+			continue
+		}
+		labels = append(labels, s.Name)
+	}
+	return labels
+}
+
+// ObserveJobs records the value count of each label in each job at now.
+func (d *TrendDetector) ObserveJobs(ctx context.Context, promAPI v1.API, labels []string, now time.Time) error {
+	for _, label := range labels {
+		r, _, err := promAPI.Query(ctx, countValuesByJobQuery(label), now)
+		if err != nil {
+			return fmt.Errorf("error querying the promtheus API for the value count of label %s, %w", label, err)
+		}
+
+		vec, ok := r.(model.Vector)
+		if !ok {
+			continue
+		}
+		for _, s := range vec {
+			d.Observe(now, string(s.Metric["job"]), label, uint64(s.Value))
+		}
+	}
+	return nil
+}
+
+// Backfill loads per job history for labels from Prometheus so trends can be
+// detected straight away instead of after several scans.
+func (d *TrendDetector) Backfill(ctx context.Context, promAPI v1.API, labels []string, end time.Time) error {
+	if d.Window <= 0 {
+		return nil
+	}
+
+	for _, label := range labels {
+		r, _, err := promAPI.QueryRange(ctx, countValuesByJobQuery(label), v1.Range{
+			Start: end.Add(-d.Window),
+			End:   end,
+			Step:  d.Window / 30,
+		})
+		if err != nil {
+			return fmt.Errorf("error querying the promtheus API for the history of label %s, %w", label, err)
+		}
+
+		matrix, ok := r.(model.Matrix)
+		if !ok {
+			continue
+		}
+
+		for _, stream := range matrix {
+			job := string(stream.Metric["job"])
+			for _, p := range stream.Values {
+				d.Observe(p.Timestamp.Time(), job, label, uint64(p.Value))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mclarke47/cardinanny/mock_v1"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+var trendStart = time.Date(2021, 8, 20, 10, 0, 0, 0, time.UTC)
+
+func Test_TrendDetector_flagsFastGrowth(t *testing.T) {
+	d := TrendDetector{Limit: 10000, MaxGrowthPerHour: 100, Window: 24 * time.Hour}
+
+	d.Observe(trendStart, "", "fast", 100)
+	d.Observe(trendStart.Add(time.Hour), "", "fast", 300)
+	d.Observe(trendStart, "", "slow", 100)
+	d.Observe(trendStart.Add(time.Hour), "", "slow", 150)
+
+	findings := d.Detect(trendStart.Add(time.Hour))
+
+	assert.Len(t, findings, 1)
+	assert.Equal(t, "fast", findings[0].Label)
+	assert.Equal(t, uint64(300), findings[0].Current)
+	assert.InDelta(t, 200, findings[0].GrowthPerHour, 0.001)
+}
+
+func Test_TrendDetector_flagsProjectedLimitCrossing(t *testing.T) {
+	d := TrendDetector{Limit: 1000, Horizon: 6 * time.Hour, Window: 24 * time.Hour}
+
+	d.Observe(trendStart, "some-job", "v1", 400)
+	d.Observe(trendStart.Add(time.Hour), "some-job", "v1", 500)
+	d.Observe(trendStart, "some-job", "v2", 100)
+	d.Observe(trendStart.Add(time.Hour), "some-job", "v2", 110)
+
+	findings := d.Detect(trendStart.Add(time.Hour))
+
+	assert.Equal(t, []TrendFinding{
+		{
+			Label:         "v1",
+			Job:           "some-job",
+			Current:       500,
+			GrowthPerHour: 100,
+			CrossesLimit:  trendStart.Add(6 * time.Hour),
+		},
+	}, findings)
+}
+
+func Test_TrendDetector_ignoresShrinkingAndOldSamples(t *testing.T) {
+	d := TrendDetector{Limit: 1000, MaxGrowthPerHour: 10, Window: time.Hour}
+
+	d.Observe(trendStart, "", "shrinking", 500)
+	d.Observe(trendStart.Add(30*time.Minute), "", "shrinking", 400)
+
+	d.Observe(trendStart, "", "old", 100)
+	d.Observe(trendStart.Add(3*time.Hour), "", "old", 900)
+
+	assert.Len(t, d.Detect(trendStart.Add(3*time.Hour)), 0)
+}
+
+func Test_TrendDetector_Backfill(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	m.
+		EXPECT().
+		QueryRange(gomock.Any(), gomock.Eq("count by (job) (count by (job, v1)({v1=~\".+\"}))"), gomock.Eq(v1.Range{
+			Start: trendStart.Add(-30 * time.Minute),
+			End:   trendStart,
+			Step:  time.Minute,
+		})).
+		Return(model.Matrix{
+			{
+				Metric: model.Metric{"job": "some-job"},
+				Values: []model.SamplePair{
+					{Timestamp: model.TimeFromUnixNano(trendStart.Add(-20 * time.Minute).UnixNano()), Value: 100},
+					{Timestamp: model.TimeFromUnixNano(trendStart.UnixNano()), Value: 400},
+				},
+			},
+		}, nil, nil)
+
+	d := TrendDetector{Limit: 1000, MaxGrowthPerHour: 100, Window: 30 * time.Minute}
+
+	assert.Nil(t, d.Backfill(context.Background(), m, []string{"v1"}, trendStart))
+
+	// the next scan observes the same label in the same job
+	d.Observe(trendStart.Add(time.Minute), "some-job", "v1", 420)
+
+	findings := d.Detect(trendStart.Add(time.Minute))
+	assert.Len(t, findings, 1)
+	assert.Equal(t, "some-job", findings[0].Job)
+	assert.Equal(t, uint64(420), findings[0].Current)
+}
+
+func Test_TrendDetector_forgetsLabelsNoLongerSeen(t *testing.T) {
+	d := TrendDetector{Limit: 1000, MaxGrowthPerHour: 10, Window: time.Hour}
+
+	d.Observe(trendStart, "", "gone", 100)
+	d.Observe(trendStart.Add(30*time.Minute), "", "gone", 500)
+	assert.Len(t, d.Detect(trendStart.Add(30*time.Minute)), 1)
+
+	assert.Len(t, d.Detect(trendStart.Add(2*time.Hour)), 0)
+	assert.Len(t, d.history, 0)
+}
+
+func Test_CardinalityScanner_scanIncludesGrowingLabels(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := mock_v1.NewMockAPI(ctrl)
+	m.
+		EXPECT().
+		TSDB(gomock.Any()).
+		Return(v1.TSDBResult{
+			LabelValueCountByLabelName: []v1.Stat{{Name: "v1", Value: 40}},
+		}, nil)
+
+	m.
+		EXPECT().
+		Query(gomock.Any(), gomock.Eq("count by (job) (count by (job, v1)({v1=~\".+\"}))"), gomock.Any()).
+		Return(model.Vector{
+			{
+				Metric: model.Metric{"job": "some-job"},
+				Value:  40,
+			},
+			{
+				Metric: model.Metric{"job": "other-job"},
+				Value:  5,
+			},
+		}, nil, nil)
+
+	trend := &TrendDetector{Limit: 50, Horizon: time.Hour, Window: 24 * time.Hour}
+	trend.Observe(time.Now().Add(-10*time.Minute), "some-job", "v1", 10)
+	trend.Observe(time.Now().Add(-10*time.Minute), "other-job", "v1", 5)
+
+	scanner := CardinalityScanner{
+		PromAPI:         m,
+		Logger:          zap.NewNop().Sugar(),
+		LabelCountLimit: 50,
+		Trend:           trend,
+	}
+
+	result, err := scanner.Scan(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{"some-job": {"v1"}}, result)
+}
+
+func Test_TrendDetector_TopLabels(t *testing.T) {
+	d := TrendDetector{Labels: 2}
+
+	labels := d.TopLabels([]v1.Stat{
+		{Name: "small", Value: 5},
+		{Name: "job", Value: 100},
+		{Name: "big", Value: 50},
+		{Name: "medium", Value: 20},
+	})
+
+	assert.Equal(t, []string{"big", "medium"}, labels)
+}
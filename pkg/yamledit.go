@@ -0,0 +1,458 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// The prometheus config is edited in place rather than written back out from
+// config.Config, which would expand every default, drop the comments and mask
+// secrets. yaml.v3 is only used to find the relabel rules, the changes are
+// spliced into the original lines so everything else is kept as written.
+
+var errUnsupportedLayout = errors.New("config layout can not be edited in place")
+
+func mappingValue(m *yaml.Node, key string) (int, *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i, m.Content[i+1]
+		}
+	}
+	return -1, nil
+}
+
+func scalarNode(v string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+}
+
+// nodeLabelNames is regexLabelNames for a relabel rule node.
+func nodeLabelNames(rule *yaml.Node) (*yaml.Node, []string, bool) {
+	if rule.Kind != yaml.MappingNode {
+		return nil, nil, false
+	}
+	_, action := mappingValue(rule, "action")
+	_, regex := mappingValue(rule, "regex")
+	if action == nil || regex == nil || strings.ToLower(action.Value) != "labeldrop" {
+		return nil, nil, false
+	}
+
+	names := strings.Split(regex.Value, "|")
+	for _, n := range names {
+		if !model.LabelName(n).IsValid() {
+			return nil, nil, false
+		}
+	}
+	return regex, names, true
+}
+
+// nodeScopedDrop is scopedDropLabel for a relabel rule node.
+func nodeScopedDrop(rule *yaml.Node) (string, bool) {
+	if rule.Kind != yaml.MappingNode {
+		return "", false
+	}
+	_, sources := mappingValue(rule, "source_labels")
+	_, target := mappingValue(rule, "target_label")
+	_, replacement := mappingValue(rule, "replacement")
+	if sources == nil || target == nil || replacement == nil || replacement.Value != ScopedDropValue {
+		return "", false
+	}
+	if _, action := mappingValue(rule, "action"); action != nil && strings.ToLower(action.Value) != "replace" {
+		return "", false
+	}
+	if sources.Kind != yaml.SequenceNode || len(sources.Content) != 1 || sources.Content[0].Value != "instance" {
+		return "", false
+	}
+	return target.Value, true
+}
+
+func parseConfigDocument(doc string) (*yaml.Node, *yaml.Node, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(doc), &root); err != nil {
+		return nil, nil, err
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("prometheus config is not a YAML mapping")
+	}
+
+	_, scrapeConfigs := mappingValue(root.Content[0], "scrape_configs")
+	if scrapeConfigs == nil {
+		return nil, nil, fmt.Errorf("prometheus config has no scrape_configs")
+	}
+	return &root, scrapeConfigs, nil
+}
+
+func jobName(job *yaml.Node) string {
+	if _, name := mappingValue(job, "job_name"); name != nil {
+		return name.Value
+	}
+	return ""
+}
+
+// editConfigDocument makes the given labeldrop and scoped drop changes to the
+// prometheus config document, leaving everything else as it was written.
+// Documents using flow style where rules are added are re-encoded instead,
+// which keeps the comments but not the formatting.
+func editConfigDocument(doc string, added, merged map[string][]string, scoped map[string][]ScopedDrop, removed map[string][]string) (string, error) {
+	edited, err := spliceConfigDocument(doc, added, merged, scoped, removed)
+	if errors.Is(err, errUnsupportedLayout) {
+		return encodeConfigDocument(doc, added, merged, scoped, removed)
+	}
+	return edited, err
+}
+
+type lineEdit struct {
+	// start and end are the lines replaced, an insertion when they are equal.
+	start, end int
+	lines      []string
+}
+
+type configDocument struct {
+	lines []string
+	order []*yaml.Node
+	index map[*yaml.Node]int
+	edits []lineEdit
+}
+
+func (d *configDocument) walk(n *yaml.Node) {
+	d.index[n] = len(d.order)
+	d.order = append(d.order, n)
+	for _, c := range n.Content {
+		d.walk(c)
+	}
+}
+
+// lastLine returns the last line of the node, the line before the node which
+// follows it without the blank lines and comments in between.
+func (d *configDocument) lastLine(n *yaml.Node) int {
+	last := n
+	for len(last.Content) > 0 {
+		last = last.Content[len(last.Content)-1]
+	}
+
+	end := len(d.lines)
+	if i := d.index[last] + 1; i < len(d.order) {
+		end = d.order[i].Line - 1
+	}
+	for end > last.Line {
+		if l := strings.TrimSpace(d.lines[end-1]); l != "" && !strings.HasPrefix(l, "#") {
+			break
+		}
+		end--
+	}
+	if end < last.Line {
+		return last.Line
+	}
+	return end
+}
+
+// itemColumns returns the columns of the dash and the keys of a block
+// sequence item.
+func (d *configDocument) itemColumns(item *yaml.Node) (int, int, error) {
+	if item.Kind != yaml.MappingNode || item.Style&yaml.FlowStyle != 0 {
+		return 0, 0, errUnsupportedLayout
+	}
+	line := d.lines[item.Line-1]
+	if item.Column-1 > len(line) {
+		return 0, 0, errUnsupportedLayout
+	}
+	prefix := line[:item.Column-1]
+	if strings.TrimSpace(prefix) != "-" {
+		return 0, 0, errUnsupportedLayout
+	}
+	return strings.Index(prefix, "-"), item.Column - 1, nil
+}
+
+func (d *configDocument) setRegex(regex *yaml.Node, value string) error {
+	line := d.lines[regex.Line-1]
+	start := regex.Column - 1
+	if start >= len(line) {
+		return errUnsupportedLayout
+	}
+
+	var end int
+	switch regex.Style {
+	case 0:
+		end = start + len(regex.Value)
+		if end > len(line) || line[start:end] != regex.Value {
+			return errUnsupportedLayout
+		}
+	case yaml.SingleQuotedStyle, yaml.DoubleQuotedStyle:
+		quote := line[start]
+		i := strings.IndexByte(line[start+1:], quote)
+		if i < 0 {
+			return errUnsupportedLayout
+		}
+		end = start + i + 2
+		value = string(quote) + value + string(quote)
+	default:
+		return errUnsupportedLayout
+	}
+
+	d.edits = append(d.edits, lineEdit{regex.Line - 1, regex.Line, []string{line[:start] + value + line[end:]}})
+	return nil
+}
+
+func labelDropLines(dashColumn int, labels []string) []string {
+	return []string{
+		strings.Repeat(" ", dashColumn) + "- regex: " + strings.Join(labels, "|"),
+		strings.Repeat(" ", dashColumn+2) + "action: labeldrop",
+	}
+}
+
+func scopedDropLines(dashColumn int, d ScopedDrop) []string {
+	indent := strings.Repeat(" ", dashColumn+2)
+	return []string{
+		strings.Repeat(" ", dashColumn) + "- source_labels: [instance]",
+		indent + "regex: '" + strings.ReplaceAll(instancesRegex(d.Instances), "'", "''") + "'",
+		indent + "target_label: " + d.Label,
+		indent + "replacement: " + ScopedDropValue,
+		indent + "action: replace",
+	}
+}
+
+// newRuleLines are the lines of the rules added to a job.
+func newRuleLines(dashColumn int, added []string, scoped []ScopedDrop) []string {
+	var lines []string
+	if len(added) > 0 {
+		lines = labelDropLines(dashColumn, added)
+	}
+	for _, d := range scoped {
+		lines = append(lines, scopedDropLines(dashColumn, d)...)
+	}
+	return lines
+}
+
+// editJob makes the same changes to the lines of a job as addLabelDrops,
+// addScopedDrops and removeLabelDrops make to its config. seqIndent is how far
+// the document indents sequence items from their key.
+func (d *configDocument) editJob(job *yaml.Node, seqIndent int, added, merged []string, scoped []ScopedDrop, removed []string) error {
+	if job.Kind != yaml.MappingNode || job.Style&yaml.FlowStyle != 0 || len(job.Content) == 0 {
+		return errUnsupportedLayout
+	}
+
+	keyIndex, rules := mappingValue(job, "metric_relabel_configs")
+	if rules != nil && (rules.Kind != yaml.SequenceNode || rules.Style&yaml.FlowStyle != 0 || len(rules.Content) == 0) {
+		return errUnsupportedLayout
+	}
+
+	var ruleEdits []lineEdit
+	kept := 0
+	if rules != nil {
+		for _, rule := range rules.Content {
+			if label, ok := nodeScopedDrop(rule); ok && containsString(removed, label) {
+				if _, _, err := d.itemColumns(rule); err != nil {
+					return err
+				}
+				ruleEdits = append(ruleEdits, lineEdit{rule.Line - 1, d.lastLine(rule), nil})
+				continue
+			}
+
+			regex, names, ok := nodeLabelNames(rule)
+			if !ok {
+				kept++
+				continue
+			}
+
+			var remaining []string
+			for _, n := range names {
+				if !containsString(removed, n) {
+					remaining = append(remaining, n)
+				}
+			}
+			if len(remaining) == 0 {
+				if _, _, err := d.itemColumns(rule); err != nil {
+					return err
+				}
+				ruleEdits = append(ruleEdits, lineEdit{rule.Line - 1, d.lastLine(rule), nil})
+				continue
+			}
+
+			kept++
+			if len(merged) > 0 {
+				remaining = append(remaining, merged...)
+				merged = nil
+			}
+			if len(remaining) != len(names) {
+				if err := d.setRegex(regex, strings.Join(remaining, "|")); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	adding := len(added) > 0 || len(scoped) > 0
+	switch {
+	case adding && rules != nil:
+		dashColumn, _, err := d.itemColumns(rules.Content[0])
+		if err != nil {
+			return err
+		}
+		end := d.lastLine(rules)
+		ruleEdits = append(ruleEdits, lineEdit{end, end, newRuleLines(dashColumn, added, scoped)})
+	case adding:
+		keyColumn := job.Content[0].Column - 1
+		end := d.lastLine(job)
+		lines := append([]string{strings.Repeat(" ", keyColumn) + "metric_relabel_configs:"}, newRuleLines(keyColumn+seqIndent, added, scoped)...)
+		ruleEdits = append(ruleEdits, lineEdit{end, end, lines})
+	case rules != nil && kept == 0:
+		key := job.Content[keyIndex]
+		ruleEdits = []lineEdit{{key.Line - 1, d.lastLine(rules), nil}}
+	}
+
+	d.edits = append(d.edits, ruleEdits...)
+	return nil
+}
+
+func spliceConfigDocument(doc string, added, merged map[string][]string, scoped map[string][]ScopedDrop, removed map[string][]string) (string, error) {
+	root, scrapeConfigs, err := parseConfigDocument(doc)
+	if err != nil {
+		return "", err
+	}
+	if scrapeConfigs.Kind != yaml.SequenceNode || scrapeConfigs.Style&yaml.FlowStyle != 0 {
+		return "", errUnsupportedLayout
+	}
+
+	d := &configDocument{lines: strings.Split(doc, "\n"), index: map[*yaml.Node]int{}}
+	d.walk(root)
+
+	seqIndent := 0
+	if len(scrapeConfigs.Content) > 0 {
+		dashColumn, _, err := d.itemColumns(scrapeConfigs.Content[0])
+		if err != nil {
+			return "", err
+		}
+		key, _ := mappingValue(root.Content[0], "scrape_configs")
+		seqIndent = dashColumn - (root.Content[0].Content[key].Column - 1)
+	}
+
+	for _, job := range scrapeConfigs.Content {
+		name := jobName(job)
+		if len(added[name]) == 0 && len(merged[name]) == 0 && len(scoped[name]) == 0 && len(removed[name]) == 0 {
+			continue
+		}
+		if err := d.editJob(job, seqIndent, added[name], merged[name], scoped[name], removed[name]); err != nil {
+			return "", err
+		}
+	}
+
+	// Applied from the bottom up so the line numbers of the edits still to
+	// make do not move.
+	sort.SliceStable(d.edits, func(i, j int) bool { return d.edits[i].start > d.edits[j].start })
+	lines := d.lines
+	for _, e := range d.edits {
+		lines = append(lines[:e.start], append(append([]string{}, e.lines...), lines[e.end:]...)...)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func scopedDropNode(d ScopedDrop) *yaml.Node {
+	sources := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Style: yaml.FlowStyle, Content: []*yaml.Node{scalarNode("instance")}}
+	return &yaml.Node{
+		Kind: yaml.MappingNode,
+		Tag:  "!!map",
+		Content: []*yaml.Node{
+			scalarNode("source_labels"), sources,
+			scalarNode("regex"), scalarNode(instancesRegex(d.Instances)),
+			scalarNode("target_label"), scalarNode(d.Label),
+			scalarNode("replacement"), scalarNode(ScopedDropValue),
+			scalarNode("action"), scalarNode("replace"),
+		},
+	}
+}
+
+func editJobNode(job *yaml.Node, added, merged []string, scoped []ScopedDrop, removed []string) {
+	keyIndex, rules := mappingValue(job, "metric_relabel_configs")
+
+	if len(removed) > 0 && rules != nil {
+		var kept []*yaml.Node
+		for _, rule := range rules.Content {
+			if label, ok := nodeScopedDrop(rule); ok && containsString(removed, label) {
+				continue
+			}
+
+			regex, names, ok := nodeLabelNames(rule)
+			if !ok {
+				kept = append(kept, rule)
+				continue
+			}
+
+			var remaining []string
+			for _, n := range names {
+				if !containsString(removed, n) {
+					remaining = append(remaining, n)
+				}
+			}
+			if len(remaining) == 0 {
+				continue
+			}
+			regex.Value = strings.Join(remaining, "|")
+			kept = append(kept, rule)
+		}
+		rules.Content = kept
+	}
+
+	if len(merged) > 0 && rules != nil {
+		for _, rule := range rules.Content {
+			if regex, names, ok := nodeLabelNames(rule); ok {
+				regex.Value = strings.Join(append(names, merged...), "|")
+				break
+			}
+		}
+	}
+
+	if len(added) > 0 || len(scoped) > 0 {
+		if rules == nil {
+			rules = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			job.Content = append(job.Content, scalarNode("metric_relabel_configs"), rules)
+			keyIndex = len(job.Content) - 2
+		}
+	}
+	if len(added) > 0 {
+		rules.Content = append(rules.Content, &yaml.Node{
+			Kind: yaml.MappingNode,
+			Tag:  "!!map",
+			Content: []*yaml.Node{
+				scalarNode("regex"), scalarNode(strings.Join(added, "|")),
+				scalarNode("action"), scalarNode("labeldrop"),
+			},
+		})
+	}
+	for _, d := range scoped {
+		rules.Content = append(rules.Content, scopedDropNode(d))
+	}
+
+	if rules != nil && len(rules.Content) == 0 {
+		job.Content = append(job.Content[:keyIndex], job.Content[keyIndex+2:]...)
+	}
+}
+
+func encodeConfigDocument(doc string, added, merged map[string][]string, scoped map[string][]ScopedDrop, removed map[string][]string) (string, error) {
+	root, scrapeConfigs, err := parseConfigDocument(doc)
+	if err != nil {
+		return "", err
+	}
+
+	for _, job := range scrapeConfigs.Content {
+		name := jobName(job)
+		if len(added[name]) > 0 || len(merged[name]) > 0 || len(scoped[name]) > 0 || len(removed[name]) > 0 {
+			editJobNode(job, added[name], merged[name], scoped[name], removed[name])
+		}
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
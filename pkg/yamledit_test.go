@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const commentedConfig = `# managed by hand, see the runbook
+global:
+  scrape_interval: 5s # keep in sync with grafana
+
+rule_files:
+  - rules/*.yml
+
+scrape_configs:
+  # the api servers
+  - job_name: api
+    basic_auth:
+      username: prometheus
+      password: hunter2
+    static_configs:
+      - targets: ["api:8080"] # only one for now
+
+  - job_name: worker
+    metric_relabel_configs:
+      - source_labels: [__name__]
+        regex: go_.*
+        action: drop
+      - regex: 'somevalue'
+        action: labeldrop
+    static_configs:
+      - targets: ["worker:8080"]
+`
+
+func TestEditConfigDocument_keepsTheRestOfTheDocument(t *testing.T) {
+	edited, err := editConfigDocument(commentedConfig,
+		map[string][]string{"api": {"user_id"}},
+		map[string][]string{"worker": {"request_id"}},
+		nil,
+		nil,
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, `# managed by hand, see the runbook
+global:
+  scrape_interval: 5s # keep in sync with grafana
+
+rule_files:
+  - rules/*.yml
+
+scrape_configs:
+  # the api servers
+  - job_name: api
+    basic_auth:
+      username: prometheus
+      password: hunter2
+    static_configs:
+      - targets: ["api:8080"] # only one for now
+    metric_relabel_configs:
+      - regex: user_id
+        action: labeldrop
+
+  - job_name: worker
+    metric_relabel_configs:
+      - source_labels: [__name__]
+        regex: go_.*
+        action: drop
+      - regex: 'somevalue|request_id'
+        action: labeldrop
+    static_configs:
+      - targets: ["worker:8080"]
+`, edited)
+}
+
+func TestEditConfigDocument_removesEmptiedRules(t *testing.T) {
+	edited, err := editConfigDocument(yamlFixture(t, "./fixtures/2-scrape-jobs-expected-1-label-each.yaml"), nil, nil, nil, map[string][]string{
+		"some-job":       {"anotherBadLabel"},
+		"some-other-job": {"somevalue"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, yamlFixture(t, "./fixtures/2-scrape-jobs.yaml"), edited)
+
+	edited, err = editConfigDocument(commentedConfig, nil, nil, nil, map[string][]string{"worker": {"somevalue"}})
+	assert.Nil(t, err)
+	assert.NotContains(t, edited, "labeldrop")
+	assert.Contains(t, edited, "        action: drop\n    static_configs:\n")
+}
+
+func TestEditConfigDocument_indentlessSequences(t *testing.T) {
+	running := runningConfig(t, "./fixtures/2-scrape-jobs.yaml")
+
+	edited, err := editConfigDocument(running, map[string][]string{"some-job": {"somevalue"}}, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Contains(t, edited, "    - host.docker.internal:8888\n  metric_relabel_configs:\n  - regex: somevalue\n    action: labeldrop\n- job_name: some-other-job\n")
+	assertConfigsAreEquivalent(t, "./fixtures/2-scrape-jobs-expected-1-label.yaml", edited)
+}
+
+func TestEditConfigDocument_flowStyleIsReencoded(t *testing.T) {
+	edited, err := editConfigDocument(`scrape_configs: [{job_name: api, metric_relabel_configs: []}] # the only job
+`, map[string][]string{"api": {"user_id"}}, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, `scrape_configs: [{job_name: api, metric_relabel_configs: [{regex: user_id, action: labeldrop}]}] # the only job
+`, edited)
+}
+
+func TestPromConfigRewriter_PlanKeepsSecrets(t *testing.T) {
+	path := writeConfigFile(t, commentedConfig)
+
+	writer := planRewriter(t, nil, commentedConfig)
+	writer.DriftPolicy = DriftRefuse
+
+	plan, err := writer.Plan(context.Background(), map[string][]string{"api": {"user_id"}}, nil, path)
+	assert.Nil(t, err)
+	assert.Contains(t, plan.Config, "password: hunter2\n")
+	assert.Contains(t, plan.Diff, "+    metric_relabel_configs:\n+      - regex: user_id\n+        action: labeldrop\n")
+}